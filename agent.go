@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type agentOptions struct {
+	server    string
+	token     string
+	hostID    string
+	interval  time.Duration
+	transport string
+}
+
+// runAgent implements `server agent`: sample the local machine and push the
+// metrics to a tracker server instead of serving anything
+func runAgent(args []string) {
+	mustLoadConfig("agent")
+	opts := agentOptions{}
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.StringVar(&opts.server, "server", envOr("AGENT_SERVER_URL", "http://localhost:8081"), "tracker server base URL")
+	fs.StringVar(&opts.token, "token", os.Getenv("AGENT_TOKEN"), "agent token accepted by the server (AGENT_TOKENS)")
+	fs.StringVar(&opts.hostID, "host-id", localHostID, "host id reported to the server")
+	fs.DurationVar(&opts.interval, "interval", 5*time.Second, "sample interval")
+	fs.StringVar(&opts.transport, "transport", "ws", "push over a WebSocket (ws) or HTTP POSTs (http)")
+	fs.Parse(args)
+
+	if opts.token == "" {
+		fatal(agentLog, "Agent token is required (-token or AGENT_TOKEN)")
+	}
+	if opts.interval < time.Second {
+		fatal(agentLog, "Agent interval must be at least 1s")
+	}
+
+	agentLog.Info("Metrics agent started",
+		"host", opts.hostID, "server", opts.server, "interval", opts.interval.String(), "transport", opts.transport)
+
+	switch opts.transport {
+	case "ws":
+		runWSAgent(opts)
+	case "http":
+		runHTTPAgent(opts)
+	default:
+		fatal(agentLog, "Unknown agent transport", "transport", opts.transport)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (opts agentOptions) sample() (SystemMetrics, error) {
+	m, err := localCollector.Sample()
+	if err != nil {
+		return SystemMetrics{}, err
+	}
+	m.HostID = opts.hostID
+	return m, nil
+}
+
+func runHTTPAgent(opts agentOptions) {
+	endpoint := strings.TrimSuffix(opts.server, "/") + "/api/v1/agent/metrics"
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m, err := opts.sample()
+		if err != nil {
+			agentLog.Warn("Failed to collect metrics", "error", err)
+			continue
+		}
+
+		body, _ := json.Marshal(m)
+		req, _ := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+opts.token)
+		req.Header.Set("X-Host-ID", opts.hostID)
+
+		res, err := client.Do(req)
+		if err != nil {
+			agentLog.Warn("Failed to push metrics", "error", err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			agentLog.Warn("Server rejected metrics", "status", res.StatusCode)
+		}
+	}
+}
+
+func runWSAgent(opts agentOptions) {
+	endpoint, err := agentWSURL(opts.server)
+	if err != nil {
+		fatal(agentLog, "Invalid server URL", "error", err)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+opts.token)
+	header.Set("X-Host-ID", opts.hostID)
+
+	backoff := time.Second
+	for {
+		conn, res, err := websocket.DefaultDialer.Dial(endpoint, header)
+		if err != nil {
+			if res != nil && res.StatusCode == http.StatusUnauthorized {
+				fatal(agentLog, "Server rejected the agent token")
+			}
+			agentLog.Warn("Failed to connect", "endpoint", endpoint, "retry_in", backoff.String(), "error", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			continue
+		}
+
+		agentLog.Info("Agent connected", "endpoint", endpoint)
+		backoff = time.Second
+		wait := pushMetrics(conn, opts)
+		conn.Close()
+		if wait > 0 {
+			// spread the reconnects of all agents of a restarting server
+			wait += rand.N(wait/2 + 1)
+			agentLog.Info("Server is shutting down", "reconnect_in", wait.Round(time.Millisecond).String())
+			time.Sleep(wait)
+		}
+	}
+}
+
+// pushMetrics streams samples until the connection fails and returns the
+// delay a server going away asked for
+func pushMetrics(conn *websocket.Conn, opts agentOptions) time.Duration {
+	closed := make(chan time.Duration, 1)
+	go func() {
+		// reading handles pings and notices the server going away
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				agentLog.Info("Agent connection closed", "error", err)
+				closed <- reconnectHint(err)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case wait := <-closed:
+			return wait
+		case <-ticker.C:
+			m, err := opts.sample()
+			if err != nil {
+				agentLog.Warn("Failed to collect metrics", "error", err)
+				continue
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(m); err != nil {
+				agentLog.Warn("Failed to push metrics", "error", err)
+				return 0
+			}
+		}
+	}
+}
+
+// reconnectHint reads the delay from the close frame of a server shutting down
+func reconnectHint(err error) time.Duration {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		return 0
+	}
+	var hint shutdownHint
+	if json.Unmarshal([]byte(closeErr.Text), &hint) != nil {
+		return 0
+	}
+	return time.Duration(hint.ReconnectAfterMs) * time.Millisecond
+}
+
+func agentWSURL(server string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(server, "/"))
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	u.Path += "/ws/agent"
+	return u.String(), nil
+}
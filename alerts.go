@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+const (
+	// alertHistoryLimit is how many alert events are kept in memory for the API
+	alertHistoryLimit = 1000
+
+	// alertHistoryMaxBytes is the size at which alerts.jsonl is rotated to
+	// alerts.jsonl.1, replacing the previous rotation
+	alertHistoryMaxBytes = 10 << 20
+
+	// alertSweepInterval is how often alerts of hosts gone offline are resolved
+	alertSweepInterval = 10 * time.Second
+)
+
+// dataDir holds the state the server keeps on local disk (server.data_dir)
+var dataDir = "data"
+
+// AlertRule fires when Metric compared to Threshold holds for For on a host
+// matching one of Hosts (glob patterns, empty matches every host)
+type AlertRule struct {
+	Name        string   `json:"name"`
+	Metric      string   `json:"metric"`
+	Comparator  string   `json:"comparator"`
+	Threshold   float64  `json:"threshold"`
+	For         string   `json:"for,omitempty"`
+	Hosts       []string `json:"hosts,omitempty"`
+	Severity    string   `json:"severity,omitempty"`
+	Description string   `json:"description,omitempty"`
+
+	duration time.Duration
+}
+
+// Alert is the state of a rule on one host, also used as history event
+type Alert struct {
+	ID          string  `json:"id"`
+	Rule        string  `json:"rule"`
+	HostID      string  `json:"host_id"`
+	Metric      string  `json:"metric"`
+	Comparator  string  `json:"comparator"`
+	Threshold   float64 `json:"threshold"`
+	Value       float64 `json:"value"`
+	State       string  `json:"state"`
+	Severity    string  `json:"severity,omitempty"`
+	Description string  `json:"description,omitempty"`
+	StartsAt    string  `json:"starts_at"`
+	FiredAt     string  `json:"fired_at,omitempty"`
+	ResolvedAt  string  `json:"resolved_at,omitempty"`
+	Reason      string  `json:"reason,omitempty"` // why an alert resolved without a sample
+	Timestamp   string  `json:"timestamp"`
+}
+
+// defaultAlertRules are used when ALERT_RULES_FILE is not set
+var defaultAlertRules = []AlertRule{
+	{
+		Name:        "high-cpu",
+		Metric:      "cpu",
+		Comparator:  ">",
+		Threshold:   90,
+		For:         "5m",
+		Severity:    "warning",
+		Description: "CPU usage above 90% for 5 minutes",
+	},
+	{
+		Name:        "high-memory",
+		Metric:      "memory",
+		Comparator:  ">",
+		Threshold:   90,
+		For:         "5m",
+		Severity:    "warning",
+		Description: "Memory usage above 90% for 5 minutes",
+	},
+}
+
+// alertMetrics are the SystemMetrics values rules can refer to. The boolean
+// is false when the sample does not carry the value, e.g. a v1 agent.
+var alertMetrics = map[string]func(SystemMetrics) (float64, bool){
+	"cpu":            func(m SystemMetrics) (float64, bool) { return m.CPU, true },
+	"memory":         func(m SystemMetrics) (float64, bool) { return m.Memory, true },
+	"used_mem_bytes": func(m SystemMetrics) (float64, bool) { return float64(m.UsedMemBytes), m.UsedMemBytes > 0 },
+	"available_mem_bytes": func(m SystemMetrics) (float64, bool) {
+		return float64(m.AvailableMemBytes), m.AvailableMemBytes > 0
+	},
+	"load1": func(m SystemMetrics) (float64, bool) {
+		if m.Load == nil {
+			return 0, false
+		}
+		return m.Load.Load1, true
+	},
+	"load5": func(m SystemMetrics) (float64, bool) {
+		if m.Load == nil {
+			return 0, false
+		}
+		return m.Load.Load5, true
+	},
+	"load15": func(m SystemMetrics) (float64, bool) {
+		if m.Load == nil {
+			return 0, false
+		}
+		return m.Load.Load15, true
+	},
+	"swap_percent": func(m SystemMetrics) (float64, bool) {
+		if m.Swap == nil {
+			return 0, false
+		}
+		return m.Swap.UsedPercent, true
+	},
+	// disk_used_percent is the fullest filesystem of the host
+	"disk_used_percent": func(m SystemMetrics) (float64, bool) {
+		var max float64
+		for _, d := range m.Disks {
+			if d.UsedPercent > max {
+				max = d.UsedPercent
+			}
+		}
+		return max, len(m.Disks) > 0
+	},
+	"container_cpu_percent": func(m SystemMetrics) (float64, bool) {
+		if m.Container == nil {
+			return 0, false
+		}
+		return m.Container.CPUUsagePercent, true
+	},
+	"container_memory_percent": func(m SystemMetrics) (float64, bool) {
+		if m.Container == nil || m.Container.MemoryLimitBytes == 0 {
+			return 0, false
+		}
+		return m.Container.MemoryUsagePercent, true
+	},
+}
+
+func compare(value float64, comparator string, threshold float64) bool {
+	switch comparator {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+	return false
+}
+
+func (rule *AlertRule) validate() error {
+	if rule.Name == "" {
+		return fmt.Errorf("rule without name")
+	}
+	if _, ok := alertMetrics[rule.Metric]; !ok {
+		return fmt.Errorf("rule %s: unknown metric %q", rule.Name, rule.Metric)
+	}
+	switch rule.Comparator {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return fmt.Errorf("rule %s: unknown comparator %q", rule.Name, rule.Comparator)
+	}
+	if rule.For != "" {
+		d, err := time.ParseDuration(rule.For)
+		if err != nil || d < 0 {
+			return fmt.Errorf("rule %s: invalid duration %q", rule.Name, rule.For)
+		}
+		rule.duration = d
+	}
+	for _, pattern := range rule.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("rule %s: invalid host pattern %q", rule.Name, pattern)
+		}
+	}
+	return nil
+}
+
+func (rule *AlertRule) matchesHost(hostID string) bool {
+	if len(rule.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Hosts {
+		if ok, _ := path.Match(pattern, hostID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAlertRules reads a JSON array of rules, falling back to the defaults
+// when file is empty
+func loadAlertRules(file string) ([]AlertRule, error) {
+	rules := defaultAlertRules
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		rules = nil
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	validated := make([]AlertRule, 0, len(rules))
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+		validated = append(validated, rule)
+	}
+	return validated, nil
+}
+
+// AlertEngine evaluates the rules on every host sample. Each rule and host
+// pair moves from pending to firing once the condition held long enough and
+// to resolved when it clears; only these transitions are published.
+type AlertEngine struct {
+	mutex   sync.RWMutex
+	rules   []AlertRule
+	active  map[string]*Alert
+	history []Alert
+
+	file     *os.File
+	fileSize int64
+	path     string
+	es       *ESClient
+	started  time.Time
+}
+
+func alertKey(rule, host string) string {
+	return rule + "|" + host
+}
+
+// newAlertEngine loads the rules and the persisted history, restoring the
+// alerts that were still firing so a restart does not notify them again
+func newAlertEngine(rulesFile string, es *ESClient) (*AlertEngine, error) {
+	rules, err := loadAlertRules(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &AlertEngine{
+		rules:   rules,
+		active:  make(map[string]*Alert),
+		es:      es,
+		started: time.Now(),
+	}
+
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	e.path = filepath.Join(dataDir, "alerts.jsonl")
+	e.loadHistory()
+	if err := e.openFile(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *AlertEngine) openFile() error {
+	f, err := os.OpenFile(e.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	e.file, e.fileSize = f, info.Size()
+	return nil
+}
+
+// loadHistory reads the rotated file, then the current one
+func (e *AlertEngine) loadHistory() {
+	last := make(map[string]Alert)
+	for _, name := range []string{e.path + ".1", e.path} {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var alert Alert
+			if err := json.Unmarshal(scanner.Bytes(), &alert); err != nil {
+				continue
+			}
+			e.history = append(e.history, alert)
+			if len(e.history) > alertHistoryLimit {
+				e.history = e.history[len(e.history)-alertHistoryLimit:]
+			}
+			last[alertKey(alert.Rule, alert.HostID)] = alert
+		}
+		f.Close()
+	}
+
+	for key, alert := range last {
+		if alert.State == AlertFiring && e.rule(alert.Rule) != nil {
+			restored := alert
+			e.active[key] = &restored
+		}
+	}
+	if len(e.active) > 0 {
+		alertsLog.Info("Restored firing alerts", "count", len(e.active))
+	}
+}
+
+func (e *AlertEngine) rule(name string) *AlertRule {
+	for i := range e.rules {
+		if e.rules[i].Name == name {
+			return &e.rules[i]
+		}
+	}
+	return nil
+}
+
+// Evaluate applies every rule to a sample and returns the alerts that
+// started firing or resolved
+func (e *AlertEngine) Evaluate(m SystemMetrics, at time.Time) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var events []Alert
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if !rule.matchesHost(m.HostID) {
+			continue
+		}
+		value, ok := alertMetrics[rule.Metric](m)
+		if !ok {
+			continue
+		}
+
+		key := alertKey(rule.Name, m.HostID)
+		alert, active := e.active[key]
+
+		if !compare(value, rule.Comparator, rule.Threshold) {
+			if !active {
+				continue
+			}
+			delete(e.active, key)
+			if alert.State == AlertFiring {
+				alert.State = AlertResolved
+				alert.Value = value
+				alert.ResolvedAt = at.Format(time.RFC3339)
+				alert.Timestamp = alert.ResolvedAt
+				events = append(events, *alert)
+			}
+			continue
+		}
+
+		if !active {
+			alert = &Alert{
+				ID:          fmt.Sprintf("%s-%s-%d", rule.Name, m.HostID, at.Unix()),
+				Rule:        rule.Name,
+				HostID:      m.HostID,
+				Metric:      rule.Metric,
+				Comparator:  rule.Comparator,
+				Threshold:   rule.Threshold,
+				State:       AlertPending,
+				Severity:    rule.Severity,
+				Description: rule.Description,
+				StartsAt:    at.Format(time.RFC3339),
+			}
+			e.active[key] = alert
+		}
+		alert.Value = value
+		alert.Timestamp = at.Format(time.RFC3339)
+
+		if alert.State == AlertPending {
+			startsAt, _ := time.Parse(time.RFC3339, alert.StartsAt)
+			if at.Sub(startsAt) >= rule.duration {
+				alert.State = AlertFiring
+				alert.FiredAt = at.Format(time.RFC3339)
+				events = append(events, *alert)
+			}
+		}
+	}
+
+	for _, event := range events {
+		e.record(event)
+	}
+	return events
+}
+
+// record appends an event to the history, the history file and Elasticsearch
+func (e *AlertEngine) record(alert Alert) {
+	e.history = append(e.history, alert)
+	if len(e.history) > alertHistoryLimit {
+		e.history = e.history[len(e.history)-alertHistoryLimit:]
+	}
+
+	if data, err := json.Marshal(alert); err == nil {
+		if err := e.write(data); err != nil {
+			alertsLog.Error("Failed to persist alert", "alert", alert.ID, "error", err)
+		}
+	}
+
+	if e.es != nil {
+		e.es.Background(func() {
+			if err := e.es.IndexDocument(context.Background(), "alerts", alert); err != nil {
+				alertsLog.Error("Failed to index alert", "alert", alert.ID, "index", "alerts", "error", err)
+			}
+		})
+	}
+
+	alertsLog.Info("Alert "+string(alert.State),
+		"alert", alert.ID, "rule", alert.Rule, "host", alert.HostID, "metric", alert.Metric,
+		"comparator", alert.Comparator, "threshold", alert.Threshold, "value", alert.Value)
+}
+
+// write appends one line to the history file, rotating it when full. The
+// caller holds the mutex.
+func (e *AlertEngine) write(line []byte) error {
+	if e.file == nil {
+		return fmt.Errorf("alert history is closed")
+	}
+	if e.fileSize+int64(len(line))+1 > alertHistoryMaxBytes {
+		if err := e.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := e.file.Write(append(line, '\n'))
+	e.fileSize += int64(n)
+	return err
+}
+
+// rotate moves the history file to alerts.jsonl.1 and starts a new one with
+// the alerts still firing, so a restart restores them from either file
+func (e *AlertEngine) rotate() error {
+	if err := e.file.Close(); err != nil {
+		alertsLog.Warn("Failed to close alert history", "error", err)
+	}
+	e.file = nil
+	if err := os.Rename(e.path, e.path+".1"); err != nil {
+		return err
+	}
+	if err := e.openFile(); err != nil {
+		return err
+	}
+	alertsLog.Info("Rotated alert history", "file", e.path+".1")
+
+	for _, alert := range e.active {
+		if alert.State != AlertFiring {
+			continue
+		}
+		data, err := json.Marshal(alert)
+		if err != nil {
+			continue
+		}
+		n, err := e.file.Write(append(data, '\n'))
+		e.fileSize += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResolveOffline resolves the alerts of hosts that stopped reporting, which
+// no sample would ever clear. Pending ones are dropped. Alerts restored at
+// startup get hostOfflineAfter for their agent to come back.
+func (e *AlertEngine) ResolveOffline(online func(hostID string) bool, at time.Time) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var events []Alert
+	for key, alert := range e.active {
+		if online(alert.HostID) {
+			continue
+		}
+		if at.Sub(e.started) < hostOfflineAfter {
+			continue
+		}
+		if last, err := time.Parse(time.RFC3339, alert.Timestamp); err == nil && at.Sub(last) < hostOfflineAfter {
+			continue
+		}
+		delete(e.active, key)
+		if alert.State == AlertFiring {
+			alert.State = AlertResolved
+			alert.ResolvedAt = at.Format(time.RFC3339)
+			alert.Timestamp = alert.ResolvedAt
+			alert.Reason = "host offline"
+			events = append(events, *alert)
+		}
+	}
+
+	for _, event := range events {
+		e.record(event)
+	}
+	return events
+}
+
+// runAlertSweeper periodically resolves the alerts of offline hosts and
+// broadcasts them like the ones Evaluate returns
+func runAlertSweeper(hub *Hub) {
+	ticker := time.NewTicker(alertSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-hub.quit:
+			return
+		case now = <-ticker.C:
+		}
+
+		if !hub.startProducing() {
+			return
+		}
+		for _, alert := range hub.alerts.ResolveOffline(hub.hosts.Online, now) {
+			hub.broadcast <- BroadcastMessage{
+				Type:    "alert",
+				Data:    alert,
+				EventID: now.Format("20060102150405"),
+				Host:    alert.HostID,
+			}
+		}
+		hub.producing.RUnlock()
+	}
+}
+
+// Active returns the pending and firing alerts, optionally of one state
+func (e *AlertEngine) Active(state string) []Alert {
+	e.mutex.RLock()
+	alerts := make([]Alert, 0, len(e.active))
+	for _, alert := range e.active {
+		if state == "" || alert.State == state {
+			alerts = append(alerts, *alert)
+		}
+	}
+	e.mutex.RUnlock()
+
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].StartsAt < alerts[j].StartsAt })
+	return alerts
+}
+
+// Close syncs and closes the history file, alerts recorded afterwards are
+// only kept in memory and Elasticsearch
+func (e *AlertEngine) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.file == nil {
+		return nil
+	}
+	f := e.file
+	e.file = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SetRules replaces the rules. Alerts of rules that no longer exist are
+// dropped, the others keep their state and are evaluated with the new rule.
+func (e *AlertEngine) SetRules(rules []AlertRule) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.rules = rules
+	for key, alert := range e.active {
+		if e.rule(alert.Rule) == nil {
+			delete(e.active, key)
+		}
+	}
+}
+
+func (e *AlertEngine) Rules() []AlertRule {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return append([]AlertRule(nil), e.rules...)
+}
+
+// AlertHistoryQuery filters the alert history, newest first
+type AlertHistoryQuery struct {
+	HostID string
+	Rule   string
+	State  string
+	Since  time.Time
+	Limit  int
+}
+
+func (e *AlertEngine) History(q AlertHistoryQuery) []Alert {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	alerts := []Alert{}
+	for i := len(e.history) - 1; i >= 0; i-- {
+		alert := e.history[i]
+		if q.HostID != "" && alert.HostID != q.HostID {
+			continue
+		}
+		if q.Rule != "" && alert.Rule != q.Rule {
+			continue
+		}
+		if q.State != "" && alert.State != q.State {
+			continue
+		}
+		if !q.Since.IsZero() {
+			if t, err := time.Parse(time.RFC3339, alert.Timestamp); err == nil && t.Before(q.Since) {
+				continue
+			}
+		}
+		alerts = append(alerts, alert)
+		if q.Limit > 0 && len(alerts) >= q.Limit {
+			break
+		}
+	}
+	return alerts
+}
+
+// Firing counts the firing alerts per severity for the Prometheus gauge
+func (e *AlertEngine) Firing() map[string]int {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, alert := range e.active {
+		if alert.State == AlertFiring {
+			counts[strings.ToLower(alert.Severity)]++
+		}
+	}
+	return counts
+}
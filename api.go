@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"status": "error",
+		"error":  message,
+	})
+}
+
+// authorizeAdmin checks the admin bearer token and writes the error response
+// The management endpoints are guarded by server.admin_token and disabled
+// when it is not set.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := currentConfig().Server.AdminToken
+	if adminToken == "" {
+		writeError(w, http.StatusServiceUnavailable, "admin API is disabled, set ADMIN_TOKEN")
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid admin token")
+		return false
+	}
+	return true
+}
+
+func leaderboardHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	params := r.URL.Query()
+
+	q := LeaderboardQuery{
+		Window:   params.Get("window"),
+		Team:     params.Get("team"),
+		Language: params.Get("language"),
+		Project:  params.Get("project"),
+		Limit:    10,
+	}
+	if q.Window == "" {
+		q.Window = WindowWeek
+	}
+	if !validWindow(q.Window) {
+		writeError(w, http.StatusBadRequest, "window must be one of week, month, all")
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+		q.Limit = n
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"window":    q.Window,
+		"team":      q.Team,
+		"language":  q.Language,
+		"project":   q.Project,
+		"entries":   hub.leaderboard.Query(q),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+func getPrivacyHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	writeJSON(w, http.StatusOK, hub.leaderboard.GetPrivacy(r.PathValue("user")))
+}
+
+// putPrivacyHandler is admin only, otherwise anybody could unhide a user
+// who opted out
+func putPrivacyHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	var privacy UserPrivacy
+	if err := json.NewDecoder(r.Body).Decode(&privacy); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	if update, changed := hub.leaderboard.SetPrivacy(r.PathValue("user"), privacy); changed {
+		hub.broadcast <- BroadcastMessage{
+			Type:    "leaderboard",
+			Data:    update,
+			EventID: time.Now().Format("20060102150405"),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, privacy)
+}
+
+func presenceHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", PresenceOnline, PresenceIdle, PresenceOffline:
+	default:
+		writeError(w, http.StatusBadRequest, "state must be one of online, idle, offline")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"users":     hub.presence.List(r.URL.Query().Get("team"), state),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// parseTime accepts RFC3339 timestamps and unix seconds
+func parseTime(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func metricsHistoryHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	params := r.URL.Query()
+
+	host := params.Get("host")
+	if host == "" {
+		host = localHostID
+	}
+
+	to := time.Now()
+	if v := params.Get("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "to must be RFC3339 or unix seconds")
+			return
+		}
+		to = t
+	}
+
+	from := to.Add(-time.Hour)
+	if v := params.Get("range"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "range must be a positive duration such as 1h")
+			return
+		}
+		from = to.Add(-d)
+	}
+	if v := params.Get("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "from must be RFC3339 or unix seconds")
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	// default to at most ~300 points
+	step := to.Sub(from) / 300
+	if v := params.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "step must be a positive duration such as 10s")
+			return
+		}
+		step = d
+	}
+
+	points, step := hub.history.Query(host, from, to, step)
+	writeJSON(w, http.StatusOK, MetricsHistoryResponse{
+		HostID:      host,
+		From:        from.Format(time.RFC3339),
+		To:          to.Format(time.RFC3339),
+		StepSeconds: step.Seconds(),
+		Points:      points,
+	})
+}
+
+func alertsHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", AlertPending, AlertFiring:
+	default:
+		writeError(w, http.StatusBadRequest, "state must be one of pending, firing")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"alerts":    hub.alerts.Active(state),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+func alertRulesHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rules": hub.alerts.Rules(),
+	})
+}
+
+func alertHistoryHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	params := r.URL.Query()
+
+	q := AlertHistoryQuery{
+		HostID: params.Get("host"),
+		Rule:   params.Get("rule"),
+		State:  params.Get("state"),
+		Limit:  100,
+	}
+	switch q.State {
+	case "", AlertFiring, AlertResolved:
+	default:
+		writeError(w, http.StatusBadRequest, "state must be one of firing, resolved")
+		return
+	}
+	if v := params.Get("since"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "since must be RFC3339 or unix seconds")
+			return
+		}
+		q.Since = t
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+		q.Limit = n
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"alerts":    hub.alerts.History(q),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request, webhooks *WebhookDispatcher) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"webhooks": webhooks.List(),
+	})
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request, webhooks *WebhookDispatcher) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	created, err := webhooks.Create(hook)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request, webhooks *WebhookDispatcher) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	hook, deliveries, ok := webhooks.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown webhook")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"webhook":    hook,
+		"deliveries": deliveries,
+	})
+}
+
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request, webhooks *WebhookDispatcher) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	updated, ok, err := webhooks.Update(r.PathValue("id"), hook)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown webhook")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request, webhooks *WebhookDispatcher) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	if !webhooks.Delete(r.PathValue("id")) {
+		writeError(w, http.StatusNotFound, "unknown webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func pingWebhookHandler(w http.ResponseWriter, r *http.Request, webhooks *WebhookDispatcher) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	if !webhooks.Ping(r.PathValue("id")) {
+		writeError(w, http.StatusNotFound, "unknown webhook")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status": "queued",
+	})
+}
+
+// summaryHandler returns the coding summary of a day (default yesterday) or,
+// with period=week, of the last 7 days
+func summaryHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	params := r.URL.Query()
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	from, to := today.AddDate(0, 0, -1), today
+	switch params.Get("period") {
+	case "", "day":
+		if v := params.Get("date"); v != "" {
+			day, err := time.ParseInLocation("2006-01-02", v, now.Location())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "date must be YYYY-MM-DD")
+				return
+			}
+			from, to = day, day.AddDate(0, 0, 1)
+		}
+	case "week":
+		from, to = now.AddDate(0, 0, -7), now
+	default:
+		writeError(w, http.StatusBadRequest, "period must be one of day, week")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, buildSummary(hub, from, to, params.Get("team")))
+}
+
+func notificationChannelsHandler(w http.ResponseWriter, r *http.Request, notifier *Notifier) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"channels": notifier.Channels(),
+	})
+}
+
+// testNotificationHandler posts the channel's summary right away
+func testNotificationHandler(w http.ResponseWriter, r *http.Request, notifier *Notifier) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	channel, ok := notifier.Channel(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown channel")
+		return
+	}
+	go notifier.sendSummary(channel, time.Now())
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status": "queued",
+	})
+}
+
+func subscribeReportsHandler(w http.ResponseWriter, r *http.Request, reporter *Reporter) {
+	if !reporter.enabled() {
+		writeError(w, http.StatusServiceUnavailable, "email reports are disabled, set SMTP_HOST")
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !reporter.Allow(ip) {
+		writeError(w, http.StatusTooManyRequests, "too many subscription requests, try again later")
+		return
+	}
+
+	var sub ReportSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	if err := reporter.Subscribe(sub); errors.Is(err, errConfirmationPending) {
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status": "confirmation sent",
+	})
+}
+
+// confirmReportsHandler confirms a new subscription or the change of a
+// confirmed one, the change link carries the new user and team
+func confirmReportsHandler(w http.ResponseWriter, r *http.Request, reporter *Reporter) {
+	token := r.URL.Query().Get("token")
+	if change, ok := reporter.verify("change", token); ok {
+		email, scope, _ := strings.Cut(change, "\n")
+		user, team, _ := strings.Cut(scope, "\n")
+		if !reporter.ApplyChange(email, user, team) {
+			reportPage(w, http.StatusNotFound, "This confirmation link is invalid or the subscription no longer exists.")
+			return
+		}
+		reportPage(w, http.StatusOK, "Change confirmed, "+email+" will receive the updated coding reports.")
+		return
+	}
+
+	email, ok := reporter.verify("confirm", token)
+	if !ok || !reporter.Confirm(email) {
+		reportPage(w, http.StatusNotFound, "This confirmation link is invalid or the subscription no longer exists.")
+		return
+	}
+	reportPage(w, http.StatusOK, "Subscription confirmed, "+email+" will receive the coding reports.")
+}
+
+// unsubscribeReportsHandler serves the link in the reports and the
+// List-Unsubscribe one-click POST
+func unsubscribeReportsHandler(w http.ResponseWriter, r *http.Request, reporter *Reporter) {
+	email, ok := reporter.verify("unsubscribe", r.URL.Query().Get("token"))
+	if !ok {
+		reportPage(w, http.StatusNotFound, "This unsubscribe link is invalid.")
+		return
+	}
+	reporter.Unsubscribe(email)
+	reportPage(w, http.StatusOK, email+" will not receive any more coding reports.")
+}
+
+func listReportSubscriptionsHandler(w http.ResponseWriter, r *http.Request, reporter *Reporter) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"schedule":      reporter.settings.Load().schedule.String(),
+		"subscriptions": reporter.Subscriptions(),
+	})
+}
+
+// sendReportsHandler sends the reports right away for the period ending now
+func sendReportsHandler(w http.ResponseWriter, r *http.Request, reporter *Reporter) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if !reporter.enabled() {
+		writeError(w, http.StatusServiceUnavailable, "email reports are disabled, set SMTP_HOST")
+		return
+	}
+
+	go reporter.SendAll(time.Now())
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status": "sending",
+	})
+}
+
+func listProjectsHandler(w http.ResponseWriter, r *http.Request, projects *ProjectCatalog) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"projects": projects.List(),
+	})
+}
+
+func putProjectHandler(w http.ResponseWriter, r *http.Request, projects *ProjectCatalog) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	var project ProjectInfo
+	if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+	project.Name = r.PathValue("name")
+
+	saved, err := projects.Put(project)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, saved)
+}
+
+func deleteProjectHandler(w http.ResponseWriter, r *http.Request, projects *ProjectCatalog) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	ok, err := projects.Delete(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown project")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	badgeColorBlue  = "#007ec6"
+	badgeColorGreen = "#4c1"
+	badgeColorGrey  = "#9f9f9f"
+)
+
+var badgeWindowLabels = map[string]string{
+	WindowWeek:  "last 7 days",
+	WindowMonth: "this month",
+	WindowAll:   "all time",
+}
+
+// badgeHandler serves GET /badge/{user}/{metric}.svg with metric one of
+// time, language or streak. Query parameters: window (week, month, all),
+// language (time only), label, color and style (flat, flat-square).
+func badgeHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	user := r.PathValue("user")
+	metric, ok := strings.CutSuffix(r.PathValue("file"), ".svg")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	params := r.URL.Query()
+	window := params.Get("window")
+	if window == "" {
+		window = WindowWeek
+	}
+	if !validWindow(window) {
+		writeError(w, http.StatusBadRequest, "window must be one of week, month, all")
+		return
+	}
+
+	privacy := hub.leaderboard.GetPrivacy(user)
+	now := time.Now()
+
+	var label, value, color string
+	switch metric {
+	case "time":
+		label, color = "coded", badgeColorBlue
+		language := params.Get("language")
+		total, languages := hub.leaderboard.UserTotals(user, window, now)
+		if language != "" {
+			total = 0
+			for name, seconds := range languages {
+				if strings.EqualFold(name, language) {
+					total += seconds
+					language = name
+				}
+			}
+		}
+		value = formatSeconds(total) + " " + badgeWindowLabels[window]
+		if language != "" {
+			value += " in " + language
+			if privacy.HideDetails {
+				value = "private"
+			}
+		}
+
+	case "language":
+		label, color = "top language "+badgeWindowLabels[window], badgeColorBlue
+		_, languages := hub.leaderboard.UserTotals(user, window, now)
+		value = topKey(languages)
+		if value == "" {
+			value, color = "none", badgeColorGrey
+		}
+		if privacy.HideDetails {
+			value = "private"
+		}
+
+	case "streak":
+		label, color = "coding streak", badgeColorGreen
+		days := hub.leaderboard.Streak(user, now)
+		value = fmt.Sprintf("%d days", days)
+		if days == 1 {
+			value = "1 day"
+		}
+		if days == 0 {
+			color = badgeColorGrey
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, "unknown badge, use time.svg, language.svg or streak.svg")
+		return
+	}
+
+	if privacy.HideBadges {
+		value = "private"
+	}
+	if value == "private" {
+		color = badgeColorGrey
+	}
+	if v := params.Get("label"); v != "" {
+		label = v
+	}
+	if v := params.Get("color"); v != "" {
+		color = badgeColor(v, color)
+	}
+
+	svg := renderBadge(label, value, color, params.Get("style") == "flat-square")
+
+	sum := sha256.Sum256([]byte(svg))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	// badges.max_age is how long clients and README proxies may cache a badge
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", currentConfig().Badges.MaxAge))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.Write([]byte(svg))
+}
+
+// badgeColor accepts hex colors without the leading # as used in URLs, or named ones
+func badgeColor(v, fallback string) string {
+	named := map[string]string{
+		"blue": badgeColorBlue, "green": badgeColorGreen, "grey": badgeColorGrey, "gray": badgeColorGrey,
+		"orange": "#fe7d37", "red": "#e05d44", "yellow": "#dfb317", "purple": "#8a63d2",
+	}
+	if c, ok := named[strings.ToLower(v)]; ok {
+		return c
+	}
+	v = strings.TrimPrefix(v, "#")
+	if len(v) != 3 && len(v) != 6 {
+		return fallback
+	}
+	if _, err := strconv.ParseUint(v, 16, 32); err != nil {
+		return fallback
+	}
+	return "#" + v
+}
+
+// textWidth approximates the width of s in 11px Verdana, which is what
+// shields-style badges are laid out for
+func textWidth(s string) int {
+	width := 0.0
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune("il.,:;|!'", c):
+			width += 3.5
+		case strings.ContainsRune("fjrt()[] ", c):
+			width += 4.5
+		case strings.ContainsRune("mwMW", c):
+			width += 10
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			width += 7.5
+		default:
+			width += 6.5
+		}
+	}
+	return int(width + 0.5)
+}
+
+func renderBadge(label, value, color string, square bool) string {
+	labelW := textWidth(label) + 10
+	valueW := textWidth(value) + 10
+	total := labelW + valueW
+	radius := "3"
+	if square {
+		radius = "0"
+	}
+
+	label = html.EscapeString(label)
+	value = html.EscapeString(value)
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="%[7]s" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="%[2]d" height="20" fill="#555"/>
+<rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/>
+<rect width="%[1]d" height="20" fill="url(#s)"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[4]s</text>
+<text x="%[8]d" y="14">%[4]s</text>
+<text x="%[9]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text>
+<text x="%[9]d" y="14">%[5]s</text>
+</g>
+</svg>
+`, total, labelW, valueW, label, value, color, radius, labelW/2, labelW+valueW/2)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// ContainerMetrics are the server's own cgroup values. They are reported next
+// to, never instead of, the host-wide values of SystemMetrics.
+type ContainerMetrics struct {
+	CgroupVersion int    `json:"cgroup_version"`
+	Runtime       string `json:"runtime,omitempty"`
+
+	// CPUQuotaCores is the CPU limit in cores, 0 when unlimited
+	CPUQuotaCores float64 `json:"cpu_quota_cores"`
+	// CPUUsageCores is the average number of cores used since the previous sample
+	CPUUsageCores float64 `json:"cpu_usage_cores"`
+	// CPUUsagePercent is relative to the quota, or to all host cores when unlimited
+	CPUUsagePercent       float64 `json:"cpu_usage_percent"`
+	CPUUsageSecondsTotal  float64 `json:"cpu_usage_seconds_total"`
+	PeriodsTotal          uint64  `json:"periods_total"`
+	ThrottledPeriodsTotal uint64  `json:"throttled_periods_total"`
+	ThrottledSecondsTotal float64 `json:"throttled_seconds_total"`
+
+	MemoryUsageBytes      uint64 `json:"memory_usage_bytes"`
+	MemoryWorkingSetBytes uint64 `json:"memory_working_set_bytes"`
+	// MemoryLimitBytes is 0 when unlimited
+	MemoryLimitBytes   uint64  `json:"memory_limit_bytes"`
+	MemoryUsagePercent float64 `json:"memory_usage_percent,omitempty"`
+	// MemoryLimitHitsTotal counts how often usage reached the limit
+	MemoryLimitHitsTotal uint64 `json:"memory_limit_hits_total"`
+	OOMEventsTotal       uint64 `json:"oom_events_total"`
+	OOMKillsTotal        uint64 `json:"oom_kills_total"`
+}
+
+// cgroupReader reads the cgroup of the current process
+type cgroupReader struct {
+	version int
+	runtime string
+
+	// v2 uses a single directory, v1 one per controller
+	dir        string
+	cpuDir     string
+	cpuacctDir string
+	memoryDir  string
+
+	prevUsage float64
+	prevAt    time.Time
+}
+
+// newCgroupReader returns nil when cgroup metrics should not be reported.
+// Mode (metrics.cgroup) true forces them outside containers, false disables them.
+func newCgroupReader(mode string) *cgroupReader {
+	if mode == "false" {
+		return nil
+	}
+
+	paths := parseProcCgroup("/proc/self/cgroup")
+	runtime := detectContainerRuntime(paths)
+	if runtime == "" && mode != "true" {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		return &cgroupReader{
+			version: 2,
+			runtime: runtime,
+			dir:     cgroupDir(cgroupRoot, paths[""]),
+		}
+	}
+
+	r := &cgroupReader{
+		version:    1,
+		runtime:    runtime,
+		cpuDir:     cgroupV1Dir(paths, "cpu", "cpu,cpuacct"),
+		cpuacctDir: cgroupV1Dir(paths, "cpuacct", "cpu,cpuacct"),
+		memoryDir:  cgroupV1Dir(paths, "memory"),
+	}
+	if r.cpuacctDir == "" && r.memoryDir == "" {
+		return nil
+	}
+	return r
+}
+
+// parseProcCgroup maps each controller to its cgroup path, "" being the v2 unified hierarchy
+func parseProcCgroup(path string) map[string]string {
+	paths := make(map[string]string)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return paths
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			paths[controller] = parts[2]
+		}
+		paths[parts[1]] = parts[2]
+	}
+	return paths
+}
+
+func detectContainerRuntime(paths map[string]string) string {
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	if _, err := os.Stat("/var/run/secrets/kubernetes.io"); err == nil {
+		return "kubernetes"
+	}
+	for _, path := range paths {
+		for _, marker := range []string{"docker", "kubepods", "containerd", "libpod", "lxc"} {
+			if strings.Contains(path, marker) {
+				return marker
+			}
+		}
+	}
+	return ""
+}
+
+// cgroupDir resolves the cgroup path below mount, falling back to the mount
+// itself when the process runs in its own cgroup namespace
+func cgroupDir(mount, path string) string {
+	if path != "" {
+		dir := filepath.Join(mount, path)
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+	}
+	return mount
+}
+
+func cgroupV1Dir(paths map[string]string, controller string, mounts ...string) string {
+	for _, name := range append([]string{controller}, mounts...) {
+		mount := filepath.Join(cgroupRoot, name)
+		if _, err := os.Stat(mount); err == nil {
+			return cgroupDir(mount, paths[controller])
+		}
+	}
+	return ""
+}
+
+func readCgroupString(dir, file string) (string, bool) {
+	if dir == "" {
+		return "", false
+	}
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+func readCgroupUint(dir, file string) (uint64, bool) {
+	s, ok := readCgroupString(dir, file)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	return v, err == nil
+}
+
+// readCgroupKeyed parses "key value" files such as cpu.stat and memory.events
+func readCgroupKeyed(dir, file string) map[string]uint64 {
+	values := make(map[string]uint64)
+	s, ok := readCgroupString(dir, file)
+	if !ok {
+		return values
+	}
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values
+}
+
+// Read samples the cgroup; hostCores scales CPU usage when no quota is set
+func (r *cgroupReader) Read(hostCores int) *ContainerMetrics {
+	m := &ContainerMetrics{CgroupVersion: r.version, Runtime: r.runtime}
+	if r.version == 2 {
+		r.readV2(m)
+	} else {
+		r.readV1(m)
+	}
+
+	now := time.Now()
+	if !r.prevAt.IsZero() && m.CPUUsageSecondsTotal >= r.prevUsage {
+		if elapsed := now.Sub(r.prevAt).Seconds(); elapsed > 0 {
+			m.CPUUsageCores = (m.CPUUsageSecondsTotal - r.prevUsage) / elapsed
+		}
+	}
+	r.prevUsage = m.CPUUsageSecondsTotal
+	r.prevAt = now
+
+	limit := m.CPUQuotaCores
+	if limit == 0 {
+		limit = float64(hostCores)
+	}
+	if limit > 0 {
+		m.CPUUsagePercent = 100 * m.CPUUsageCores / limit
+	}
+	if m.MemoryLimitBytes > 0 {
+		m.MemoryUsagePercent = 100 * float64(m.MemoryUsageBytes) / float64(m.MemoryLimitBytes)
+	}
+
+	return m
+}
+
+func (r *cgroupReader) readV2(m *ContainerMetrics) {
+	if s, ok := readCgroupString(r.dir, "cpu.max"); ok {
+		fields := strings.Fields(s)
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, err1 := strconv.ParseFloat(fields[0], 64)
+			period, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 == nil && err2 == nil && period > 0 {
+				m.CPUQuotaCores = quota / period
+			}
+		}
+	}
+
+	cpuStat := readCgroupKeyed(r.dir, "cpu.stat")
+	m.CPUUsageSecondsTotal = float64(cpuStat["usage_usec"]) / 1e6
+	m.PeriodsTotal = cpuStat["nr_periods"]
+	m.ThrottledPeriodsTotal = cpuStat["nr_throttled"]
+	m.ThrottledSecondsTotal = float64(cpuStat["throttled_usec"]) / 1e6
+
+	m.MemoryUsageBytes, _ = readCgroupUint(r.dir, "memory.current")
+	if limit, ok := readCgroupUint(r.dir, "memory.max"); ok {
+		m.MemoryLimitBytes = limit
+	}
+	inactive := readCgroupKeyed(r.dir, "memory.stat")["inactive_file"]
+	m.MemoryWorkingSetBytes = workingSet(m.MemoryUsageBytes, inactive)
+
+	events := readCgroupKeyed(r.dir, "memory.events")
+	m.MemoryLimitHitsTotal = events["max"]
+	m.OOMEventsTotal = events["oom"]
+	m.OOMKillsTotal = events["oom_kill"]
+}
+
+func (r *cgroupReader) readV1(m *ContainerMetrics) {
+	quota, quotaOK := readCgroupString(r.cpuDir, "cpu.cfs_quota_us")
+	period, periodOK := readCgroupUint(r.cpuDir, "cpu.cfs_period_us")
+	if quotaOK && periodOK && period > 0 {
+		if q, err := strconv.ParseInt(quota, 10, 64); err == nil && q > 0 {
+			m.CPUQuotaCores = float64(q) / float64(period)
+		}
+	}
+
+	if usage, ok := readCgroupUint(r.cpuacctDir, "cpuacct.usage"); ok {
+		m.CPUUsageSecondsTotal = float64(usage) / 1e9
+	}
+	cpuStat := readCgroupKeyed(r.cpuDir, "cpu.stat")
+	m.PeriodsTotal = cpuStat["nr_periods"]
+	m.ThrottledPeriodsTotal = cpuStat["nr_throttled"]
+	m.ThrottledSecondsTotal = float64(cpuStat["throttled_time"]) / 1e9
+
+	m.MemoryUsageBytes, _ = readCgroupUint(r.memoryDir, "memory.usage_in_bytes")
+	// v1 reports "unlimited" as a page-aligned huge number
+	if limit, ok := readCgroupUint(r.memoryDir, "memory.limit_in_bytes"); ok && limit < 1<<62 {
+		m.MemoryLimitBytes = limit
+	}
+	inactive := readCgroupKeyed(r.memoryDir, "memory.stat")["total_inactive_file"]
+	m.MemoryWorkingSetBytes = workingSet(m.MemoryUsageBytes, inactive)
+
+	m.MemoryLimitHitsTotal, _ = readCgroupUint(r.memoryDir, "memory.failcnt")
+	// v1 has no OOM event counter, only kills (kernel 4.13+)
+	m.OOMKillsTotal = readCgroupKeyed(r.memoryDir, "memory.oom_control")["oom_kill"]
+}
+
+// workingSet mirrors what `docker stats` and the kubelet report as memory usage
+func workingSet(usage, inactiveFile uint64) uint64 {
+	if inactiveFile > usage {
+		return 0
+	}
+	return usage - inactiveFile
+}
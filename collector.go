@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// hostCollector samples SystemMetrics for the local machine. Samples are
+// cached for a short while so concurrent monitor clients and scrapes share
+// the same reading.
+type hostCollector struct {
+	mutex  sync.Mutex
+	last   SystemMetrics
+	lastAt time.Time
+	maxAge time.Duration
+
+	// topProcesses is how many processes to report, 0 disables the process list
+	topProcesses int
+
+	// previous IO counters used to compute rates
+	prevAt   time.Time
+	prevDisk map[string]disk.IOCountersStat
+	prevNet  map[string]net.IOCountersStat
+
+	// processes are kept between samples so CPU percent is measured over the interval
+	procs map[int32]*process.Process
+
+	// cgroup is nil outside containers
+	cgroup     *cgroupReader
+	cgroupMode string
+}
+
+// localCollector samples the machine the process runs on, it is set up by applyConfig
+var localCollector *hostCollector
+
+func newHostCollector(cfg MetricsConfig) *hostCollector {
+	c := &hostCollector{procs: make(map[int32]*process.Process)}
+	c.Configure(cfg)
+	return c
+}
+
+// Configure applies the metrics settings to the next samples
+func (c *hostCollector) Configure(cfg MetricsConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.topProcesses = cfg.TopProcesses
+	// a sample must be stale by the time the next tick asks for one
+	c.maxAge = 900 * time.Millisecond
+	if cfg.SampleInterval < time.Second {
+		c.maxAge = cfg.SampleInterval * 9 / 10
+	}
+	if cfg.Cgroup != c.cgroupMode {
+		c.cgroupMode = cfg.Cgroup
+		c.cgroup = newCgroupReader(cfg.Cgroup)
+	}
+}
+
+// runLocalMetrics samples the local machine every metrics.sample_interval for
+// the history, the monitor subscribers and the rollups, whether or not anyone
+// is connected. A changed interval takes effect after the current tick.
+func runLocalMetrics(hub *Hub) {
+	interval := currentConfig().Metrics.SampleInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hub.quit:
+			return
+		case <-ticker.C:
+		}
+
+		if next := currentConfig().Metrics.SampleInterval; next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+
+		metrics, err := localCollector.Sample()
+		if err != nil {
+			collectorLog.Warn("Failed to collect metrics", "error", err)
+			continue
+		}
+
+		hub.RecordMetrics(metrics, HostSourceLocal, "")
+	}
+}
+
+// Sample returns the latest metrics, collecting fresh ones when the cached sample is stale
+func (c *hostCollector) Sample() (SystemMetrics, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.lastAt.IsZero() && time.Since(c.lastAt) < c.maxAge {
+		return c.last, nil
+	}
+
+	metrics, err := c.collect()
+	if err != nil {
+		return SystemMetrics{}, err
+	}
+
+	c.last = metrics
+	c.lastAt = time.Now()
+	return metrics, nil
+}
+
+func (c *hostCollector) collect() (SystemMetrics, error) {
+	cpuPercent, err := cpu.Percent(0, false)
+	if err != nil || len(cpuPercent) == 0 {
+		return SystemMetrics{}, fmt.Errorf("failed to get CPU metrics: %v", err)
+	}
+
+	cpuInfo, err := cpu.Info()
+	if err != nil || len(cpuInfo) == 0 {
+		return SystemMetrics{}, fmt.Errorf("failed to get CPU info: %v", err)
+	}
+	coreCount, _ := cpu.Counts(true)
+
+	memStat, err := mem.VirtualMemory()
+	if err != nil {
+		return SystemMetrics{}, fmt.Errorf("failed to get memory info: %w", err)
+	}
+
+	hostInfo, err := host.Info()
+	if err != nil {
+		return SystemMetrics{}, fmt.Errorf("failed to get host info: %w", err)
+	}
+
+	now := time.Now()
+	metrics := SystemMetrics{
+		SchemaVersion:     MetricsSchemaVersion,
+		CPU:               cpuPercent[0],
+		CPUModel:          cpuInfo[0].ModelName,
+		Cores:             coreCount,
+		Memory:            memStat.UsedPercent,
+		TotalMem:          memStat.Total / 1024 / 1024 / 1024, // GB, kept for schema version 1
+		UsedMem:           memStat.Used / 1024 / 1024 / 1024,  // GB, kept for schema version 1
+		TotalMemBytes:     memStat.Total,
+		UsedMemBytes:      memStat.Used,
+		AvailableMemBytes: memStat.Available,
+		HostID:            localHostID,
+		Hostname:          hostInfo.Hostname,
+		OS:                hostInfo.OS,
+		Platform:          hostInfo.Platform,
+		Kernel:            hostInfo.KernelVersion,
+		Arch:              hostInfo.KernelArch,
+		Uptime:            hostInfo.Uptime,
+		Timestamp:         now.Format(time.RFC3339),
+	}
+
+	// The remaining readings are best effort: an unsupported platform or a
+	// restricted container should not take the whole sample down.
+	if perCore, err := cpu.Percent(0, true); err == nil {
+		metrics.CPUPerCore = perCore
+	}
+
+	if avg, err := load.Avg(); err == nil {
+		metrics.Load = &LoadAverage{Load1: avg.Load1, Load5: avg.Load5, Load15: avg.Load15}
+	}
+
+	if swap, err := mem.SwapMemory(); err == nil && swap.Total > 0 {
+		metrics.Swap = &SwapMetrics{
+			TotalBytes:  swap.Total,
+			UsedBytes:   swap.Used,
+			UsedPercent: swap.UsedPercent,
+		}
+	}
+
+	elapsed := now.Sub(c.prevAt).Seconds()
+	if c.prevAt.IsZero() {
+		elapsed = 0
+	}
+	metrics.Disks = c.collectDisks(elapsed)
+	metrics.Network = c.collectNetwork(elapsed)
+	c.prevAt = now
+
+	if c.topProcesses > 0 {
+		metrics.Processes = c.collectProcesses(memStat.Total)
+	}
+
+	if c.cgroup != nil {
+		metrics.Container = c.cgroup.Read(coreCount)
+	}
+
+	return metrics, nil
+}
+
+// rate returns the per second increase of a counter, 0 for the first sample or a reset
+func rate(current, previous uint64, elapsed float64) float64 {
+	if elapsed <= 0 || current < previous {
+		return 0
+	}
+	return float64(current-previous) / elapsed
+}
+
+func (c *hostCollector) collectDisks(elapsed float64) []DiskMetrics {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return nil
+	}
+
+	counters, err := disk.IOCounters()
+	if err != nil {
+		counters = nil
+	}
+
+	var disks []DiskMetrics
+	seen := make(map[string]bool)
+	for _, p := range partitions {
+		if seen[p.Mountpoint] {
+			continue
+		}
+		seen[p.Mountpoint] = true
+
+		usage, err := disk.Usage(p.Mountpoint)
+		if err != nil || usage.Total == 0 {
+			continue
+		}
+
+		d := DiskMetrics{
+			Mount:       p.Mountpoint,
+			Device:      p.Device,
+			FSType:      p.Fstype,
+			TotalBytes:  usage.Total,
+			UsedBytes:   usage.Used,
+			FreeBytes:   usage.Free,
+			UsedPercent: usage.UsedPercent,
+		}
+
+		name := filepath.Base(p.Device)
+		if io, ok := counters[name]; ok {
+			d.ReadBytesTotal = io.ReadBytes
+			d.WriteBytesTotal = io.WriteBytes
+			if prev, ok := c.prevDisk[name]; ok {
+				d.ReadBytesRate = rate(io.ReadBytes, prev.ReadBytes, elapsed)
+				d.WriteBytesRate = rate(io.WriteBytes, prev.WriteBytes, elapsed)
+				d.ReadOpsRate = rate(io.ReadCount, prev.ReadCount, elapsed)
+				d.WriteOpsRate = rate(io.WriteCount, prev.WriteCount, elapsed)
+			}
+		}
+
+		disks = append(disks, d)
+	}
+
+	c.prevDisk = counters
+	return disks
+}
+
+func (c *hostCollector) collectNetwork(elapsed float64) []NetworkMetrics {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		return nil
+	}
+
+	current := make(map[string]net.IOCountersStat, len(counters))
+	var interfaces []NetworkMetrics
+	for _, io := range counters {
+		current[io.Name] = io
+		if io.Name == "lo" {
+			continue
+		}
+
+		n := NetworkMetrics{
+			Interface:     io.Name,
+			RxBytesTotal:  io.BytesRecv,
+			TxBytesTotal:  io.BytesSent,
+			RxErrorsTotal: io.Errin,
+			TxErrorsTotal: io.Errout,
+		}
+		if prev, ok := c.prevNet[io.Name]; ok {
+			n.RxBytesRate = rate(io.BytesRecv, prev.BytesRecv, elapsed)
+			n.TxBytesRate = rate(io.BytesSent, prev.BytesSent, elapsed)
+			n.RxPacketsRate = rate(io.PacketsRecv, prev.PacketsRecv, elapsed)
+			n.TxPacketsRate = rate(io.PacketsSent, prev.PacketsSent, elapsed)
+		}
+		interfaces = append(interfaces, n)
+	}
+
+	c.prevNet = current
+	return interfaces
+}
+
+// collectProcesses returns the top processes by CPU usage since the previous sample
+func (c *hostCollector) collectProcesses(totalMem uint64) []ProcessMetrics {
+	pids, err := process.Pids()
+	if err != nil {
+		return nil
+	}
+
+	alive := make(map[int32]*process.Process, len(pids))
+	var list []ProcessMetrics
+	for _, pid := range pids {
+		p, ok := c.procs[pid]
+		if !ok {
+			if p, err = process.NewProcess(pid); err != nil {
+				continue
+			}
+		}
+		alive[pid] = p
+
+		cpuPercent, err := p.Percent(0)
+		if err != nil {
+			continue
+		}
+		name, _ := p.Name()
+		pm := ProcessMetrics{PID: pid, Name: name, CPU: cpuPercent}
+		if memInfo, err := p.MemoryInfo(); err == nil {
+			pm.MemoryBytes = memInfo.RSS
+			if totalMem > 0 {
+				pm.MemoryPercent = float32(100 * float64(memInfo.RSS) / float64(totalMem))
+			}
+		}
+		list = append(list, pm)
+	}
+	c.procs = alive
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CPU != list[j].CPU {
+			return list[i].CPU > list[j].CPU
+		}
+		return list[i].MemoryBytes > list[j].MemoryBytes
+	})
+	if len(list) > c.topProcesses {
+		list = list[:c.topProcesses]
+	}
+	return list
+}
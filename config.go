@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration. Every setting can come from the YAML
+// file given with -config (or CONFIG_FILE), from its environment variable
+// or from a flag named after its YAML path, e.g. -server.port. Flags win
+// over the environment, which wins over the file, which wins over defaults.
+type Config struct {
+	Server        ServerConfig        `yaml:"server"`
+	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch"`
+	WebSocket     WebSocketConfig     `yaml:"websocket"`
+	Hub           HubConfig           `yaml:"hub"`
+	Metrics       MetricsConfig       `yaml:"metrics"`
+	Hosts         HostsConfig         `yaml:"hosts"`
+	Leaderboard   LeaderboardConfig   `yaml:"leaderboard"`
+	Presence      PresenceConfig      `yaml:"presence"`
+	Alerts        AlertsConfig        `yaml:"alerts"`
+	Webhooks      WebhooksConfig      `yaml:"webhooks"`
+	Notifications NotificationsConfig `yaml:"notifications"`
+	Reports       ReportsConfig       `yaml:"reports"`
+	Badges        BadgesConfig        `yaml:"badges"`
+	Logging       LoggingConfig       `yaml:"logging"`
+	Tracing       TracingConfig       `yaml:"tracing"`
+	Health        HealthConfig        `yaml:"health"`
+}
+
+type ServerConfig struct {
+	Port       int    `yaml:"port" env:"PORT" help:"HTTP listen port"`
+	PublicURL  string `yaml:"public_url" env:"PUBLIC_URL" help:"base URL used in links sent to users (default http://localhost:<port>)"`
+	DataDir    string `yaml:"data_dir" env:"DATA_DIR" help:"directory for the state kept on local disk"`
+	AdminToken string `yaml:"admin_token" env:"ADMIN_TOKEN" secret:"true" help:"bearer token of the management endpoints, empty disables them"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" help:"how long a shutdown waits for requests, clients and pending writes"`
+	ReconnectAfter  time.Duration `yaml:"reconnect_after" env:"RECONNECT_AFTER" help:"delay WebSocket clients are asked to wait before reconnecting after a shutdown"`
+}
+
+type ElasticsearchConfig struct {
+	URL string `yaml:"url" env:"ELASTICSEARCH_URL" help:"Elasticsearch address"`
+}
+
+type WebSocketConfig struct {
+	PingInterval     time.Duration `yaml:"ping_interval" env:"WS_PING_INTERVAL" help:"interval of keepalive pings to tracking, external and agent connections"`
+	TrackReadTimeout time.Duration `yaml:"track_read_timeout" env:"WS_TRACK_READ_TIMEOUT" help:"how long a tracking connection may stay silent"`
+	ReadTimeout      time.Duration `yaml:"read_timeout" env:"WS_READ_TIMEOUT" help:"how long external and agent connections may stay silent"`
+}
+
+type HubConfig struct {
+	BroadcastBuffer int           `yaml:"broadcast_buffer" env:"HUB_BROADCAST_BUFFER" help:"messages queued for broadcasting before senders block"`
+	SessionWindow   time.Duration `yaml:"session_window" env:"SESSION_WINDOW" help:"window of the per-client weekly totals"`
+}
+
+type MetricsConfig struct {
+	SampleInterval time.Duration `yaml:"sample_interval" env:"METRICS_SAMPLE_INTERVAL" help:"how often the local machine is sampled"`
+	RollupWindow   time.Duration `yaml:"rollup_window" env:"METRICS_ROLLUP_WINDOW" help:"window of the metrics rollups indexed to Elasticsearch"`
+	TopProcesses   int           `yaml:"top_processes" env:"METRICS_TOP_PROCESSES" help:"processes listed per sample, 0 disables them"`
+	Cgroup         string        `yaml:"cgroup" env:"METRICS_CGROUP" help:"container metrics: auto, true (force) or false"`
+	SessionLabels  bool          `yaml:"session_labels" env:"METRICS_SESSION_LABELS" help:"export coding time by language and project to Prometheus"`
+}
+
+type HostsConfig struct {
+	HostID      string   `yaml:"host_id" env:"HOST_ID" help:"id of the machine the server runs on (default the hostname)"`
+	AgentTokens []string `yaml:"agent_tokens" env:"AGENT_TOKENS" secret:"true" help:"comma separated tokens accepted from metrics agents"`
+}
+
+type LeaderboardConfig struct {
+	OptOut []string `yaml:"opt_out" env:"LEADERBOARD_OPT_OUT" help:"comma separated users hidden from the leaderboard"`
+}
+
+type PresenceConfig struct {
+	IdleAfter time.Duration `yaml:"idle_after" env:"PRESENCE_IDLE_AFTER" help:"inactivity after which a user is shown idle"`
+}
+
+type AlertsConfig struct {
+	RulesFile string `yaml:"rules_file" env:"ALERT_RULES_FILE" help:"JSON file with alert rules (default rules when empty)"`
+}
+
+type WebhooksConfig struct {
+	RetryBase   time.Duration `yaml:"retry_base" env:"WEBHOOK_RETRY_BASE" help:"first retry delay of failed deliveries, doubled per attempt"`
+	MaxFailures int           `yaml:"max_failures" env:"WEBHOOK_MAX_FAILURES" help:"consecutive failures after which a webhook is disabled"`
+}
+
+type NotificationsConfig struct {
+	ChannelsFile string `yaml:"channels_file" env:"NOTIFY_CHANNELS_FILE" help:"JSON file with Slack, Discord and Mattermost channels"`
+}
+
+type ReportsConfig struct {
+	Schedule string     `yaml:"schedule" env:"REPORT_SCHEDULE" help:"when email reports are sent, e.g. \"weekly mon 08:00\""`
+	Template string     `yaml:"template" env:"REPORT_TEMPLATE" help:"HTML template file replacing the built-in report"`
+	Secret   string     `yaml:"secret" env:"REPORT_SECRET" secret:"true" help:"key signing confirm and unsubscribe links (generated when empty)"`
+	SMTP     SMTPConfig `yaml:"smtp"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host" env:"SMTP_HOST" help:"SMTP server, empty disables email reports"`
+	Port     int    `yaml:"port" env:"SMTP_PORT" help:"SMTP port"`
+	Username string `yaml:"username" env:"SMTP_USERNAME" help:"SMTP user"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD" secret:"true" help:"SMTP password"`
+	From     string `yaml:"from" env:"SMTP_FROM" help:"sender address of email reports"`
+}
+
+type LoggingConfig struct {
+	Format string   `yaml:"format" env:"LOG_FORMAT" help:"log output: text or json"`
+	Level  string   `yaml:"level" env:"LOG_LEVEL" help:"lowest level logged: debug, info, warn or error"`
+	Levels []string `yaml:"levels" env:"LOG_LEVELS" help:"comma separated per-subsystem levels, e.g. hub=debug,webhooks=warn"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER" help:"where spans go: none, otlp or stdout"`
+	Endpoint    string  `yaml:"endpoint" env:"TRACING_ENDPOINT" help:"OTLP/HTTP collector URL, e.g. http://localhost:4318, /v1/traces is added when there is no path (default from OTEL_EXPORTER_OTLP_ENDPOINT)"`
+	ServiceName string  `yaml:"service_name" env:"TRACING_SERVICE_NAME" help:"service.name of the exported spans"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" help:"share of new traces recorded, from 0 to 1"`
+}
+
+type HealthConfig struct {
+	ReadyChecks []string      `yaml:"ready_checks" env:"HEALTH_READY_CHECKS" help:"comma separated checks gating /readyz: elasticsearch, spool, hub, collector"`
+	Timeout     time.Duration `yaml:"timeout" env:"HEALTH_TIMEOUT" help:"how long a single health check may take"`
+	MaxSpool    int           `yaml:"max_spool" env:"HEALTH_MAX_SPOOL" help:"pending webhook deliveries and Elasticsearch writes above which the spool check fails"`
+}
+
+type BadgesConfig struct {
+	MaxAge int `yaml:"max_age" env:"BADGE_MAX_AGE" help:"seconds clients may cache a badge"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server:        ServerConfig{Port: 8081, DataDir: "data", ShutdownTimeout: 10 * time.Second, ReconnectAfter: 5 * time.Second},
+		Elasticsearch: ElasticsearchConfig{URL: "http://localhost:9200"},
+		WebSocket: WebSocketConfig{
+			PingInterval:     30 * time.Second,
+			TrackReadTimeout: 60 * time.Second,
+			ReadTimeout:      90 * time.Second,
+		},
+		Hub:      HubConfig{BroadcastBuffer: 256, SessionWindow: 7 * 24 * time.Hour},
+		Metrics:  MetricsConfig{SampleInterval: time.Second, RollupWindow: time.Minute, TopProcesses: 5, Cgroup: "auto"},
+		Presence: PresenceConfig{IdleAfter: 5 * time.Minute},
+		Webhooks: WebhooksConfig{RetryBase: 10 * time.Second, MaxFailures: 10},
+		Reports:  ReportsConfig{Schedule: "weekly mon 08:00", SMTP: SMTPConfig{Port: 587}},
+		Badges:   BadgesConfig{MaxAge: 300},
+		Logging:  LoggingConfig{Format: "text", Level: "info"},
+		Tracing:  TracingConfig{Exporter: "none", ServiceName: "coding-tracker", SampleRatio: 1},
+		Health:   HealthConfig{ReadyChecks: []string{"hub", "collector"}, Timeout: 2 * time.Second, MaxSpool: 1000},
+	}
+}
+
+// PublicURLOrDefault is the configured public URL without a trailing slash
+func (s ServerConfig) PublicURLOrDefault() string {
+	if s.PublicURL == "" {
+		return "http://localhost:" + strconv.Itoa(s.Port)
+	}
+	return strings.TrimSuffix(s.PublicURL, "/")
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(path, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+	positive := func(path string, d time.Duration) {
+		if d <= 0 {
+			fail(path, "must be a positive duration, got %s", d)
+		}
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		fail("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.PublicURL != "" {
+		if u, err := url.Parse(c.Server.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("server.public_url", "must be an absolute URL such as https://tracker.example.com, got %q", c.Server.PublicURL)
+		}
+	}
+	if c.Server.DataDir == "" {
+		fail("server.data_dir", "must not be empty")
+	}
+	positive("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	if c.Server.ReconnectAfter < 0 {
+		fail("server.reconnect_after", "must not be negative, got %s", c.Server.ReconnectAfter)
+	}
+	if u, err := url.Parse(c.Elasticsearch.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("elasticsearch.url", "must be an http or https URL, got %q", c.Elasticsearch.URL)
+	}
+
+	positive("websocket.ping_interval", c.WebSocket.PingInterval)
+	positive("websocket.track_read_timeout", c.WebSocket.TrackReadTimeout)
+	positive("websocket.read_timeout", c.WebSocket.ReadTimeout)
+	// a connection answering every ping must never run into its read deadline
+	if c.WebSocket.PingInterval >= c.WebSocket.ReadTimeout || c.WebSocket.PingInterval >= c.WebSocket.TrackReadTimeout {
+		fail("websocket.ping_interval", "must be shorter than the read timeouts (%s, %s), got %s",
+			c.WebSocket.TrackReadTimeout, c.WebSocket.ReadTimeout, c.WebSocket.PingInterval)
+	}
+
+	if c.Hub.BroadcastBuffer < 1 {
+		fail("hub.broadcast_buffer", "must be at least 1, got %d", c.Hub.BroadcastBuffer)
+	}
+	positive("hub.session_window", c.Hub.SessionWindow)
+
+	if c.Metrics.SampleInterval < 100*time.Millisecond {
+		fail("metrics.sample_interval", "must be at least 100ms, got %s", c.Metrics.SampleInterval)
+	}
+	if c.Metrics.RollupWindow < c.Metrics.SampleInterval {
+		fail("metrics.rollup_window", "must not be shorter than metrics.sample_interval (%s), got %s",
+			c.Metrics.SampleInterval, c.Metrics.RollupWindow)
+	}
+	if c.Metrics.TopProcesses < 0 {
+		fail("metrics.top_processes", "must not be negative, got %d", c.Metrics.TopProcesses)
+	}
+	switch c.Metrics.Cgroup {
+	case "auto", "true", "false":
+	default:
+		fail("metrics.cgroup", "must be one of auto, true, false, got %q", c.Metrics.Cgroup)
+	}
+
+	positive("presence.idle_after", c.Presence.IdleAfter)
+	positive("webhooks.retry_base", c.Webhooks.RetryBase)
+	if c.Webhooks.MaxFailures < 1 {
+		fail("webhooks.max_failures", "must be at least 1, got %d", c.Webhooks.MaxFailures)
+	}
+
+	if _, err := parseSchedule(c.Reports.Schedule); err != nil {
+		fail("reports.schedule", "%v", err)
+	}
+	if c.Reports.SMTP.Port < 1 || c.Reports.SMTP.Port > 65535 {
+		fail("reports.smtp.port", "must be between 1 and 65535, got %d", c.Reports.SMTP.Port)
+	}
+	if c.Badges.MaxAge < 0 {
+		fail("badges.max_age", "must not be negative, got %d", c.Badges.MaxAge)
+	}
+	if _, err := newLogSettings(c.Logging, io.Discard); err != nil {
+		fail("logging", "%v", err)
+	}
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	default:
+		fail("tracing.exporter", "must be one of none, otlp, stdout, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("tracing.endpoint", "must be an http or https URL, got %q", c.Tracing.Endpoint)
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio", "must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+	}
+	for _, name := range c.Health.ReadyChecks {
+		known := false
+		for _, check := range healthCheckNames {
+			known = known || check == name
+		}
+		if !known {
+			fail("health.ready_checks", "unknown check %q, use %s", name, strings.Join(healthCheckNames, ", "))
+		}
+	}
+	positive("health.timeout", c.Health.Timeout)
+	if c.Health.MaxSpool < 1 {
+		fail("health.max_spool", "must be at least 1, got %d", c.Health.MaxSpool)
+	}
+
+	for _, file := range []struct{ path, name string }{
+		{"alerts.rules_file", c.Alerts.RulesFile},
+		{"notifications.channels_file", c.Notifications.ChannelsFile},
+		{"reports.template", c.Reports.Template},
+	} {
+		if file.name == "" {
+			continue
+		}
+		if _, err := os.Stat(file.name); err != nil {
+			fail(file.path, "%v", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// configSources records where each setting came from, for config print
+type configSources map[string]string
+
+// configField is one setting of the Config tree
+type configField struct {
+	path  string
+	field reflect.StructField
+	value reflect.Value
+}
+
+// configFields lists the settings of c in declaration order
+func configFields(c *Config) []configField {
+	var fields []configField
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			path := prefix + f.Tag.Get("yaml")
+			if f.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path+".")
+				continue
+			}
+			fields = append(fields, configField{path: path, field: f, value: v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return fields
+}
+
+// parseConfigValue parses s into a new value of type t
+func parseConfigValue(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch {
+	case t == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid duration %q, use e.g. 30s or 5m", s)
+		}
+		v.SetInt(int64(d))
+	case t.Kind() == reflect.String:
+		v.SetString(s)
+	case t.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid number %q", s)
+		}
+		v.SetInt(int64(n))
+	case t.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid number %q", s)
+		}
+		v.SetFloat(f)
+	case t.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return v, fmt.Errorf("unsupported setting type %s", t)
+	}
+	return v, nil
+}
+
+func formatConfigValue(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case []string:
+		return strings.Join(x, ",")
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// configFlag holds a flag value until it is applied over file and environment
+type configFlag struct {
+	typ   reflect.Type
+	def   string
+	value *reflect.Value
+}
+
+func (f *configFlag) String() string { return f.def }
+
+func (f *configFlag) Set(s string) error {
+	v, err := parseConfigValue(f.typ, s)
+	if err != nil {
+		return err
+	}
+	f.value = &v
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool { return f.typ.Kind() == reflect.Bool }
+
+// loadConfig builds the configuration from defaults, the config file, the
+// environment and args, in increasing precedence. It does not validate.
+func loadConfig(name string, args []string) (*Config, configSources, error) {
+	cfg := defaultConfig()
+	sources := make(configSources)
+	fields := configFields(cfg)
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file (CONFIG_FILE)")
+	flags := make(map[string]*configFlag)
+	for _, f := range fields {
+		cf := &configFlag{typ: f.field.Type, def: formatConfigValue(f.value)}
+		flags[f.path] = cf
+		help := f.field.Tag.Get("help")
+		if env := f.field.Tag.Get("env"); env != "" {
+			help += " (" + env + ")"
+		}
+		fs.Var(cf, f.path, help)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("%s: %v", *configFile, err)
+		}
+
+		var present map[string]interface{}
+		yaml.Unmarshal(data, &present)
+		for _, f := range fields {
+			if yamlPathSet(present, f.path) {
+				sources[f.path] = "file " + *configFile
+			}
+		}
+	}
+
+	for _, f := range fields {
+		env := f.field.Tag.Get("env")
+		if s := os.Getenv(env); env != "" && s != "" {
+			v, err := parseConfigValue(f.field.Type, s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", env, err)
+			}
+			f.value.Set(v)
+			sources[f.path] = "env " + env
+		}
+	}
+
+	for _, f := range fields {
+		if cf := flags[f.path]; cf.value != nil {
+			f.value.Set(*cf.value)
+			sources[f.path] = "flag -" + f.path
+		}
+	}
+
+	return cfg, sources, nil
+}
+
+func yamlPathSet(tree map[string]interface{}, path string) bool {
+	head, rest, nested := strings.Cut(path, ".")
+	v, ok := tree[head]
+	if !ok || !nested {
+		return ok
+	}
+	sub, ok := v.(map[string]interface{})
+	return ok && yamlPathSet(sub, rest)
+}
+
+// activeConfig is the configuration the server runs with
+var activeConfig atomic.Pointer[Config]
+
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// applyConfig makes cfg the active configuration and sets up the parts of
+// the process that are derived from it once
+func applyConfig(cfg *Config) {
+	activeConfig.Store(cfg)
+	configureLogging(cfg.Logging)
+	dataDir = cfg.Server.DataDir
+	if cfg.Hosts.HostID != "" {
+		localHostID = cfg.Hosts.HostID
+	}
+	localCollector = newHostCollector(cfg.Metrics)
+}
+
+// mustLoadConfig loads and validates the configuration of a subcommand that
+// takes its own flags, from the config file in CONFIG_FILE and the environment
+func mustLoadConfig(name string) *Config {
+	cfg, _, err := loadConfig(name, nil)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	applyConfig(cfg)
+	return cfg
+}
+
+// printConfig writes cfg as YAML, noting where every setting that is not a
+// default came from. Secrets are redacted.
+func printConfig(w io.Writer, cfg *Config, sources configSources) error {
+	var root yaml.Node
+	if err := root.Encode(cfg); err != nil {
+		return err
+	}
+
+	secrets := make(map[string]bool)
+	for _, f := range configFields(cfg) {
+		if f.field.Tag.Get("secret") == "true" && !f.value.IsZero() && f.value.Len() > 0 {
+			secrets[f.path] = true
+		}
+	}
+
+	var annotate func(n *yaml.Node, prefix string)
+	annotate = func(n *yaml.Node, prefix string) {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			path := prefix + key.Value
+			if value.Kind == yaml.MappingNode {
+				annotate(value, path+".")
+				continue
+			}
+			if secrets[path] {
+				*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "<redacted>"}
+			}
+			if source, ok := sources[path]; ok {
+				key.LineComment = source
+			}
+		}
+	}
+	annotate(&root, "")
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// runConfig implements `server config print [flags]`
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "Usage: server config print [-config file] [flags]")
+		os.Exit(2)
+	}
+
+	cfg, sources, err := loadConfig("config print", args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := printConfig(os.Stdout, cfg, sources); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// clientSendQueue is how many broadcasts may wait for a hub subscriber
+	// before it counts as too slow and is disconnected
+	clientSendQueue = 64
+
+	// closeGrace is how long a client gets to answer the close frame before
+	// its connection is dropped
+	closeGrace = 2 * time.Second
+)
+
+// hubMessageTypes are the message types a subscription filter can name
+var hubMessageTypes = []string{"metrics", "alert", "session", "weekly_summary", "leaderboard", "presence", "announcement"}
+
+// shutdownHint is the reason of the going-away close frame, clients wait
+// ReconnectAfterMs before reconnecting
+type shutdownHint struct {
+	ReconnectAfterMs int64 `json:"reconnect_after_ms"`
+}
+
+// outgoing is a broadcast waiting in a client's send queue
+type outgoing struct {
+	typ  string
+	data []byte
+}
+
+// wsClient is one upgraded WebSocket connection with its traffic counters.
+// Hub subscribers get a send queue drained by their own writer, so a slow
+// client does not hold up the broadcast to the others.
+type wsClient struct {
+	ID          string
+	Kind        string // monitor, external, track or agent
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	conn *websocket.Conn
+
+	messagesIn   atomic.Int64
+	messagesOut  atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	lastActivity atomic.Int64 // unix nanoseconds
+
+	mutex          sync.Mutex
+	user           string
+	host           string
+	sending        bool
+	reconnectAfter time.Duration
+
+	send  chan outgoing
+	leave chan struct{} // closed on shutdown, the writer drains the queue first
+	done  chan struct{} // closed when the hub drops the client
+	once  sync.Once
+}
+
+func newWSClient(conn *websocket.Conn, kind string, r *http.Request) *wsClient {
+	c := &wsClient{
+		ID:          randomHex(6),
+		Kind:        kind,
+		RemoteAddr:  r.RemoteAddr,
+		ConnectedAt: time.Now(),
+		conn:        conn,
+		send:        make(chan outgoing, clientSendQueue),
+		leave:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	c.lastActivity.Store(c.ConnectedAt.UnixNano())
+	return c
+}
+
+// received counts a message read from the client
+func (c *wsClient) received(size int) {
+	c.messagesIn.Add(1)
+	c.bytesIn.Add(int64(size))
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// sent counts a message written to the client
+func (c *wsClient) sent(size int) {
+	c.messagesOut.Add(1)
+	c.bytesOut.Add(int64(size))
+}
+
+// writeJSON writes v directly, for handlers that are the only writer of
+// their connection
+func (c *wsClient) writeJSON(v interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	c.sent(len(data))
+	return nil
+}
+
+// identify records the user or host the connection reports for
+func (c *wsClient) identify(user, host string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if user != "" {
+		c.user = user
+	}
+	if host != "" {
+		c.host = host
+	}
+}
+
+// startSending starts the writer of the send queue, the hub calls it when
+// the client subscribes
+func (c *wsClient) startSending() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.sending {
+		c.sending = true
+		go c.writeLoop()
+	}
+}
+
+// enqueue queues a broadcast without blocking, false means the queue is full
+func (c *wsClient) enqueue(o outgoing) bool {
+	select {
+	case c.send <- o:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop ends the writer and closes the connection
+func (c *wsClient) stop() {
+	c.once.Do(func() { close(c.done) })
+	c.conn.Close()
+}
+
+func (c *wsClient) writeLoop() {
+	for {
+		select {
+		case o := <-c.send:
+			if !c.write(o) {
+				return
+			}
+		case <-c.leave:
+			for n := len(c.send); n > 0; n-- {
+				if !c.write(<-c.send) {
+					return
+				}
+			}
+			c.mutex.Lock()
+			reconnectAfter := c.reconnectAfter
+			c.mutex.Unlock()
+			goingAway(c.conn, reconnectAfter)
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsClient) write(o outgoing) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if err := c.conn.WriteMessage(websocket.TextMessage, o.data); err != nil {
+		hubLog.Warn("Broadcast to client failed", "client", c.RemoteAddr, "connection", c.ID, "type", o.typ, "error", err)
+		hubMessagesDropped.Inc(o.typ)
+		// the handler's read fails next and unregisters the client
+		c.conn.Close()
+		return false
+	}
+	hubMessagesDelivered.Inc(o.typ)
+	c.sent(len(o.data))
+	return true
+}
+
+// goAway closes the connection for a shutdown, after the queued broadcasts
+func (c *wsClient) goAway(reconnectAfter time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.sending {
+		go goingAway(c.conn, reconnectAfter)
+		return
+	}
+	c.reconnectAfter = reconnectAfter
+	close(c.leave)
+}
+
+// disconnect starts a normal closing handshake with reason
+func (c *wsClient) disconnect(reason string) {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		c.conn.Close()
+		return
+	}
+	c.conn.SetReadDeadline(time.Now().Add(closeGrace))
+}
+
+// goingAway starts the closing handshake, the handler's read loop ends when
+// the client answers or at the grace deadline
+func goingAway(conn *websocket.Conn, reconnectAfter time.Duration) {
+	reason, _ := json.Marshal(shutdownHint{ReconnectAfterMs: reconnectAfter.Milliseconds()})
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, string(reason))
+	if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(closeGrace))
+}
+
+// connTracker follows the upgraded WebSocket connections, which
+// http.Server.Shutdown neither closes nor waits for, and lists them for the
+// admin API
+type connTracker struct {
+	mutex          sync.Mutex
+	clients        map[string]*wsClient
+	closing        bool
+	reconnectAfter time.Duration
+	handlers       sync.WaitGroup
+}
+
+var wsConns = &connTracker{clients: make(map[string]*wsClient)}
+
+// track registers the connection of a handler, which must call release when
+// it returns. Connections accepted while shutting down are sent away right away.
+func (t *connTracker) track(conn *websocket.Conn, kind string, r *http.Request) *wsClient {
+	c := newWSClient(conn, kind, r)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closing {
+		goingAway(conn, t.reconnectAfter)
+		return c
+	}
+	t.clients[c.ID] = c
+	t.handlers.Add(1)
+	return c
+}
+
+func (t *connTracker) release(c *wsClient) {
+	t.mutex.Lock()
+	_, ok := t.clients[c.ID]
+	delete(t.clients, c.ID)
+	t.mutex.Unlock()
+	if ok {
+		t.handlers.Done()
+	}
+}
+
+// Get returns the connection with id
+func (t *connTracker) Get(id string) (*wsClient, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c, ok := t.clients[id]
+	return c, ok
+}
+
+// List returns the connections, oldest first
+func (t *connTracker) List() []*wsClient {
+	t.mutex.Lock()
+	clients := make([]*wsClient, 0, len(t.clients))
+	for _, c := range t.clients {
+		clients = append(clients, c)
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ConnectedAt.Before(clients[j].ConnectedAt) })
+	return clients
+}
+
+// Close sends every connection a going-away close frame and waits for the
+// handlers to return
+func (t *connTracker) Close(ctx context.Context, reconnectAfter time.Duration) error {
+	t.mutex.Lock()
+	t.closing = true
+	t.reconnectAfter = reconnectAfter
+	clients := make([]*wsClient, 0, len(t.clients))
+	for _, c := range t.clients {
+		clients = append(clients, c)
+	}
+	t.mutex.Unlock()
+
+	wsLog.Info("Closing WebSocket connections", "count", len(clients))
+	for _, c := range clients {
+		c.goAway(reconnectAfter)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ConnectionInfo describes a live connection in the admin API
+type ConnectionInfo struct {
+	ID           string   `json:"id"`
+	Type         string   `json:"type"`
+	RemoteAddr   string   `json:"remote_addr"`
+	User         string   `json:"user,omitempty"`
+	Host         string   `json:"host,omitempty"`
+	ConnectedAt  string   `json:"connected_at"`
+	LastActivity string   `json:"last_activity"`
+	MessagesIn   int64    `json:"messages_in"`
+	MessagesOut  int64    `json:"messages_out"`
+	BytesIn      int64    `json:"bytes_in"`
+	BytesOut     int64    `json:"bytes_out"`
+	QueueDepth   int      `json:"queue_depth"`
+	Subscribed   bool     `json:"subscribed"`
+	Filter       string   `json:"filter,omitempty"`
+	Hosts        []string `json:"hosts,omitempty"`
+}
+
+func (c *wsClient) info(hub *Hub) ConnectionInfo {
+	c.mutex.Lock()
+	user, host := c.user, c.host
+	c.mutex.Unlock()
+
+	info := ConnectionInfo{
+		ID:           c.ID,
+		Type:         c.Kind,
+		RemoteAddr:   c.RemoteAddr,
+		User:         user,
+		Host:         host,
+		ConnectedAt:  c.ConnectedAt.Format(time.RFC3339),
+		LastActivity: time.Unix(0, c.lastActivity.Load()).Format(time.RFC3339),
+		MessagesIn:   c.messagesIn.Load(),
+		MessagesOut:  c.messagesOut.Load(),
+		BytesIn:      c.bytesIn.Load(),
+		BytesOut:     c.bytesOut.Load(),
+		QueueDepth:   len(c.send),
+	}
+	info.Filter, info.Hosts, info.Subscribed = hub.Subscription(c)
+	return info
+}
+
+// Announcement is an operator message broadcast to every hub subscriber,
+// whatever its filter
+type Announcement struct {
+	Message   string `json:"message"`
+	Level     string `json:"level"` // info, warning or critical
+	Timestamp string `json:"timestamp"`
+}
+
+func listConnectionsHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	kind := r.URL.Query().Get("type")
+	connections := []ConnectionInfo{}
+	for _, c := range wsConns.List() {
+		if kind == "" || c.Kind == kind {
+			connections = append(connections, c.info(hub))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"connections": connections,
+		"count":       len(connections),
+		"timestamp":   time.Now().Format(time.RFC3339),
+	})
+}
+
+func disconnectHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	c, ok := wsConns.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown connection")
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "disconnected by an administrator"
+	}
+	// the close reason has to fit a control frame, cut on a rune boundary
+	if len(reason) > 120 {
+		cut := 120
+		for cut > 0 && !utf8.RuneStart(reason[cut]) {
+			cut--
+		}
+		reason = reason[:cut]
+	}
+	c.disconnect(reason)
+	wsLog.Info("Connection closed by an administrator", "connection", c.ID, "client", c.RemoteAddr, "endpoint", "/ws/"+c.Kind)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "disconnecting",
+		"id":     c.ID,
+	})
+}
+
+func updateSubscriptionHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	c, ok := wsConns.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown connection")
+		return
+	}
+
+	var req struct {
+		Filter string   `json:"filter"`
+		Hosts  []string `json:"hosts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+	var types []string
+	for _, t := range strings.Split(req.Filter, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		known := false
+		for _, name := range hubMessageTypes {
+			known = known || name == t
+		}
+		if !known {
+			writeError(w, http.StatusBadRequest, "unknown message type "+t+", use "+strings.Join(hubMessageTypes, ", "))
+			return
+		}
+		types = append(types, t)
+	}
+
+	if !hub.SetSubscription(c, strings.Join(types, ","), req.Hosts) {
+		writeError(w, http.StatusConflict, "connection is not subscribed to the hub, only monitor and external connections are")
+		return
+	}
+	writeJSON(w, http.StatusOK, c.info(hub))
+}
+
+func announceHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	var a Announcement
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+	a.Message = strings.TrimSpace(a.Message)
+	if a.Message == "" {
+		writeError(w, http.StatusBadRequest, "message is required")
+		return
+	}
+	switch a.Level {
+	case "":
+		a.Level = "info"
+	case "info", "warning", "critical":
+	default:
+		writeError(w, http.StatusBadRequest, "level must be one of info, warning, critical")
+		return
+	}
+	a.Timestamp = time.Now().Format(time.RFC3339)
+
+	hub.broadcast <- BroadcastMessage{
+		Type:    "announcement",
+		Data:    a,
+		EventID: time.Now().Format("20060102150405"),
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":       "queued",
+		"announcement": a,
+		"recipients":   hub.GetClientCount(),
+	})
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReportSubscription is an email address opted in to the coding reports.
+// It only receives reports once the address is confirmed.
+type ReportSubscription struct {
+	Email        string `json:"email"`
+	User         string `json:"user,omitempty"`
+	Team         string `json:"team,omitempty"`
+	Confirmed    bool   `json:"confirmed"`
+	SubscribedAt string `json:"subscribed_at"`
+	LastSentAt   string `json:"last_sent_at,omitempty"`
+	// ConfirmationSentAt is when the last confirmation email went out
+	ConfirmationSentAt string `json:"confirmation_sent_at,omitempty"`
+}
+
+const (
+	// confirmationResendAfter is how long an address waits for a new confirmation email
+	confirmationResendAfter = time.Hour
+	// subscribeRequestsPerHour limits the subscribe requests of one client IP
+	subscribeRequestsPerHour = 5
+)
+
+// errConfirmationPending is returned while a recent confirmation email is unanswered
+var errConfirmationPending = fmt.Errorf("a confirmation email was already sent to this address, try again later")
+
+type smtpConfig struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+// reportSettings is the part of the reporter that follows the configuration
+type reportSettings struct {
+	smtp      smtpConfig
+	schedule  Schedule
+	publicURL string
+	secret    []byte
+	template  *htmltemplate.Template
+}
+
+// Reporter sends the scheduled HTML coding reports over SMTP
+type Reporter struct {
+	mutex         sync.Mutex
+	subscriptions map[string]*ReportSubscription
+	path          string
+	// changed is closed when the settings are replaced, restarting the schedule
+	changed chan struct{}
+
+	hub      *Hub
+	settings atomic.Pointer[reportSettings]
+
+	// requests holds the recent subscribe requests per client IP
+	requestsMutex sync.Mutex
+	requests      map[string][]time.Time
+}
+
+func newReporter(hub *Hub, cfg ReportsConfig, publicURL string) (*Reporter, error) {
+	settings, err := newReportSettings(cfg, publicURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reporter{
+		subscriptions: make(map[string]*ReportSubscription),
+		path:          filepath.Join(dataDir, "report-subscriptions.json"),
+		changed:       make(chan struct{}),
+		hub:           hub,
+	}
+	r.settings.Store(settings)
+
+	var subscriptions []*ReportSubscription
+	if err := readJSONFile(r.path, &subscriptions); err != nil {
+		return nil, err
+	}
+	for _, s := range subscriptions {
+		r.subscriptions[strings.ToLower(s.Email)] = s
+	}
+
+	return r, nil
+}
+
+// newReportSettings parses the schedule and template and loads the link secret
+func newReportSettings(cfg ReportsConfig, publicURL string) (*reportSettings, error) {
+	s := &reportSettings{
+		smtp: smtpConfig{
+			addr:     net.JoinHostPort(cfg.SMTP.Host, strconv.Itoa(cfg.SMTP.Port)),
+			host:     cfg.SMTP.Host,
+			username: cfg.SMTP.Username,
+			password: cfg.SMTP.Password,
+			from:     cfg.SMTP.From,
+		},
+		publicURL: publicURL,
+	}
+	if s.smtp.from == "" {
+		s.smtp.from = "coding-tracker@localhost"
+	}
+
+	schedule, err := parseSchedule(cfg.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	s.schedule = schedule
+
+	text := defaultReportTemplate
+	if file := cfg.Template; file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	s.template, err = htmltemplate.New("report").Funcs(htmltemplate.FuncMap{"duration": formatSeconds}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("report template: %v", err)
+	}
+
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	if s.secret, err = reportSecret(cfg.Secret); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reportSecret signs the confirm and unsubscribe links. reports.secret sets
+// it, otherwise one is generated once and kept in the data directory.
+func reportSecret(secret string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+
+	path := filepath.Join(dataDir, "report-secret")
+	if data, err := os.ReadFile(path); err == nil && len(data) > 0 {
+		return bytes.TrimSpace(data), nil
+	}
+	secret = randomHex(32)
+	if err := os.WriteFile(path, []byte(secret), 0o600); err != nil {
+		return nil, err
+	}
+	return []byte(secret), nil
+}
+
+func (s *reportSettings) enabled() bool {
+	return s.smtp.host != ""
+}
+
+func (r *Reporter) enabled() bool {
+	return r.settings.Load().enabled()
+}
+
+// SetSettings switches to new settings. Links signed with a previous secret
+// stop working when the secret changes.
+func (r *Reporter) SetSettings(settings *reportSettings) {
+	r.mutex.Lock()
+	r.settings.Store(settings)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mutex.Unlock()
+}
+
+func (r *Reporter) run() {
+	for {
+		r.mutex.Lock()
+		settings, changed := r.settings.Load(), r.changed
+		r.mutex.Unlock()
+
+		if settings.enabled() {
+			reportsLog.Info("Email reports scheduled", "schedule", settings.schedule.String(), "smtp", settings.smtp.addr)
+			runSchedule(settings.schedule, r.SendAll, changed)
+		} else {
+			<-changed
+		}
+	}
+}
+
+// token signs action and email; the email is recoverable so links stay short
+func (r *Reporter) token(action, subject string) string {
+	payload := action + "\n" + subject
+	mac := hmac.New(sha256.New, r.settings.Load().secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the subject of a token issued for action
+func (r *Reporter) verify(action, token string) (string, bool) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, r.settings.Load().secret)
+	mac.Write(payload)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", false
+	}
+
+	gotAction, email, ok := strings.Cut(string(payload), "\n")
+	if !ok || gotAction != action {
+		return "", false
+	}
+	return email, true
+}
+
+func (r *Reporter) link(path, action, email string) string {
+	return r.tokenLink(path, action, strings.ToLower(email))
+}
+
+func (r *Reporter) tokenLink(path, action, subject string) string {
+	return r.settings.Load().publicURL + path + "?token=" + url.QueryEscape(r.token(action, subject))
+}
+
+// changeSubject signs the user and team a confirmed address asked to switch to
+func changeSubject(email, user, team string) string {
+	return strings.ToLower(email) + "\n" + user + "\n" + team
+}
+
+// Allow records a subscribe request of ip and reports whether it is within the limit
+func (r *Reporter) Allow(ip string) bool {
+	now := time.Now()
+
+	r.requestsMutex.Lock()
+	defer r.requestsMutex.Unlock()
+
+	if r.requests == nil {
+		r.requests = make(map[string][]time.Time)
+	}
+	for key, times := range r.requests {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < time.Hour {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(r.requests, key)
+		} else {
+			r.requests[key] = recent
+		}
+	}
+
+	if len(r.requests[ip]) >= subscribeRequestsPerHour {
+		return false
+	}
+	r.requests[ip] = append(r.requests[ip], now)
+	return true
+}
+
+func (r *Reporter) save() {
+	list := make([]*ReportSubscription, 0, len(r.subscriptions))
+	for _, s := range r.subscriptions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Email < list[j].Email })
+
+	if err := writeJSONFile(r.path, list); err != nil {
+		reportsLog.Error("Failed to persist report subscriptions", "error", err)
+	}
+}
+
+// Subscribe registers an address and mails it the confirmation link. A
+// confirmed address keeps its user and team until it confirms the change
+// from a new email, and no address gets more than one confirmation email
+// per confirmationResendAfter.
+func (r *Reporter) Subscribe(sub ReportSubscription) error {
+	addr, err := mail.ParseAddress(sub.Email)
+	if err != nil {
+		return fmt.Errorf("invalid email address")
+	}
+	sub.Email = addr.Address
+	key := strings.ToLower(sub.Email)
+	now := time.Now()
+
+	r.mutex.Lock()
+	existing, ok := r.subscriptions[key]
+	if ok && existing.Confirmed && existing.User == sub.User && existing.Team == sub.Team {
+		r.mutex.Unlock()
+		return nil
+	}
+	if ok {
+		if sentAt, err := time.Parse(time.RFC3339, existing.ConfirmationSentAt); err == nil && now.Sub(sentAt) < confirmationResendAfter {
+			r.mutex.Unlock()
+			return errConfirmationPending
+		}
+	}
+
+	var subject, body string
+	if ok && existing.Confirmed {
+		existing.ConfirmationSentAt = now.Format(time.RFC3339)
+		subject = "Confirm the change of your coding tracker reports"
+		body = fmt.Sprintf(`<p>Someone asked to send the coding tracker reports%s to this address instead of the current ones.</p>
+<p><a href="%s">Confirm the change</a></p>
+<p>If this was not you, ignore this email and the reports stay as they are.</p>`,
+			scopeSuffix(sub.User, sub.Team), htmltemplate.HTMLEscapeString(r.tokenLink("/reports/confirm", "change", changeSubject(key, sub.User, sub.Team))))
+	} else {
+		sub.Confirmed = false
+		sub.SubscribedAt = now.Format(time.RFC3339)
+		sub.ConfirmationSentAt = sub.SubscribedAt
+		sub.LastSentAt = ""
+		r.subscriptions[key] = &sub
+		subject = "Confirm your coding tracker reports"
+		body = fmt.Sprintf(`<p>Someone asked to send the coding tracker reports%s to this address.</p>
+<p><a href="%s">Confirm the subscription</a></p>
+<p>If this was not you, ignore this email and nothing will be sent.</p>`,
+			teamSuffix(sub.Team), htmltemplate.HTMLEscapeString(r.link("/reports/confirm", "confirm", sub.Email)))
+	}
+	r.save()
+	r.mutex.Unlock()
+
+	return r.send(sub.Email, subject, body, "")
+}
+
+// scopeSuffix describes the user and team a subscription is narrowed to
+func scopeSuffix(user, team string) string {
+	if user == "" {
+		return teamSuffix(team)
+	}
+	return " of " + htmltemplate.HTMLEscapeString(user) + teamSuffix(team)
+}
+
+func teamSuffix(team string) string {
+	if team == "" {
+		return ""
+	}
+	return " for team " + htmltemplate.HTMLEscapeString(team)
+}
+
+func (r *Reporter) Confirm(email string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sub, ok := r.subscriptions[email]
+	if !ok {
+		return false
+	}
+	sub.Confirmed = true
+	sub.ConfirmationSentAt = ""
+	r.save()
+	return true
+}
+
+// ApplyChange switches a confirmed address to the user and team of a change link
+func (r *Reporter) ApplyChange(email, user, team string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sub, ok := r.subscriptions[email]
+	if !ok || !sub.Confirmed {
+		return false
+	}
+	sub.User = user
+	sub.Team = team
+	sub.ConfirmationSentAt = ""
+	r.save()
+	return true
+}
+
+func (r *Reporter) Unsubscribe(email string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.subscriptions[email]; !ok {
+		return false
+	}
+	delete(r.subscriptions, email)
+	r.save()
+	return true
+}
+
+func (r *Reporter) Subscriptions() []ReportSubscription {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	list := make([]ReportSubscription, 0, len(r.subscriptions))
+	for _, s := range r.subscriptions {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Email < list[j].Email })
+	return list
+}
+
+// reportData is what the report template renders
+type reportData struct {
+	Title          string
+	Period         string
+	Summary        CodingSummary
+	Languages      []reportRow
+	Projects       []reportRow
+	User           string
+	UnsubscribeURL string
+}
+
+type reportRow struct {
+	Name    string
+	Seconds int64
+}
+
+func sortedRows(totals map[string]int64) []reportRow {
+	rows := make([]reportRow, 0, len(totals))
+	for name, seconds := range totals {
+		rows = append(rows, reportRow{Name: name, Seconds: seconds})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Seconds != rows[j].Seconds {
+			return rows[i].Seconds > rows[j].Seconds
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	return rows
+}
+
+// SendAll mails the report for the period ending at to every confirmed subscription
+func (r *Reporter) SendAll(at time.Time) {
+	settings := r.settings.Load()
+	from, to := settings.schedule.Period(at)
+	period := fmt.Sprintf("%s – %s", from.Format("Mon Jan 2"), to.Add(-time.Second).Format("Mon Jan 2"))
+
+	sent := 0
+	for _, sub := range r.Subscriptions() {
+		if !sub.Confirmed {
+			continue
+		}
+
+		summary := buildSummary(r.hub, from, to, sub.Team)
+		data := reportData{
+			Title:          "Coding report",
+			Period:         period,
+			Summary:        summary,
+			Languages:      sortedRows(summary.Languages),
+			Projects:       sortedRows(summary.Projects),
+			User:           sub.User,
+			UnsubscribeURL: r.link("/reports/unsubscribe", "unsubscribe", sub.Email),
+		}
+		if sub.Team != "" {
+			data.Title += " · " + sub.Team
+		}
+
+		var body bytes.Buffer
+		if err := settings.template.Execute(&body, data); err != nil {
+			reportsLog.Error("Failed to render report", "email", sub.Email, "error", err)
+			emailReports.Inc("failure")
+			continue
+		}
+		if err := r.send(sub.Email, data.Title+" "+period, body.String(), data.UnsubscribeURL); err != nil {
+			reportsLog.Error("Failed to send report", "email", sub.Email, "error", err)
+			emailReports.Inc("failure")
+			continue
+		}
+		emailReports.Inc("success")
+		sent++
+
+		r.mutex.Lock()
+		if s, ok := r.subscriptions[strings.ToLower(sub.Email)]; ok {
+			s.LastSentAt = at.Format(time.RFC3339)
+		}
+		r.save()
+		r.mutex.Unlock()
+	}
+	reportsLog.Info("Sent email reports", "count", sent)
+}
+
+// send delivers an HTML email, unsubscribeURL adds the List-Unsubscribe headers
+func (r *Reporter) send(to, subject, html, unsubscribeURL string) error {
+	settings := r.settings.Load()
+	if !settings.enabled() {
+		return fmt.Errorf("SMTP is not configured, set SMTP_HOST")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", settings.smtp.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mimeHeader(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", randomHex(12), settings.smtp.host)
+	if unsubscribeURL != "" {
+		fmt.Fprintf(&msg, "List-Unsubscribe: <%s>\r\n", unsubscribeURL)
+		msg.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(html))
+	qp.Close()
+
+	var auth smtp.Auth
+	if settings.smtp.username != "" {
+		auth = smtp.PlainAuth("", settings.smtp.username, settings.smtp.password, settings.smtp.host)
+	}
+	return smtp.SendMail(settings.smtp.addr, auth, settings.smtp.from, []string{to}, msg.Bytes())
+}
+
+func mimeHeader(s string) string {
+	for _, c := range s {
+		if c > 127 {
+			return "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(s)) + "?="
+		}
+	}
+	return s
+}
+
+// reportPage answers the confirm and unsubscribe links opened in a browser
+func reportPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<!doctype html><html><head><meta charset="utf-8"><title>Coding reports</title></head>
+<body style="font-family:sans-serif;max-width:32em;margin:4em auto"><p>%s</p></body></html>`,
+		htmltemplate.HTMLEscapeString(message))
+}
+
+const defaultReportTemplate = `<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body style="font-family:-apple-system,Segoe UI,Helvetica,Arial,sans-serif;color:#1f2328;max-width:640px;margin:0 auto;padding:24px">
+<h2 style="margin-bottom:4px">{{.Title}}</h2>
+<p style="color:#656d76;margin-top:0">{{.Period}}</p>
+{{if not .Summary.Users}}
+<p>No coding activity was tracked in this period.</p>
+{{else}}
+<p><strong>{{duration .Summary.TotalSeconds}}</strong> of coding by {{len .Summary.Users}} developer(s).</p>
+<h3>Developers</h3>
+<table cellpadding="6" style="border-collapse:collapse;width:100%">
+{{range .Summary.Users}}<tr style="border-bottom:1px solid #d0d7de{{if eq .User $.User}};font-weight:bold{{end}}">
+<td>{{.User}}</td><td>{{.Team}}</td><td>{{.TopLanguage}}</td><td align="right">{{duration .TotalSeconds}}</td></tr>
+{{end}}</table>
+{{if .Projects}}<h3>Projects</h3>
+<table cellpadding="6" style="border-collapse:collapse;width:100%">
+{{range .Projects}}<tr style="border-bottom:1px solid #d0d7de"><td>{{.Name}}</td><td align="right">{{duration .Seconds}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Languages}}<h3>Languages</h3>
+<table cellpadding="6" style="border-collapse:collapse;width:100%">
+{{range .Languages}}<tr style="border-bottom:1px solid #d0d7de"><td>{{.Name}}</td><td align="right">{{duration .Seconds}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+<p style="color:#656d76;font-size:12px;margin-top:32px">You receive this report because you subscribed to the coding tracker reports.
+<a href="{{.UnsubscribeURL}}">Unsubscribe</a></p>
+</body>
+</html>
+`
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type sentMail struct {
+	to  []string
+	msg *mail.Message
+}
+
+// smtpServer is an SMTP stand-in that accepts every message without
+// STARTTLS or AUTH and keeps them
+type smtpServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	mails    []sentMail
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	var to []string
+	reply("220 localhost ESMTP")
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			to = nil
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			to = append(to, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := in.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(data.String()))
+			if err != nil {
+				reply("554 " + err.Error())
+				continue
+			}
+			s.mutex.Lock()
+			s.mails = append(s.mails, sentMail{to: to, msg: msg})
+			s.mutex.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// take returns the messages received so far and forgets them
+func (s *smtpServer) take() []sentMail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mails := s.mails
+	s.mails = nil
+	return mails
+}
+
+func newTestReporter(t *testing.T, smtpAddr net.Addr) *Reporter {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Server.DataDir = t.TempDir()
+	applyConfig(cfg)
+
+	addr := smtpAddr.(*net.TCPAddr)
+	reporter, err := newReporter(newHub(cfg), ReportsConfig{
+		Schedule: "weekly mon 08:00",
+		SMTP:     SMTPConfig{Host: addr.IP.String(), Port: addr.Port, From: "tracker@example.com"},
+	}, "http://tracker.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reporter
+}
+
+var confirmLink = regexp.MustCompile(`href="http://tracker\.test(/reports/confirm\?token=[^"]+)"`)
+
+// confirm opens the link of a confirmation email like a browser would
+func confirm(t *testing.T, reporter *Reporter, m sentMail) {
+	t.Helper()
+	body, err := io.ReadAll(quotedprintable.NewReader(m.msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := confirmLink.FindSubmatch(body)
+	if match == nil {
+		t.Fatalf("no confirmation link in %s", body)
+	}
+	target := strings.ReplaceAll(string(match[1]), "&amp;", "&")
+
+	rec := httptest.NewRecorder()
+	confirmReportsHandler(rec, httptest.NewRequest(http.MethodGet, target, nil), reporter)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("confirm answered %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestReportSubscribeConfirmSend(t *testing.T) {
+	server := newSMTPServer(t)
+	reporter := newTestReporter(t, server.listener.Addr())
+
+	for _, email := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		if err := reporter.Subscribe(ReportSubscription{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mails := server.take()
+	if len(mails) != 3 {
+		t.Fatalf("%d confirmation emails, want 3", len(mails))
+	}
+	// carol never confirms
+	confirm(t, reporter, mails[0])
+	confirm(t, reporter, mails[1])
+
+	// bob follows the unsubscribe link of a report
+	rec := httptest.NewRecorder()
+	unsubscribe := reporter.link("/reports/unsubscribe", "unsubscribe", "bob@example.com")
+	unsubscribeReportsHandler(rec, httptest.NewRequest(http.MethodPost, strings.TrimPrefix(unsubscribe, "http://tracker.test"), nil), reporter)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unsubscribe answered %d", rec.Code)
+	}
+
+	reporter.SendAll(time.Now())
+	mails = server.take()
+	if len(mails) != 1 {
+		t.Fatalf("%d reports sent, want 1", len(mails))
+	}
+	report := mails[0]
+	if len(report.to) != 1 || report.to[0] != "alice@example.com" {
+		t.Errorf("report sent to %v", report.to)
+	}
+
+	header := report.msg.Header
+	link := strings.Trim(header.Get("List-Unsubscribe"), "<>")
+	u, err := url.Parse(link)
+	if err != nil || u.Path != "/reports/unsubscribe" {
+		t.Fatalf("List-Unsubscribe %q", header.Get("List-Unsubscribe"))
+	}
+	if email, ok := reporter.verify("unsubscribe", u.Query().Get("token")); !ok || email != "alice@example.com" {
+		t.Errorf("unsubscribe token for %q, valid %v", email, ok)
+	}
+	if header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Errorf("List-Unsubscribe-Post %q", header.Get("List-Unsubscribe-Post"))
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	sessionsIndex = "coding-sessions"
+	// exportPageSize is how many sessions are fetched and written at a time
+	exportPageSize = 1000
+)
+
+// ExportedSession is one row of a session export
+type ExportedSession struct {
+	ID              string    `json:"id" parquet:"id"`
+	ServerTimestamp time.Time `json:"server_timestamp" parquet:"server_timestamp,timestamp(millisecond)"`
+	ClientTimestamp string    `json:"client_timestamp,omitempty" parquet:"client_timestamp,optional"`
+	User            string    `json:"user,omitempty" parquet:"user,optional"`
+	Team            string    `json:"team,omitempty" parquet:"team,optional"`
+	Editor          string    `json:"editor" parquet:"editor"`
+	Project         string    `json:"project" parquet:"project"`
+	Language        string    `json:"language" parquet:"language"`
+	FilePath        string    `json:"file_path,omitempty" parquet:"file_path,optional"`
+	DurationSeconds int64     `json:"duration_seconds" parquet:"duration_seconds"`
+	LinesOfCode     *int64    `json:"lines_of_code,omitempty" parquet:"lines_of_code,optional"`
+}
+
+var exportCSVHeader = []string{
+	"id", "server_timestamp", "client_timestamp", "user", "team", "editor",
+	"project", "language", "file_path", "duration_seconds", "lines_of_code",
+}
+
+func (s ExportedSession) csvRecord() []string {
+	lines := ""
+	if s.LinesOfCode != nil {
+		lines = strconv.FormatInt(*s.LinesOfCode, 10)
+	}
+	return []string{
+		s.ID, s.ServerTimestamp.Format(time.RFC3339), s.ClientTimestamp, s.User, s.Team, s.Editor,
+		s.Project, s.Language, s.FilePath, strconv.FormatInt(s.DurationSeconds, 10), lines,
+	}
+}
+
+// ExportQuery selects the sessions of an export, empty filters match everything
+type ExportQuery struct {
+	From     time.Time
+	To       time.Time
+	User     string
+	Team     string
+	Project  string
+	Language string
+	Editor   string
+}
+
+func (q ExportQuery) esQuery() map[string]interface{} {
+	filters := []interface{}{
+		map[string]interface{}{
+			"range": map[string]interface{}{
+				"server_timestamp": map[string]interface{}{
+					"gte": q.From.Format(time.RFC3339),
+					"lt":  q.To.Format(time.RFC3339),
+				},
+			},
+		},
+	}
+	for field, value := range map[string]string{
+		"user": q.User, "team": q.Team, "project": q.Project, "language": q.Language, "editor": q.Editor,
+	} {
+		if value != "" {
+			// dynamic mapping indexes strings as text with a keyword sub-field
+			filters = append(filters, map[string]interface{}{
+				"term": map[string]interface{}{field + ".keyword": value},
+			})
+		}
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{"filter": filters}}
+}
+
+// ExportSessions pages through the matching sessions in server time order
+// using a point in time, so the result is consistent and memory use stays
+// at one page however many sessions match
+func (es *ESClient) ExportSessions(ctx context.Context, q ExportQuery, page func([]ExportedSession) error) error {
+	res, err := es.client.OpenPointInTime([]string{sessionsIndex}, "2m",
+		es.client.OpenPointInTime.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	var pit struct {
+		ID string `json:"id"`
+	}
+	err = decodeESResponse(res.Body, res.IsError(), res.Status(), &pit)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("opening point in time: %v", err)
+	}
+	defer func() {
+		body, _ := json.Marshal(map[string]string{"id": pit.ID})
+		if res, err := es.client.ClosePointInTime(
+			es.client.ClosePointInTime.WithContext(context.Background()),
+			es.client.ClosePointInTime.WithBody(bytes.NewReader(body))); err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	var searchAfter []interface{}
+	for {
+		request := map[string]interface{}{
+			"size":  exportPageSize,
+			"query": q.esQuery(),
+			"pit":   map[string]interface{}{"id": pit.ID, "keep_alive": "2m"},
+			"sort": []interface{}{
+				map[string]interface{}{"server_timestamp": "asc"},
+				map[string]interface{}{"_shard_doc": "asc"},
+			},
+			"track_total_hits": false,
+		}
+		if searchAfter != nil {
+			request["search_after"] = searchAfter
+		}
+		body, _ := json.Marshal(request)
+
+		res, err := es.client.Search(
+			es.client.Search.WithContext(ctx),
+			es.client.Search.WithBody(bytes.NewReader(body)),
+		)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			PitID string `json:"pit_id"`
+			Hits  struct {
+				Hits []struct {
+					ID     string          `json:"_id"`
+					Source json.RawMessage `json:"_source"`
+					Sort   []interface{}   `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		err = decodeESResponse(res.Body, res.IsError(), res.Status(), &result)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("searching sessions: %v", err)
+		}
+
+		hits := result.Hits.Hits
+		if len(hits) == 0 {
+			return nil
+		}
+
+		sessions := make([]ExportedSession, 0, len(hits))
+		for _, hit := range hits {
+			sessions = append(sessions, exportedSession(hit.ID, hit.Source))
+		}
+		if err := page(sessions); err != nil {
+			return err
+		}
+
+		if result.PitID != "" {
+			pit.ID = result.PitID
+		}
+		searchAfter = hits[len(hits)-1].Sort
+		if len(hits) < exportPageSize {
+			return nil
+		}
+	}
+}
+
+func decodeESResponse(body io.Reader, isError bool, status string, v interface{}) error {
+	if isError {
+		data, _ := io.ReadAll(io.LimitReader(body, 4096))
+		return fmt.Errorf("%s: %s", status, data)
+	}
+	return json.NewDecoder(body).Decode(v)
+}
+
+// exportedSession maps an indexed session document to an export row
+func exportedSession(id string, source json.RawMessage) ExportedSession {
+	var doc struct {
+		DurationSeconds int64   `json:"duration_seconds"`
+		Editor          string  `json:"editor"`
+		Project         string  `json:"project"`
+		Language        string  `json:"language"`
+		FilePath        *string `json:"file_path"`
+		ClientTimestamp string  `json:"client_timestamp"`
+		ServerTimestamp string  `json:"server_timestamp"`
+		LinesOfCode     *int64  `json:"lines_of_code"`
+		User            string  `json:"user"`
+		Team            string  `json:"team"`
+	}
+	json.Unmarshal(source, &doc)
+
+	s := ExportedSession{
+		ID:              id,
+		ClientTimestamp: doc.ClientTimestamp,
+		User:            doc.User,
+		Team:            doc.Team,
+		Editor:          doc.Editor,
+		Project:         doc.Project,
+		Language:        doc.Language,
+		DurationSeconds: doc.DurationSeconds,
+		LinesOfCode:     doc.LinesOfCode,
+	}
+	if doc.FilePath != nil {
+		s.FilePath = *doc.FilePath
+	}
+	s.ServerTimestamp, _ = time.Parse(time.RFC3339, doc.ServerTimestamp)
+	return s
+}
+
+// sessionWriter encodes export pages in one format
+type sessionWriter interface {
+	WriteSessions([]ExportedSession) error
+	Close() error
+}
+
+var exportContentTypes = map[string]string{
+	"csv":     "text/csv; charset=utf-8",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+func newSessionWriter(format string, w io.Writer) (sessionWriter, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return nil, err
+		}
+		return &csvSessionWriter{w: cw}, nil
+	case "ndjson":
+		return &ndjsonSessionWriter{enc: json.NewEncoder(w)}, nil
+	case "parquet":
+		// bound the row groups so the writer does not keep the whole export
+		return &parquetSessionWriter{w: parquet.NewGenericWriter[ExportedSession](w,
+			parquet.MaxRowsPerRowGroup(50*exportPageSize))}, nil
+	}
+	return nil, fmt.Errorf("format must be one of csv, ndjson, parquet")
+}
+
+type csvSessionWriter struct{ w *csv.Writer }
+
+func (c *csvSessionWriter) WriteSessions(sessions []ExportedSession) error {
+	for _, s := range sessions {
+		if err := c.w.Write(s.csvRecord()); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvSessionWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonSessionWriter struct{ enc *json.Encoder }
+
+func (n *ndjsonSessionWriter) WriteSessions(sessions []ExportedSession) error {
+	for _, s := range sessions {
+		if err := n.enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ndjsonSessionWriter) Close() error { return nil }
+
+type parquetSessionWriter struct {
+	w *parquet.GenericWriter[ExportedSession]
+}
+
+func (p *parquetSessionWriter) WriteSessions(sessions []ExportedSession) error {
+	_, err := p.w.Write(sessions)
+	return err
+}
+
+func (p *parquetSessionWriter) Close() error { return p.w.Close() }
+
+// parseExportRange resolves from, to and range (a duration before to) with
+// the same syntax as the history API; the default is the last 30 days
+func parseExportRange(from, to, rng string) (time.Time, time.Time, error) {
+	end := time.Now()
+	if to != "" {
+		t, err := parseTime(to)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("to must be RFC3339 or unix seconds")
+		}
+		end = t
+	}
+
+	start := end.AddDate(0, 0, -30)
+	if rng != "" {
+		d, err := time.ParseDuration(rng)
+		if err != nil || d <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("range must be a positive duration such as 720h")
+		}
+		start = end.Add(-d)
+	}
+	if from != "" {
+		t, err := parseTime(from)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("from must be RFC3339 or unix seconds")
+		}
+		start = t
+	}
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return start, end, nil
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request, esClient *ESClient) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if esClient == nil {
+		writeError(w, http.StatusServiceUnavailable, "Elasticsearch is not connected")
+		return
+	}
+
+	params := r.URL.Query()
+	from, to, err := parseExportRange(params.Get("from"), params.Get("to"), params.Get("range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q := ExportQuery{
+		From:     from,
+		To:       to,
+		User:     params.Get("user"),
+		Team:     params.Get("team"),
+		Project:  params.Get("project"),
+		Language: params.Get("language"),
+		Editor:   params.Get("editor"),
+	}
+
+	format := params.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	writer, err := newSessionWriter(format, w)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sessions-%s-%s.%s"`,
+		from.Format("20060102"), to.Format("20060102"), format))
+
+	flusher, _ := w.(http.Flusher)
+	rows := 0
+	err = esClient.ExportSessions(r.Context(), q, func(sessions []ExportedSession) error {
+		if err := writer.WriteSessions(sessions); err != nil {
+			return err
+		}
+		rows += len(sessions)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && rows == 0 {
+		// nothing was flushed yet, the client can still get an error status
+		// instead of what looks like an empty export
+		exportLog.Error("Session export failed", "format", format, "error", err)
+		w.Header().Del("Content-Disposition")
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		// the status line is gone, an incomplete body is all we can signal
+		exportLog.Error("Session export failed", "format", format, "rows", rows, "error", err)
+		return
+	}
+	exportLog.Info("Sessions exported", "format", format, "rows", rows)
+}
+
+// runExport implements `server export`: write sessions from Elasticsearch to a file or stdout
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	from := fs.String("from", "", "start time, RFC3339 or unix seconds (default: 30 days ago)")
+	to := fs.String("to", "", "end time, RFC3339 or unix seconds (default: now)")
+	rng := fs.String("range", "", "duration before -to, e.g. 168h, instead of -from")
+	format := fs.String("format", "csv", "csv, ndjson or parquet")
+	output := fs.String("o", "-", "output file, - for stdout")
+	q := ExportQuery{}
+	fs.StringVar(&q.User, "user", "", "only sessions of this user")
+	fs.StringVar(&q.Team, "team", "", "only sessions of this team")
+	fs.StringVar(&q.Project, "project", "", "only sessions of this project")
+	fs.StringVar(&q.Language, "language", "", "only sessions in this language")
+	fs.StringVar(&q.Editor, "editor", "", "only sessions from this editor")
+	fs.Parse(args)
+
+	var err error
+	q.From, q.To, err = parseExportRange(*from, *to, *rng)
+	if err != nil {
+		fatal(exportLog, "Invalid export range", "error", err)
+	}
+
+	cfg := mustLoadConfig("export")
+	esClient, err := NewESClient(cfg.Elasticsearch.URL)
+	if err != nil || esClient == nil {
+		fatal(exportLog, "Failed to connect to Elasticsearch", "error", err)
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			fatal(exportLog, "Failed to create the output file", "file", *output, "error", err)
+		}
+		defer out.Close()
+	}
+
+	writer, err := newSessionWriter(*format, out)
+	if err != nil {
+		fatal(exportLog, "Invalid export format", "error", err)
+	}
+
+	rows := 0
+	err = esClient.ExportSessions(context.Background(), q, func(sessions []ExportedSession) error {
+		rows += len(sessions)
+		fmt.Fprintf(os.Stderr, "\rExported %d sessions", rows)
+		return writer.WriteSessions(sessions)
+	})
+	fmt.Fprintln(os.Stderr)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		fatal(exportLog, "Export failed", "rows", rows, "error", err)
+	}
+	exportLog.Info("Sessions exported", "rows", rows, "from", q.From.Format(time.RFC3339), "to", q.To.Format(time.RFC3339))
+}
@@ -3,14 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/host"
-	"github.com/shirou/gopsutil/v3/mem"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var upgrader = websocket.Upgrader{
@@ -19,127 +18,132 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-func monitorWSHandler(w http.ResponseWriter, r *http.Request, esClient *ESClient, hub *Hub) {
+func monitorWSHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	backfill := 10 * time.Minute
+	if v := r.URL.Query().Get("backfill"); v != "" {
+		d, err := time.ParseDuration(v)
+		if v == "0" {
+			d, err = 0, nil
+		}
+		if err != nil || d < 0 {
+			http.Error(w, "backfill must be a duration such as 10m or 0", http.StatusBadRequest)
+			return
+		}
+		backfill = d
+	}
+
+	logger := wsLog.With("client", r.RemoteAddr, "endpoint", r.URL.Path)
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Monitor WebSocket upgrade error:", err)
+		logger.Warn("WebSocket upgrade failed", "error", err)
 		return
 	}
+	client := wsConns.track(conn, "monitor", r)
+	defer wsConns.release(client)
 
-	clientIP := r.RemoteAddr
-	log.Printf("Monitor client connected: %s", clientIP)
-
-	hub.register <- Subscription{Conn: conn, Filter: "metrics"}
-
-	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		defer ticker.Stop()
-		defer func() {
-			hub.unregister <- conn
-			log.Printf("Monitor client disconnected: %s", clientIP)
-		}()
-
-		for range ticker.C {
-			cpuPercent, err := cpu.Percent(0, false)
-			if err != nil || len(cpuPercent) == 0 {
-				log.Printf("Failed to get CPU metrics: %v", err)
-				continue
-			}
-
-			cpuInfo, err := cpu.Info()
-			if err != nil || len(cpuInfo) == 0 {
-				log.Printf("Failed to get CPU info: %v", err)
-				continue
-			}
-			coreCount, _ := cpu.Counts(true)
-
-			memStat, err := mem.VirtualMemory()
-			if err != nil {
-				log.Printf("Failed to get memory info: %v", err)
-				continue
-			}
-
-			hostInfo, err := host.Info()
-			if err != nil {
-				log.Printf("Failed to get host info: %v", err)
-				continue
-			}
-
-			metrics := SystemMetrics{
-				CPU:       cpuPercent[0],
-				CPUModel:  cpuInfo[0].ModelName,
-				Cores:     coreCount,
-				Memory:    memStat.UsedPercent,
-				TotalMem:  memStat.Total / 1024 / 1024 / 1024, // GB
-				UsedMem:   memStat.Used / 1024 / 1024 / 1024,  // GB
-				OS:        hostInfo.OS,
-				Platform:  hostInfo.Platform,
-				Kernel:    hostInfo.KernelVersion,
-				Arch:      hostInfo.KernelArch,
-				Uptime:    hostInfo.Uptime,
-				Timestamp: time.Now().Format(time.RFC3339),
-			}
+	logger.Info("Monitor client connected")
 
-			hub.broadcast <- BroadcastMessage{
-				Type:    "metrics",
-				Data:    metrics,
-				EventID: time.Now().Format("20060102150405"),
-			}
+	hosts := parseHostFilter(r.URL.Query().Get("host"))
 
-			if esClient != nil && time.Now().Second()%5 == 0 {
-				go func(m SystemMetrics) {
-					ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-					defer cancel()
-
-					done := make(chan error, 1)
-					go func() {
-						done <- esClient.IndexMetrics(m)
-					}()
-
-					select {
-					case err := <-done:
-						if err != nil {
-							log.Printf("Failed to index metrics: %v", err)
-						}
-					case <-ctx.Done():
-						log.Println("Elasticsearch metrics indexing timeout")
-					}
-				}(metrics)
-			}
+	// the backfill is written before registering so it never races hub writes
+	if backfill > 0 {
+		if err := sendMetricsBackfill(client, hub, hosts, backfill); err != nil {
+			logger.Warn("Failed to send metrics backfill", "error", err)
+			conn.Close()
+			return
 		}
-	}()
+	}
+
+	hub.register <- Subscription{
+		Client: client,
+		Filter: "metrics,alert",
+		Hosts:  hosts,
+	}
 
 	for {
-		_, _, err := conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Monitor client unexpected close: %s - %v", clientIP, err)
+				logger.Warn("Monitor client closed unexpectedly", "error", err)
 			}
-			hub.unregister <- conn
+			hub.unregister <- client
+			logger.Info("Monitor client disconnected")
 			break
 		}
+		client.received(len(message))
 	}
 }
 
+// sendMetricsBackfill writes one metrics_history message per subscribed host
+func sendMetricsBackfill(client *wsClient, hub *Hub, hosts []string, window time.Duration) error {
+	if len(hosts) == 0 {
+		hosts = hub.history.Hosts()
+	}
+
+	now := time.Now()
+	for _, host := range hosts {
+		points, step := hub.history.Query(host, now.Add(-window), now, 0)
+		message := BroadcastMessage{
+			Type: "metrics_history",
+			Data: MetricsHistoryResponse{
+				HostID:      host,
+				From:        now.Add(-window).Format(time.RFC3339),
+				To:          now.Format(time.RFC3339),
+				StepSeconds: step.Seconds(),
+				Points:      points,
+			},
+			EventID: now.Format("20060102150405"),
+		}
+
+		if err := client.writeJSON(message, 5*time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func trackingWSHandler(w http.ResponseWriter, r *http.Request, esClient *ESClient, hub *Hub) {
+	clientIP := r.RemoteAddr
+	connUser := r.URL.Query().Get("user")
+	connTeam := r.URL.Query().Get("team")
+	logger := wsLog.With("client", clientIP, "endpoint", r.URL.Path)
+	if connUser != "" {
+		logger = logger.With("user", connUser)
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Tracking WebSocket upgrade error:", err)
+		logger.Warn("WebSocket upgrade failed", "error", err)
 		return
 	}
+	client := wsConns.track(conn, "track", r)
+	defer wsConns.release(client)
 	defer conn.Close()
+	client.identify(connUser, "")
 
-	clientIP := r.RemoteAddr
-	log.Printf("Tracking client connected: %s", clientIP)
+	logger.Info("Tracking client connected")
+
+	// users seen on this connection, marked offline when it closes
+	present := make(map[string]bool)
+	defer func() {
+		for user := range present {
+			hub.presence.Disconnect(user)
+		}
+	}()
+	if connUser != "" {
+		hub.presence.Connect(connUser, connTeam)
+		present[connUser] = true
+	}
 
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	ws := currentConfig().WebSocket
+	conn.SetReadDeadline(time.Now().Add(ws.TrackReadTimeout))
 
 	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(ws.TrackReadTimeout))
 		return nil
 	})
 
-	pingTicker := time.NewTicker(30 * time.Second)
+	pingTicker := time.NewTicker(ws.PingInterval)
 	defer pingTicker.Stop()
 
 	done := make(chan struct{})
@@ -149,8 +153,7 @@ func trackingWSHandler(w http.ResponseWriter, r *http.Request, esClient *ESClien
 		for {
 			select {
 			case <-pingTicker.C:
-				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
 					return
 				}
 			case <-done:
@@ -163,74 +166,156 @@ func trackingWSHandler(w http.ResponseWriter, r *http.Request, esClient *ESClien
 		_, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Tracking client unexpected close: %s - %v", clientIP, err)
+				logger.Warn("Tracking client closed unexpectedly", "error", err)
 			} else {
-				log.Printf("Tracking client disconnected: %s", clientIP)
+				logger.Info("Tracking client disconnected")
 			}
 			break
 		}
+		client.received(len(message))
 
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(ws.TrackReadTimeout))
 
+		// one trace per frame, covering everything the session goes through
+		ctx, frame := tracer.Start(context.Background(), "ws.track frame",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("client.address", clientIP),
+				attribute.Int("message.size", len(message)),
+			))
+
+		_, validate := tracer.Start(ctx, "session.validate")
 		var session CodingSession
 		if err := json.Unmarshal(message, &session); err != nil {
-			log.Printf("JSON parse error from %s: %v", clientIP, err)
+			endSpan(validate, err)
+			endSpan(frame, err)
+			logger.Warn("Invalid session JSON", "error", err)
+			sessionsRejected.Inc("invalid_json")
 
 			errResp := map[string]interface{}{
 				"status": "error",
 				"error":  "Invalid JSON format",
 			}
-			conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-			errJSON, _ := json.Marshal(errResp)
-			conn.WriteMessage(websocket.TextMessage, errJSON)
+			client.writeJSON(errResp, 2*time.Second)
 			continue
 		}
 
-		if session.DurationSeconds <= 0 {
-			log.Printf("Invalid duration from %s: %d", clientIP, session.DurationSeconds)
+		if session.User == "" {
+			session.User = connUser
+		}
+		if session.Team == "" {
+			session.Team = connTeam
+		}
+		clientKey := session.User
+		if clientKey == "" {
+			clientKey = clientIP
+		}
+		client.identify(session.User, "")
+		var invalid error
+		if session.Type != "heartbeat" && session.DurationSeconds <= 0 {
+			invalid = fmt.Errorf("invalid duration %d", session.DurationSeconds)
+		}
+		endSpan(validate, invalid)
+		frame.SetAttributes(
+			attribute.String("session.type", session.Type),
+			attribute.String("user", clientKey),
+			attribute.String("project", session.Project),
+			attribute.String("language", session.Language),
+			attribute.String("editor", session.Editor),
+			attribute.Int64("duration_seconds", session.DurationSeconds),
+		)
+
+		if !present[clientKey] {
+			hub.presence.Connect(clientKey, session.Team)
+			present[clientKey] = true
+		}
+		hub.presence.Activity(clientKey, session.Team, session.Project, session.Language, session.Editor)
+
+		if session.Type == "heartbeat" {
+			ack := map[string]interface{}{
+				"status":    "received",
+				"timestamp": time.Now().Format(time.RFC3339),
+			}
+			err := client.writeJSON(ack, 2*time.Second)
+			endSpan(frame, err)
+			if err != nil {
+				logger.Warn("Failed to send ack", "error", err)
+				break
+			}
 			continue
 		}
 
+		sessionsReceived.Inc()
+		if invalid != nil {
+			endSpan(frame, invalid)
+			logger.Warn("Invalid session duration", "user", clientKey, "duration_seconds", session.DurationSeconds)
+			sessionsRejected.Inc("invalid_duration")
+			continue
+		}
+		if currentConfig().Metrics.SessionLabels {
+			codingSeconds.Add(float64(session.DurationSeconds), session.Language, session.Project)
+		}
+
 		if esClient != nil {
-			go func(s CodingSession) {
-				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			s := session
+			esClient.Background(func() {
+				ctx, span := tracer.Start(ctx, "session.index",
+					trace.WithAttributes(attribute.String("db.elasticsearch.index", sessionsIndex)))
+				ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 				defer cancel()
 
 				done := make(chan error, 1)
 				go func() {
-					done <- esClient.IndexSession(s)
+					done <- esClient.IndexSession(ctx, s)
 				}()
 
 				select {
 				case err := <-done:
+					endSpan(span, err)
 					if err != nil {
-						log.Printf("Failed to index session from %s: %v", clientIP, err)
+						logger.Error("Failed to index session", "user", clientKey, "index", sessionsIndex, "error", err)
 					} else {
-						log.Printf("Session indexed: %s | %s | %s | %ds",
-							s.Editor, s.Project, s.Language, s.DurationSeconds)
+						sessionsIndexed.Inc()
+						logger.Debug("Session indexed", "user", clientKey, "index", sessionsIndex,
+							"editor", s.Editor, "project", s.Project, "language", s.Language, "duration_seconds", s.DurationSeconds)
 					}
 				case <-ctx.Done():
-					log.Printf("Elasticsearch session indexing timeout for %s", clientIP)
+					endSpan(span, ctx.Err())
+					logger.Error("Session indexing timed out", "user", clientKey, "index", sessionsIndex)
+					esIndexTimeouts.Inc(sessionsIndex)
 				}
-			}(session)
+			})
 		}
 
-		weekSeconds := hub.AddSessionRecord(clientIP, session.DurationSeconds)
+		_, record := tracer.Start(ctx, "hub.AddSessionRecord")
+		weekSeconds := hub.AddSessionRecord(clientKey, session.DurationSeconds)
+		record.End()
 
 		hub.broadcast <- BroadcastMessage{
 			Type:    "session",
 			Data:    session,
 			EventID: time.Now().Format("20060102150405"),
+			ctx:     ctx,
 		}
 
 		summary := WeeklySummary{
-			Client:      clientIP,
+			Client:      clientKey,
 			WeekSeconds: weekSeconds,
 		}
 		hub.broadcast <- BroadcastMessage{
 			Type:    "weekly_summary",
 			Data:    summary,
 			EventID: time.Now().Format("20060102150405"),
+			ctx:     ctx,
+		}
+
+		if update, changed := hub.leaderboard.Record(clientKey, session.Team, session, time.Now()); changed {
+			hub.broadcast <- BroadcastMessage{
+				Type:    "leaderboard",
+				Data:    update,
+				EventID: time.Now().Format("20060102150405"),
+				ctx:     ctx,
+			}
 		}
 
 		ack := map[string]interface{}{
@@ -239,44 +324,45 @@ func trackingWSHandler(w http.ResponseWriter, r *http.Request, esClient *ESClien
 			"week_seconds": weekSeconds,
 		}
 
-		conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-		ackJSON, _ := json.Marshal(ack)
-		if err := conn.WriteMessage(websocket.TextMessage, ackJSON); err != nil {
-			log.Printf("Failed to send ack to %s: %v", clientIP, err)
+		err = client.writeJSON(ack, 2*time.Second)
+		endSpan(frame, err)
+		if err != nil {
+			logger.Warn("Failed to send ack", "error", err)
 			break
 		}
 	}
 }
 
 func externalWSHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	logger := wsLog.With("client", r.RemoteAddr, "endpoint", r.URL.Path)
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("External WebSocket upgrade error:", err)
+		logger.Warn("WebSocket upgrade failed", "error", err)
 		return
 	}
+	client := wsConns.track(conn, "external", r)
+	defer wsConns.release(client)
 	defer conn.Close()
 
-	clientIP := r.RemoteAddr
-	log.Printf("External client connected: %s", clientIP)
-
-	filter := "session,weekly_summary"
+	filter := "session,weekly_summary,leaderboard,presence,alert"
 
-	log.Printf("External client %s subscribed (session + weekly_summary only)", clientIP)
+	logger.Info("External client connected", "filter", filter)
 
-	hub.register <- Subscription{Conn: conn, Filter: filter}
+	hub.register <- Subscription{Client: client, Filter: filter}
 	defer func() {
-		hub.unregister <- conn
-		log.Printf("External client disconnected: %s", clientIP)
+		hub.unregister <- client
+		logger.Info("External client disconnected")
 	}()
 
-	conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+	ws := currentConfig().WebSocket
+	conn.SetReadDeadline(time.Now().Add(ws.ReadTimeout))
 
 	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(ws.ReadTimeout))
 		return nil
 	})
 
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(ws.PingInterval)
 	defer ticker.Stop()
 
 	done := make(chan struct{})
@@ -286,8 +372,7 @@ func externalWSHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
 		for {
 			select {
 			case <-ticker.C:
-				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
 					return
 				}
 			case <-done:
@@ -297,13 +382,14 @@ func externalWSHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
 	}()
 
 	for {
-		_, _, err := conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("External client unexpected close: %s - %v", clientIP, err)
+				logger.Warn("External client closed unexpectedly", "error", err)
 			}
 			return
 		}
-		conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+		client.received(len(message))
+		conn.SetReadDeadline(time.Now().Add(ws.ReadTimeout))
 	}
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheckNames are the checks health.ready_checks can name
+var healthCheckNames = []string{"elasticsearch", "spool", "hub", "collector"}
+
+// livenessChecks run on /livez. Only a wedged hub loop is worth a restart,
+// a missing dependency is not.
+var livenessChecks = []string{"hub"}
+
+// healthCheck probes one dependency, detail says what it found
+type healthCheck func(ctx context.Context) (detail string, err error)
+
+// HealthCheckResult is one check in the /livez and /readyz responses
+type HealthCheckResult struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"` // ok or failing
+	Gating     bool    `json:"gating"`
+	DurationMs float64 `json:"duration_ms"`
+	Detail     string  `json:"detail,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// healthChecker holds the checks by name, main registers them once the
+// dependencies exist
+type healthChecker struct {
+	mutex  sync.RWMutex
+	checks map[string]healthCheck
+}
+
+var healthChecks = &healthChecker{checks: make(map[string]healthCheck)}
+
+func (h *healthChecker) Register(name string, check healthCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checks[name] = check
+}
+
+// Run runs the named checks concurrently, each within health.timeout, and
+// marks the ones gating says count
+func (h *healthChecker) Run(ctx context.Context, names []string, gating func(string) bool) []HealthCheckResult {
+	timeout := currentConfig().Health.Timeout
+
+	results := make([]HealthCheckResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		h.mutex.RLock()
+		check, ok := h.checks[name]
+		h.mutex.RUnlock()
+
+		results[i] = HealthCheckResult{Name: name, Status: "ok", Gating: gating(name)}
+		if !ok {
+			results[i].Status = "failing"
+			results[i].Error = "check not registered"
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *HealthCheckResult) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			detail, err := runCheck(ctx, check)
+			result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+			result.Detail = detail
+			if err != nil {
+				result.Status = "failing"
+				result.Error = err.Error()
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// runCheck gives up on a check that ignores its context
+func runCheck(ctx context.Context, check healthCheck) (string, error) {
+	type outcome struct {
+		detail string
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		detail, err := check(ctx)
+		done <- outcome{detail, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.detail, o.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("timed out: %w", ctx.Err())
+	}
+}
+
+func esHealthCheck(es *ESClient) healthCheck {
+	return func(ctx context.Context) (string, error) {
+		if es == nil {
+			return "", errors.New("not connected, the server started without Elasticsearch")
+		}
+		start := time.Now()
+		if err := es.Ping(ctx); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("ping %s", time.Since(start).Round(time.Microsecond)), nil
+	}
+}
+
+// spoolHealthCheck fails when more writes wait than health.max_spool, which
+// means a webhook receiver or Elasticsearch cannot keep up
+func spoolHealthCheck(es *ESClient, webhooks *WebhookDispatcher) healthCheck {
+	return func(context.Context) (string, error) {
+		deliveries := webhooks.QueueLength()
+		writes := 0
+		if es != nil {
+			writes = es.Pending()
+		}
+		detail := fmt.Sprintf("%d webhook deliveries, %d Elasticsearch writes pending", deliveries, writes)
+		if max := currentConfig().Health.MaxSpool; deliveries+writes > max {
+			return detail, fmt.Errorf("%d pending writes exceed %d", deliveries+writes, max)
+		}
+		return detail, nil
+	}
+}
+
+// hubHealthCheck has the hub loop deliver its queue, which it only does
+// when it is still running
+func hubHealthCheck(hub *Hub) healthCheck {
+	return func(ctx context.Context) (string, error) {
+		queued := len(hub.broadcast)
+		if err := hub.Flush(ctx); err != nil {
+			return fmt.Sprintf("%d broadcasts queued", queued), errors.New("hub loop not responding")
+		}
+		return fmt.Sprintf("%d broadcasts queued, %d clients", queued, hub.GetClientCount()), nil
+	}
+}
+
+// collectorHealthCheck fails when the local machine has not been sampled for
+// three intervals
+func collectorHealthCheck(hub *Hub) healthCheck {
+	return func(context.Context) (string, error) {
+		lastSeen, ok := hub.hosts.LastSeen(localHostID)
+		if !ok {
+			return "", errors.New("no local sample yet")
+		}
+		age := time.Since(lastSeen).Round(time.Millisecond)
+		detail := fmt.Sprintf("last sample %s ago", age)
+		if maxAge := 3 * currentConfig().Metrics.SampleInterval; age > maxAge {
+			return detail, fmt.Errorf("no sample for more than %s", maxAge)
+		}
+		return detail, nil
+	}
+}
+
+// writeProbe answers a probe, 503 when a gating check fails
+func writeProbe(w http.ResponseWriter, ok bool, okStatus, failStatus string, results []HealthCheckResult) {
+	code, status := http.StatusOK, okStatus
+	if !ok {
+		code, status = http.StatusServiceUnavailable, failStatus
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, map[string]interface{}{
+		"status":    status,
+		"checks":    results,
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+func passed(results []HealthCheckResult) bool {
+	for _, result := range results {
+		if result.Gating && result.Status != "ok" {
+			return false
+		}
+	}
+	return true
+}
+
+// livezHandler tells the orchestrator whether to restart the process
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	results := healthChecks.Run(r.Context(), livenessChecks, func(string) bool { return true })
+	writeProbe(w, passed(results), "alive", "failing", results)
+}
+
+// readyzHandler runs every check, only those in health.ready_checks decide
+// whether the server takes traffic
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	gating := make(map[string]bool)
+	for _, name := range currentConfig().Health.ReadyChecks {
+		gating[name] = true
+	}
+	results := healthChecks.Run(r.Context(), healthCheckNames, func(name string) bool { return gating[name] })
+	writeProbe(w, passed(results), "ready", "not_ready", results)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryPoint is the average of the samples of one host within a step
+type HistoryPoint struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Samples      int       `json:"samples"`
+	CPU          float64   `json:"cpu"`
+	Memory       float64   `json:"memory"`
+	UsedMemBytes float64   `json:"used_mem_bytes"`
+	Load1        float64   `json:"load1"`
+	SwapPercent  float64   `json:"swap_percent"`
+	NetRxRate    float64   `json:"net_rx_bytes_per_sec"`
+	NetTxRate    float64   `json:"net_tx_bytes_per_sec"`
+	DiskRead     float64   `json:"disk_read_bytes_per_sec"`
+	DiskWrite    float64   `json:"disk_write_bytes_per_sec"`
+	ContainerCPU float64   `json:"container_cpu_percent,omitempty"`
+	ContainerMem float64   `json:"container_memory_bytes,omitempty"`
+}
+
+func pointFromMetrics(m SystemMetrics, at time.Time) HistoryPoint {
+	p := HistoryPoint{
+		Timestamp:    at,
+		Samples:      1,
+		CPU:          m.CPU,
+		Memory:       m.Memory,
+		UsedMemBytes: float64(m.UsedMemBytes),
+	}
+	if m.Load != nil {
+		p.Load1 = m.Load.Load1
+	}
+	if m.Swap != nil {
+		p.SwapPercent = m.Swap.UsedPercent
+	}
+	for _, n := range m.Network {
+		p.NetRxRate += n.RxBytesRate
+		p.NetTxRate += n.TxBytesRate
+	}
+	for _, d := range m.Disks {
+		p.DiskRead += d.ReadBytesRate
+		p.DiskWrite += d.WriteBytesRate
+	}
+	if m.Container != nil {
+		p.ContainerCPU = m.Container.CPUUsagePercent
+		p.ContainerMem = float64(m.Container.MemoryWorkingSetBytes)
+	}
+	return p
+}
+
+// merge folds other into p as a running average
+func (p *HistoryPoint) merge(other HistoryPoint) {
+	n := float64(p.Samples)
+	m := float64(other.Samples)
+	avg := func(a, b float64) float64 { return (a*n + b*m) / (n + m) }
+
+	p.CPU = avg(p.CPU, other.CPU)
+	p.Memory = avg(p.Memory, other.Memory)
+	p.UsedMemBytes = avg(p.UsedMemBytes, other.UsedMemBytes)
+	p.Load1 = avg(p.Load1, other.Load1)
+	p.SwapPercent = avg(p.SwapPercent, other.SwapPercent)
+	p.NetRxRate = avg(p.NetRxRate, other.NetRxRate)
+	p.NetTxRate = avg(p.NetTxRate, other.NetTxRate)
+	p.DiskRead = avg(p.DiskRead, other.DiskRead)
+	p.DiskWrite = avg(p.DiskWrite, other.DiskWrite)
+	p.ContainerCPU = avg(p.ContainerCPU, other.ContainerCPU)
+	p.ContainerMem = avg(p.ContainerMem, other.ContainerMem)
+	p.Samples += other.Samples
+}
+
+// historyTiers are the resolutions kept per host: 1s for 10 minutes, 10s for
+// 6 hours and 1m for 7 days
+var historyTiers = []struct {
+	step time.Duration
+	size int
+}{
+	{time.Second, 600},
+	{10 * time.Second, 2160},
+	{time.Minute, 10080},
+}
+
+// historyRing is a fixed size ring of points at one resolution
+type historyRing struct {
+	step    time.Duration
+	points  []HistoryPoint
+	next    int
+	full    bool
+	pending *HistoryPoint
+}
+
+func (r *historyRing) add(p HistoryPoint) {
+	bucket := p.Timestamp.Truncate(r.step)
+	if r.pending != nil && r.pending.Timestamp.Equal(bucket) {
+		r.pending.merge(p)
+		return
+	}
+
+	if r.pending != nil {
+		r.points[r.next] = *r.pending
+		r.next = (r.next + 1) % len(r.points)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+	p.Timestamp = bucket
+	r.pending = &p
+}
+
+// snapshot returns the points in time order including the bucket being filled
+func (r *historyRing) snapshot() []HistoryPoint {
+	var points []HistoryPoint
+	if r.full {
+		points = append(points, r.points[r.next:]...)
+	}
+	points = append(points, r.points[:r.next]...)
+	if r.pending != nil {
+		points = append(points, *r.pending)
+	}
+	return points
+}
+
+// oldest returns the timestamp of the first retained point
+func (r *historyRing) oldest() time.Time {
+	if r.full {
+		return r.points[r.next].Timestamp
+	}
+	if r.next > 0 {
+		return r.points[0].Timestamp
+	}
+	if r.pending != nil {
+		return r.pending.Timestamp
+	}
+	return time.Time{}
+}
+
+type hostHistory struct {
+	rings []*historyRing
+}
+
+// MetricsHistory keeps multi-resolution in-memory history per host
+type MetricsHistory struct {
+	mutex sync.RWMutex
+	hosts map[string]*hostHistory
+}
+
+func newMetricsHistory() *MetricsHistory {
+	return &MetricsHistory{hosts: make(map[string]*hostHistory)}
+}
+
+func (h *MetricsHistory) Add(m SystemMetrics, at time.Time) {
+	p := pointFromMetrics(m, at)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hh, ok := h.hosts[m.HostID]
+	if !ok {
+		hh = &hostHistory{}
+		for _, tier := range historyTiers {
+			hh.rings = append(hh.rings, &historyRing{step: tier.step, points: make([]HistoryPoint, tier.size)})
+		}
+		h.hosts[m.HostID] = hh
+	}
+	for _, ring := range hh.rings {
+		ring.add(p)
+	}
+}
+
+// Hosts returns the ids of all hosts with history
+func (h *MetricsHistory) Hosts() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	hosts := make([]string, 0, len(h.hosts))
+	for host := range h.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Query returns points of host between from and to, averaged to step. Step
+// is raised to the resolution of the ring the points are taken from.
+func (h *MetricsHistory) Query(host string, from, to time.Time, step time.Duration) ([]HistoryPoint, time.Duration) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	hh, ok := h.hosts[host]
+	if !ok {
+		return []HistoryPoint{}, step
+	}
+
+	// prefer the coarsest covering ring that is still at least as fine as
+	// step, then the finest covering ring, then the longest one
+	var ring *historyRing
+	for _, r := range hh.rings {
+		if r.full && r.oldest().After(from) {
+			continue
+		}
+		if ring == nil || r.step <= step {
+			ring = r
+		}
+	}
+	if ring == nil {
+		ring = hh.rings[len(hh.rings)-1]
+	}
+	if step < ring.step {
+		step = ring.step
+	}
+
+	points := []HistoryPoint{}
+	var current *HistoryPoint
+	for _, p := range ring.snapshot() {
+		if p.Timestamp.Before(from) || p.Timestamp.After(to) {
+			continue
+		}
+		bucket := p.Timestamp.Truncate(step)
+		if current != nil && current.Timestamp.Equal(bucket) {
+			current.merge(p)
+			continue
+		}
+		if current != nil {
+			points = append(points, *current)
+		}
+		p.Timestamp = bucket
+		current = &p
+	}
+	if current != nil {
+		points = append(points, *current)
+	}
+
+	return points, step
+}
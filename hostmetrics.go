@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// hostRegistry holds the host-level metrics, served on /metrics together with
+// the server internals and on /metrics/host alone for node-exporter style scraping
+var hostRegistry = &promRegistry{}
+
+// hostLabels are attached to every host metric
+var hostLabels = []string{"host", "os", "arch", "kernel"}
+
+func hostLabelValues(m SystemMetrics) []string {
+	host := m.HostID
+	if host == "" {
+		host = m.Hostname
+	}
+	return []string{host, m.OS, m.Arch, m.Kernel}
+}
+
+// hostSeries returns extra label values and a value for each series of one host
+type hostSeries func(m SystemMetrics) []promSample
+
+// registerHostMetrics exposes the samples returned by source in Prometheus format
+func registerHostMetrics(source func() []SystemMetrics) {
+	series := func(register func(string, string, []string, func() []promSample), name, help string, extra []string, fn hostSeries) {
+		labels := append(append([]string(nil), hostLabels...), extra...)
+		register(name, help, labels, func() []promSample {
+			var samples []promSample
+			for _, m := range source() {
+				for _, s := range fn(m) {
+					s.Labels = append(hostLabelValues(m), s.Labels...)
+					samples = append(samples, s)
+				}
+			}
+			return samples
+		})
+	}
+	gauge := func(name, help string, value func(SystemMetrics) float64) {
+		series(hostRegistry.gaugeFunc, name, help, nil, func(m SystemMetrics) []promSample {
+			return []promSample{{Value: value(m)}}
+		})
+	}
+
+	series(hostRegistry.gaugeFunc, "host_info", "Static host information, always 1.",
+		[]string{"platform", "cpu_model"}, func(m SystemMetrics) []promSample {
+			return []promSample{{Labels: []string{m.Platform, m.CPUModel}, Value: 1}}
+		})
+
+	gauge("host_cpu_usage_percent", "CPU usage across all cores in percent.",
+		func(m SystemMetrics) float64 { return m.CPU })
+	gauge("host_cpu_cores", "Number of logical CPU cores.",
+		func(m SystemMetrics) float64 { return float64(m.Cores) })
+	series(hostRegistry.gaugeFunc, "host_cpu_core_usage_percent", "CPU usage per logical core in percent.",
+		[]string{"core"}, func(m SystemMetrics) []promSample {
+			samples := make([]promSample, 0, len(m.CPUPerCore))
+			for i, v := range m.CPUPerCore {
+				samples = append(samples, promSample{Labels: []string{strconv.Itoa(i)}, Value: v})
+			}
+			return samples
+		})
+
+	gauge("host_memory_usage_percent", "Used memory in percent.",
+		func(m SystemMetrics) float64 { return m.Memory })
+	gauge("host_memory_total_bytes", "Total physical memory in bytes.",
+		func(m SystemMetrics) float64 { return float64(m.TotalMemBytes) })
+	gauge("host_memory_used_bytes", "Used physical memory in bytes.",
+		func(m SystemMetrics) float64 { return float64(m.UsedMemBytes) })
+	gauge("host_memory_available_bytes", "Memory available for new allocations in bytes.",
+		func(m SystemMetrics) float64 { return float64(m.AvailableMemBytes) })
+	gauge("host_uptime_seconds", "Host uptime in seconds.",
+		func(m SystemMetrics) float64 { return float64(m.Uptime) })
+
+	load := func(name, help string, value func(*LoadAverage) float64) {
+		series(hostRegistry.gaugeFunc, name, help, nil, func(m SystemMetrics) []promSample {
+			if m.Load == nil {
+				return nil
+			}
+			return []promSample{{Value: value(m.Load)}}
+		})
+	}
+	load("host_load1", "1 minute load average.", func(l *LoadAverage) float64 { return l.Load1 })
+	load("host_load5", "5 minute load average.", func(l *LoadAverage) float64 { return l.Load5 })
+	load("host_load15", "15 minute load average.", func(l *LoadAverage) float64 { return l.Load15 })
+
+	swap := func(name, help string, value func(*SwapMetrics) float64) {
+		series(hostRegistry.gaugeFunc, name, help, nil, func(m SystemMetrics) []promSample {
+			if m.Swap == nil {
+				return nil
+			}
+			return []promSample{{Value: value(m.Swap)}}
+		})
+	}
+	swap("host_swap_total_bytes", "Total swap space in bytes.", func(s *SwapMetrics) float64 { return float64(s.TotalBytes) })
+	swap("host_swap_used_bytes", "Used swap space in bytes.", func(s *SwapMetrics) float64 { return float64(s.UsedBytes) })
+
+	diskLabels := []string{"mount", "device", "fstype"}
+	disk := func(register func(string, string, []string, func() []promSample), name, help string, value func(DiskMetrics) float64) {
+		series(register, name, help, diskLabels, func(m SystemMetrics) []promSample {
+			samples := make([]promSample, 0, len(m.Disks))
+			for _, d := range m.Disks {
+				samples = append(samples, promSample{Labels: []string{d.Mount, d.Device, d.FSType}, Value: value(d)})
+			}
+			return samples
+		})
+	}
+	disk(hostRegistry.gaugeFunc, "host_disk_total_bytes", "Filesystem size in bytes.",
+		func(d DiskMetrics) float64 { return float64(d.TotalBytes) })
+	disk(hostRegistry.gaugeFunc, "host_disk_used_bytes", "Used filesystem space in bytes.",
+		func(d DiskMetrics) float64 { return float64(d.UsedBytes) })
+	disk(hostRegistry.gaugeFunc, "host_disk_free_bytes", "Free filesystem space in bytes.",
+		func(d DiskMetrics) float64 { return float64(d.FreeBytes) })
+	disk(hostRegistry.counterFunc, "host_disk_read_bytes_total", "Bytes read from the device.",
+		func(d DiskMetrics) float64 { return float64(d.ReadBytesTotal) })
+	disk(hostRegistry.counterFunc, "host_disk_written_bytes_total", "Bytes written to the device.",
+		func(d DiskMetrics) float64 { return float64(d.WriteBytesTotal) })
+
+	network := func(name, help string, value func(NetworkMetrics) float64) {
+		series(hostRegistry.counterFunc, name, help, []string{"interface"}, func(m SystemMetrics) []promSample {
+			samples := make([]promSample, 0, len(m.Network))
+			for _, n := range m.Network {
+				samples = append(samples, promSample{Labels: []string{n.Interface}, Value: value(n)})
+			}
+			return samples
+		})
+	}
+	network("host_network_receive_bytes_total", "Bytes received on the interface.",
+		func(n NetworkMetrics) float64 { return float64(n.RxBytesTotal) })
+	network("host_network_transmit_bytes_total", "Bytes sent on the interface.",
+		func(n NetworkMetrics) float64 { return float64(n.TxBytesTotal) })
+	network("host_network_receive_errors_total", "Receive errors on the interface.",
+		func(n NetworkMetrics) float64 { return float64(n.RxErrorsTotal) })
+	network("host_network_transmit_errors_total", "Transmit errors on the interface.",
+		func(n NetworkMetrics) float64 { return float64(n.TxErrorsTotal) })
+
+	process := func(name, help string, value func(ProcessMetrics) float64) {
+		series(hostRegistry.gaugeFunc, name, help, []string{"pid", "name"}, func(m SystemMetrics) []promSample {
+			samples := make([]promSample, 0, len(m.Processes))
+			for _, p := range m.Processes {
+				pid := strconv.Itoa(int(p.PID))
+				samples = append(samples, promSample{Labels: []string{pid, p.Name}, Value: value(p)})
+			}
+			return samples
+		})
+	}
+	process("host_top_process_cpu_usage_percent", "CPU usage of the top processes in percent.",
+		func(p ProcessMetrics) float64 { return p.CPU })
+	process("host_top_process_resident_memory_bytes", "Resident memory of the top processes in bytes.",
+		func(p ProcessMetrics) float64 { return float64(p.MemoryBytes) })
+
+	container := func(register func(string, string, []string, func() []promSample), name, help string, value func(*ContainerMetrics) float64) {
+		series(register, name, help, nil, func(m SystemMetrics) []promSample {
+			if m.Container == nil {
+				return nil
+			}
+			return []promSample{{Value: value(m.Container)}}
+		})
+	}
+	container(hostRegistry.gaugeFunc, "container_cpu_quota_cores", "CPU limit of the container in cores, 0 when unlimited.",
+		func(c *ContainerMetrics) float64 { return c.CPUQuotaCores })
+	container(hostRegistry.gaugeFunc, "container_cpu_usage_percent", "Container CPU usage relative to its quota in percent.",
+		func(c *ContainerMetrics) float64 { return c.CPUUsagePercent })
+	container(hostRegistry.counterFunc, "container_cpu_usage_seconds_total", "CPU time consumed by the container.",
+		func(c *ContainerMetrics) float64 { return c.CPUUsageSecondsTotal })
+	container(hostRegistry.counterFunc, "container_cpu_periods_total", "Elapsed CFS enforcement periods.",
+		func(c *ContainerMetrics) float64 { return float64(c.PeriodsTotal) })
+	container(hostRegistry.counterFunc, "container_cpu_throttled_periods_total", "CFS periods in which the container was throttled.",
+		func(c *ContainerMetrics) float64 { return float64(c.ThrottledPeriodsTotal) })
+	container(hostRegistry.counterFunc, "container_cpu_throttled_seconds_total", "Time the container was throttled.",
+		func(c *ContainerMetrics) float64 { return c.ThrottledSecondsTotal })
+	container(hostRegistry.gaugeFunc, "container_memory_usage_bytes", "Memory used by the container including page cache.",
+		func(c *ContainerMetrics) float64 { return float64(c.MemoryUsageBytes) })
+	container(hostRegistry.gaugeFunc, "container_memory_working_set_bytes", "Memory used by the container without inactive page cache.",
+		func(c *ContainerMetrics) float64 { return float64(c.MemoryWorkingSetBytes) })
+	container(hostRegistry.gaugeFunc, "container_memory_limit_bytes", "Memory limit of the container, 0 when unlimited.",
+		func(c *ContainerMetrics) float64 { return float64(c.MemoryLimitBytes) })
+	container(hostRegistry.counterFunc, "container_memory_limit_hits_total", "Times the container memory usage reached its limit.",
+		func(c *ContainerMetrics) float64 { return float64(c.MemoryLimitHitsTotal) })
+	container(hostRegistry.counterFunc, "container_oom_events_total", "OOM events in the container.",
+		func(c *ContainerMetrics) float64 { return float64(c.OOMEventsTotal) })
+	container(hostRegistry.counterFunc, "container_oom_kills_total", "Processes killed by the OOM killer in the container.",
+		func(c *ContainerMetrics) float64 { return float64(c.OOMKillsTotal) })
+}
+
+// hostSamples returns a fresh sample of the machine the server runs on
+// followed by the latest samples of all online agents
+func hostSamples(hub *Hub) func() []SystemMetrics {
+	return func() []SystemMetrics {
+		samples := hub.hosts.LatestRemote()
+
+		metrics, err := localCollector.Sample()
+		if err != nil {
+			collectorLog.Warn("Failed to collect host metrics", "error", err)
+			return samples
+		}
+		return append([]SystemMetrics{metrics}, samples...)
+	}
+}
+
+func hostMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	hostRegistry.Write(w)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	HostSourceLocal = "local"
+	HostSourceAgent = "agent"
+)
+
+// hostOfflineAfter is how long an agent may stay silent before its host is reported offline
+const hostOfflineAfter = 30 * time.Second
+
+// localHostID identifies the machine the server runs on, hosts.host_id overrides the hostname
+var localHostID = func() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "local"
+}()
+
+// HostInfo is an entry of the host inventory
+type HostInfo struct {
+	HostID     string `json:"host_id"`
+	Hostname   string `json:"hostname,omitempty"`
+	Source     string `json:"source"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	OS         string `json:"os,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	Kernel     string `json:"kernel,omitempty"`
+	Arch       string `json:"arch,omitempty"`
+	CPUModel   string `json:"cpu_model,omitempty"`
+	Cores      int    `json:"cores,omitempty"`
+	FirstSeen  string `json:"first_seen"`
+	LastSeen   string `json:"last_seen"`
+	Online     bool   `json:"online"`
+	Samples    uint64 `json:"samples"`
+}
+
+type hostEntry struct {
+	info     HostInfo
+	lastSeen time.Time
+	latest   SystemMetrics
+}
+
+// HostInventory keeps every host that reported metrics, the local one included
+type HostInventory struct {
+	mutex sync.RWMutex
+	hosts map[string]*hostEntry
+}
+
+func newHostInventory() *HostInventory {
+	return &HostInventory{hosts: make(map[string]*hostEntry)}
+}
+
+// Update records a sample for its host
+func (inv *HostInventory) Update(m SystemMetrics, source, remoteAddr string) {
+	now := time.Now()
+
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	entry, ok := inv.hosts[m.HostID]
+	if !ok {
+		entry = &hostEntry{info: HostInfo{
+			HostID:    m.HostID,
+			FirstSeen: now.Format(time.RFC3339),
+		}}
+		inv.hosts[m.HostID] = entry
+	}
+
+	entry.info.Hostname = m.Hostname
+	entry.info.Source = source
+	entry.info.RemoteAddr = remoteAddr
+	entry.info.OS = m.OS
+	entry.info.Platform = m.Platform
+	entry.info.Kernel = m.Kernel
+	entry.info.Arch = m.Arch
+	entry.info.CPUModel = m.CPUModel
+	entry.info.Cores = m.Cores
+	entry.info.LastSeen = now.Format(time.RFC3339)
+	entry.info.Samples++
+	entry.lastSeen = now
+	entry.latest = m
+}
+
+func (inv *HostInventory) view(entry *hostEntry, now time.Time) HostInfo {
+	info := entry.info
+	info.Online = entry.info.Source == HostSourceLocal || now.Sub(entry.lastSeen) < hostOfflineAfter
+	return info
+}
+
+// List returns all known hosts ordered by id
+func (inv *HostInventory) List() []HostInfo {
+	now := time.Now()
+
+	inv.mutex.RLock()
+	list := make([]HostInfo, 0, len(inv.hosts))
+	for _, entry := range inv.hosts {
+		list = append(list, inv.view(entry, now))
+	}
+	inv.mutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].HostID < list[j].HostID })
+	return list
+}
+
+func (inv *HostInventory) Get(hostID string) (HostInfo, SystemMetrics, bool) {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+
+	entry, ok := inv.hosts[hostID]
+	if !ok {
+		return HostInfo{}, SystemMetrics{}, false
+	}
+	return inv.view(entry, time.Now()), entry.latest, true
+}
+
+// Online reports whether the host is known and still reporting
+func (inv *HostInventory) Online(hostID string) bool {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+
+	entry, ok := inv.hosts[hostID]
+	return ok && inv.view(entry, time.Now()).Online
+}
+
+// LastSeen returns when the host last reported a sample
+func (inv *HostInventory) LastSeen(hostID string) (time.Time, bool) {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+
+	entry, ok := inv.hosts[hostID]
+	if !ok {
+		return time.Time{}, false
+	}
+	return entry.lastSeen, true
+}
+
+// LatestRemote returns the last sample of every online agent host
+func (inv *HostInventory) LatestRemote() []SystemMetrics {
+	now := time.Now()
+
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+
+	var samples []SystemMetrics
+	for _, entry := range inv.hosts {
+		if entry.info.Source == HostSourceAgent && now.Sub(entry.lastSeen) < hostOfflineAfter {
+			samples = append(samples, entry.latest)
+		}
+	}
+	return samples
+}
+
+// authorizeAgent checks the bearer token (or token query parameter for
+// WebSocket clients that cannot set headers) and writes the error response
+func authorizeAgent(w http.ResponseWriter, r *http.Request) bool {
+	agentTokens := currentConfig().Hosts.AgentTokens
+	if len(agentTokens) == 0 {
+		writeError(w, http.StatusServiceUnavailable, "agent ingest is disabled, set AGENT_TOKENS")
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	for _, valid := range agentTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return true
+		}
+	}
+
+	writeError(w, http.StatusUnauthorized, "invalid agent token")
+	return false
+}
+
+// agentHostID returns the host id announced by an agent, falling back to the sample
+func agentHostID(r *http.Request, m SystemMetrics) string {
+	if id := r.Header.Get("X-Host-ID"); id != "" {
+		return id
+	}
+	if id := r.URL.Query().Get("host"); id != "" {
+		return id
+	}
+	if m.HostID != "" {
+		return m.HostID
+	}
+	return m.Hostname
+}
+
+// ingestAgentSample tags a sample pushed by an agent and records it like a local one
+func ingestAgentSample(m SystemMetrics, hostID, remoteAddr string, hub *Hub) {
+	m.HostID = hostID
+	if m.Timestamp == "" {
+		m.Timestamp = time.Now().Format(time.RFC3339)
+	}
+	if m.SchemaVersion == 0 {
+		m.SchemaVersion = 1
+	}
+
+	hub.RecordMetrics(m, HostSourceAgent, remoteAddr)
+}
+
+func agentMetricsHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	if !authorizeAgent(w, r) {
+		return
+	}
+
+	var m SystemMetrics
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	hostID := agentHostID(r, m)
+	if hostID == "" {
+		writeError(w, http.StatusBadRequest, "host id is required")
+		return
+	}
+
+	ingestAgentSample(m, hostID, r.RemoteAddr, hub)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":  "received",
+		"host_id": hostID,
+	})
+}
+
+func agentWSHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	if !authorizeAgent(w, r) {
+		return
+	}
+
+	clientIP := r.RemoteAddr
+	logger := wsLog.With("client", clientIP, "endpoint", r.URL.Path)
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+	client := wsConns.track(conn, "agent", r)
+	defer wsConns.release(client)
+	defer conn.Close()
+
+	logger.Info("Agent connected")
+
+	ws := currentConfig().WebSocket
+	conn.SetReadDeadline(time.Now().Add(ws.ReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(ws.ReadTimeout))
+		return nil
+	})
+
+	ticker := time.NewTicker(ws.PingInterval)
+	defer ticker.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logger.Warn("Agent closed unexpectedly", "error", err)
+			} else {
+				logger.Info("Agent disconnected")
+			}
+			return
+		}
+		client.received(len(message))
+		conn.SetReadDeadline(time.Now().Add(ws.ReadTimeout))
+
+		var m SystemMetrics
+		if err := json.Unmarshal(message, &m); err != nil {
+			logger.Warn("Invalid agent sample JSON", "error", err)
+			continue
+		}
+
+		hostID := agentHostID(r, m)
+		if hostID == "" {
+			logger.Warn("Agent sample without host id")
+			continue
+		}
+		client.identify("", hostID)
+
+		ingestAgentSample(m, hostID, clientIP, hub)
+	}
+}
+
+func hostsHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"hosts":     hub.hosts.List(),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+func hostHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	info, latest, ok := hub.hosts.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown host")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"host":    info,
+		"metrics": latest,
+	})
+}
+
+// parseHostFilter turns the host query parameter of /ws/monitor into a
+// subscription: no parameter keeps the local host only, "*" selects all hosts
+func parseHostFilter(param string) []string {
+	if param == "" {
+		return []string{localHostID}
+	}
+	if param == "*" {
+		return nil
+	}
+
+	var hosts []string
+	for _, host := range strings.Split(param, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
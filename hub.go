@@ -1,123 +1,292 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Hub struct {
 	// clients maps connection -> filter ("" == all, "metrics" == metrics only, etc)
-	clients map[*websocket.Conn]string
+	clients map[*wsClient]string
+
+	// hostFilters restricts host-scoped messages per connection, absent == all hosts
+	hostFilters map[*wsClient]map[string]bool
 
 	// broadcast channel for sending messages to clients
 	broadcast chan BroadcastMessage
 
-	// register accepts Subscription objects (Conn + Filter)
+	// register accepts Subscription objects (Client + Filter)
 	register chan Subscription
 
 	// unregister removes clients
-	unregister chan *websocket.Conn
+	unregister chan *wsClient
+
+	// flush asks the loop to deliver the queued broadcasts, see Flush and Stop
+	flush chan flushRequest
 
 	// mutex for thread-safe access
 	mutex sync.RWMutex
 
+	// hosts is the inventory of machines reporting metrics
+	hosts *HostInventory
+
+	// history keeps recent metrics per host for charts and backfills
+	history *MetricsHistory
+
+	// rollups persists per-window metrics aggregates, nil without Elasticsearch
+	rollups *MetricsRollups
+
+	// alerts evaluates the alert rules on every sample
+	alerts *AlertEngine
+
+	// listeners receive every broadcast, they are set up before run and must not block
+	listeners []func(BroadcastMessage)
+
 	// weekly session records keyed by client identifier (e.g., client IP)
 	weeklyRecords map[string][]SessionRecord
+
+	// leaderboard ranks users over the week/month/all-time windows
+	leaderboard *Leaderboard
+
+	// presence tracks who is coding right now
+	presence *Presence
+
+	// quit is closed by StopProducers, the sampling and sweeping loops end on it
+	quit chan struct{}
+	// producing is held shared while metrics and alerts are produced and
+	// exclusively by StopProducers, stopped turns later producers away
+	producing sync.RWMutex
+	stopped   bool
 }
 
-func newHub() *Hub {
-	return &Hub{
-		clients:       make(map[*websocket.Conn]string),
-		broadcast:     make(chan BroadcastMessage, 256),
+func newHub(cfg *Config) *Hub {
+	h := &Hub{
+		clients:       make(map[*wsClient]string),
+		hostFilters:   make(map[*wsClient]map[string]bool),
+		broadcast:     make(chan BroadcastMessage, cfg.Hub.BroadcastBuffer),
 		register:      make(chan Subscription),
-		unregister:    make(chan *websocket.Conn),
+		unregister:    make(chan *wsClient),
+		flush:         make(chan flushRequest),
 		weeklyRecords: make(map[string][]SessionRecord),
+		hosts:         newHostInventory(),
+		history:       newMetricsHistory(),
+		leaderboard:   newLeaderboard(),
+		quit:          make(chan struct{}),
 	}
+	h.presence = newPresence(cfg.Presence.IdleAfter, func(p UserPresence) {
+		h.broadcast <- BroadcastMessage{
+			Type:    "presence",
+			Data:    p,
+			EventID: time.Now().Format("20060102150405"),
+		}
+	}, h.leaderboard.GetPrivacy)
+	return h
 }
 
 func (h *Hub) run() {
-	log.Println("Hub started")
+	hubLog.Info("Hub started")
 
 	for {
 		select {
 		case sub := <-h.register:
 			h.mutex.Lock()
-			h.clients[sub.Conn] = sub.Filter
+			h.subscribe(sub.Client, sub.Filter, sub.Hosts)
 			clientCount := len(h.clients)
 			h.mutex.Unlock()
-			log.Printf("Client registered with filter '%s'. Total clients: %d", sub.Filter, clientCount)
+			sub.Client.startSending()
+			hubLog.Info("Client registered", "client", sub.Client.RemoteAddr, "connection", sub.Client.ID, "filter", sub.Filter, "clients", clientCount)
 
 		case client := <-h.unregister:
 			h.mutex.Lock()
 			if filter, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				client.Close()
+				delete(h.hostFilters, client)
+				client.stop()
 				clientCount := len(h.clients)
-				log.Printf("Client unregistered (filter: %s). Total clients: %d", filter, clientCount)
+				hubLog.Info("Client unregistered", "client", client.RemoteAddr, "connection", client.ID, "filter", filter, "clients", clientCount)
 			}
 			h.mutex.Unlock()
 
 		case message := <-h.broadcast:
 			h.broadcastMessage(message)
+
+		case req := <-h.flush:
+			// only what is queued now, producers may keep adding
+			for n := len(h.broadcast); n > 0; n-- {
+				h.broadcastMessage(<-h.broadcast)
+			}
+			if req.stop {
+				h.mutex.Lock()
+				for client := range h.clients {
+					client.stop()
+				}
+				h.clients = make(map[*wsClient]string)
+				h.hostFilters = make(map[*wsClient]map[string]bool)
+				h.mutex.Unlock()
+				close(req.done)
+				hubLog.Info("Hub stopped")
+				return
+			}
+			close(req.done)
 		}
 	}
 }
 
+type flushRequest struct {
+	stop bool
+	done chan struct{}
+}
+
+// Flush delivers the broadcasts queued so far
+func (h *Hub) Flush(ctx context.Context) error {
+	return h.requestFlush(ctx, false)
+}
+
+// Stop delivers the queued broadcasts, closes the remaining clients and ends
+// the hub loop. Listeners still see every message queued before the call.
+func (h *Hub) Stop(ctx context.Context) error {
+	return h.requestFlush(ctx, true)
+}
+
+func (h *Hub) requestFlush(ctx context.Context, stop bool) error {
+	req := flushRequest{stop: stop, done: make(chan struct{})}
+	select {
+	case h.flush <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-req.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (h *Hub) broadcastMessage(message BroadcastMessage) {
+	// only messages that belong to a trace get a span, metrics samples do not
+	span := trace.SpanFromContext(context.Background())
+	if message.ctx != nil {
+		_, span = tracer.Start(message.ctx, "hub.broadcast", trace.WithAttributes(
+			attribute.String("message.type", message.Type),
+			attribute.String("event.id", message.EventID),
+		))
+		defer span.End()
+	}
+
+	for _, listener := range h.listeners {
+		listener(message)
+	}
+
 	h.mutex.RLock()
-	clientsCopy := make(map[*websocket.Conn]string, len(h.clients))
-	for conn, filter := range h.clients {
-		clientsCopy[conn] = filter
+	clientsCopy := make(map[*wsClient]string, len(h.clients))
+	for client, filter := range h.clients {
+		if message.Host != "" {
+			if hosts, ok := h.hostFilters[client]; ok && !hosts[message.Host] {
+				continue
+			}
+		}
+		clientsCopy[client] = filter
 	}
 	h.mutex.RUnlock()
 
 	jsonData, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Failed to marshal broadcast message: %v", err)
+		hubLog.Error("Failed to marshal broadcast message", "type", message.Type, "event_id", message.EventID, "error", err)
 		return
 	}
 
-	var failedClients []*websocket.Conn
-	successCount := 0
+	hubMessagesBroadcast.Inc(message.Type)
+
+	// clients write from their own queue, one whose queue is still full
+	// is too slow to keep up and gets disconnected
+	var slowClients []*wsClient
+	queuedCount := 0
 
 	for client, filter := range clientsCopy {
-		if filter != "" && !matchesFilter(message.Type, filter) {
+		// announcements reach everybody, whatever the filter
+		if message.Type != "announcement" && filter != "" && !matchesFilter(message.Type, filter) {
 			continue
 		}
 
-		client.SetWriteDeadline(time.Now().Add(2 * time.Second))
-
-		err := client.WriteMessage(websocket.TextMessage, jsonData)
-		if err != nil {
-			log.Printf("Broadcast error to client (filter: %s): %v", filter, err)
-			failedClients = append(failedClients, client)
+		if client.enqueue(outgoing{typ: message.Type, data: jsonData}) {
+			queuedCount++
 		} else {
-			successCount++
+			hubLog.Warn("Client send queue full", "client", client.RemoteAddr, "connection", client.ID, "filter", filter, "type", message.Type, "event_id", message.EventID)
+			slowClients = append(slowClients, client)
+			hubMessagesDropped.Inc(message.Type)
 		}
 	}
 
+	span.SetAttributes(
+		attribute.Int("clients.queued", queuedCount),
+		attribute.Int("clients.failed", len(slowClients)),
+	)
 	if message.Type != "metrics" {
-		log.Printf("Broadcast '%s' to %d clients", message.Type, successCount)
+		hubLog.Debug("Broadcast", "type", message.Type, "event_id", message.EventID, "clients", queuedCount)
 	}
 
-	if len(failedClients) > 0 {
+	if len(slowClients) > 0 {
 		h.mutex.Lock()
-		for _, client := range failedClients {
+		for _, client := range slowClients {
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				client.Close()
+				delete(h.hostFilters, client)
+				client.stop()
 			}
 		}
 		h.mutex.Unlock()
-		log.Printf("Removed %d failed clients", len(failedClients))
+		hubLog.Info("Removed slow clients", "count", len(slowClients))
 	}
 }
 
+// subscribe sets the filters of client, the caller holds the mutex
+func (h *Hub) subscribe(client *wsClient, filter string, hosts []string) {
+	h.clients[client] = filter
+	delete(h.hostFilters, client)
+	if len(hosts) > 0 {
+		set := make(map[string]bool, len(hosts))
+		for _, host := range hosts {
+			set[host] = true
+		}
+		h.hostFilters[client] = set
+	}
+}
+
+// SetSubscription changes the filters of a registered client, false if the
+// client is not subscribed to the hub
+func (h *Hub) SetSubscription(client *wsClient, filter string, hosts []string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+	h.subscribe(client, filter, hosts)
+	hubLog.Info("Client subscription changed", "client", client.RemoteAddr, "connection", client.ID, "filter", filter, "hosts", len(hosts))
+	return true
+}
+
+// Subscription returns the filters of client, ok is false if it is not
+// subscribed to the hub
+func (h *Hub) Subscription(client *wsClient) (filter string, hosts []string, ok bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	filter, ok = h.clients[client]
+	for host := range h.hostFilters[client] {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return filter, hosts, ok
+}
+
 
 func matchesFilter(messageType, filter string) bool {
 	if filter == "" {
@@ -137,7 +306,7 @@ func matchesFilter(messageType, filter string) bool {
 
 func (h *Hub) AddSessionRecord(clientKey string, duration int64) int64 {
 	now := time.Now()
-	sevenDaysAgo := now.Add(-7 * 24 * time.Hour)
+	windowStart := now.Add(-currentConfig().Hub.SessionWindow)
 
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
@@ -152,7 +321,7 @@ func (h *Hub) AddSessionRecord(clientKey string, duration int64) int64 {
 	var pruned []SessionRecord
 	var total int64
 	for _, r := range recs {
-		if r.Timestamp.After(sevenDaysAgo) {
+		if r.Timestamp.After(windowStart) {
 			pruned = append(pruned, r)
 			total += r.Duration
 		}
@@ -165,14 +334,14 @@ func (h *Hub) AddSessionRecord(clientKey string, duration int64) int64 {
 
 func (h *Hub) GetWeeklyTotal(clientKey string) int64 {
 	now := time.Now()
-	sevenDaysAgo := now.Add(-7 * 24 * time.Hour)
+	windowStart := now.Add(-currentConfig().Hub.SessionWindow)
 
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
 	var total int64
 	for _, r := range h.weeklyRecords[clientKey] {
-		if r.Timestamp.After(sevenDaysAgo) {
+		if r.Timestamp.After(windowStart) {
 			total += r.Duration
 		}
 	}
@@ -182,7 +351,7 @@ func (h *Hub) GetWeeklyTotal(clientKey string) int64 {
 
 func (h *Hub) GetAllWeeklyTotals() map[string]int64 {
 	now := time.Now()
-	sevenDaysAgo := now.Add(-7 * 24 * time.Hour)
+	windowStart := now.Add(-currentConfig().Hub.SessionWindow)
 
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
@@ -191,7 +360,7 @@ func (h *Hub) GetAllWeeklyTotals() map[string]int64 {
 	for clientKey, records := range h.weeklyRecords {
 		var total int64
 		for _, r := range records {
-			if r.Timestamp.After(sevenDaysAgo) {
+			if r.Timestamp.After(windowStart) {
 				total += r.Duration
 			}
 		}
@@ -208,8 +377,8 @@ func (h *Hub) GetClientInfo() map[string]string {
 	defer h.mutex.RUnlock()
 
 	info := make(map[string]string)
-	for conn, filter := range h.clients {
-		info[conn.RemoteAddr().String()] = filter
+	for client, filter := range h.clients {
+		info[client.RemoteAddr] = filter
 	}
 
 	return info
@@ -219,4 +388,83 @@ func (h *Hub) GetClientCount() int {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 	return len(h.clients)
-}
\ No newline at end of file
+}
+
+// RecordMetrics adds a host sample to the inventory, history and rollups,
+// broadcasts it to the monitor subscribers of that host and evaluates the alerts
+func (h *Hub) RecordMetrics(m SystemMetrics, source, remoteAddr string) {
+	if !h.startProducing() {
+		return
+	}
+	defer h.producing.RUnlock()
+
+	h.hosts.Update(m, source, remoteAddr)
+	h.history.Add(m, time.Now())
+	if h.rollups != nil {
+		h.rollups.Add(m, time.Now())
+	}
+
+	h.broadcast <- BroadcastMessage{
+		Type:    "metrics",
+		Data:    m,
+		EventID: time.Now().Format("20060102150405"),
+		Host:    m.HostID,
+	}
+
+	if h.alerts != nil {
+		for _, alert := range h.alerts.Evaluate(m, time.Now()) {
+			h.broadcast <- BroadcastMessage{
+				Type:    "alert",
+				Data:    alert,
+				EventID: time.Now().Format("20060102150405"),
+				Host:    alert.HostID,
+			}
+		}
+	}
+}
+
+// startProducing holds the producing lock shared unless the producers are
+// stopped, the caller releases it with producing.RUnlock
+func (h *Hub) startProducing() bool {
+	h.producing.RLock()
+	if h.stopped {
+		h.producing.RUnlock()
+		return false
+	}
+	return true
+}
+
+// StopProducers ends the sampling and sweeping loops, waits for the samples
+// being recorded and drops the ones arriving later. The shutdown calls it
+// before Stop so nothing is broadcast, rolled up or alerted on afterwards.
+func (h *Hub) StopProducers() {
+	h.producing.Lock()
+	defer h.producing.Unlock()
+
+	if !h.stopped {
+		h.stopped = true
+		close(h.quit)
+	}
+}
+
+// TotalsBetween sums the session records of every client within [from, to),
+// limited to the last 7 days the hub keeps
+func (h *Hub) TotalsBetween(from, to time.Time) map[string]int64 {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	totals := make(map[string]int64)
+	for clientKey, records := range h.weeklyRecords {
+		var total int64
+		for _, r := range records {
+			if !r.Timestamp.Before(from) && r.Timestamp.Before(to) {
+				total += r.Duration
+			}
+		}
+		if total > 0 {
+			totals[clientKey] = total
+		}
+	}
+
+	return totals
+}
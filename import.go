@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	importBatchSize = 500
+	// maxTrackedSession bounds how far past an import batch a live session may
+	// end and still be looked up for overlaps
+	maxTrackedSession = 24 * time.Hour
+	// sqliteHeader starts every SQLite database, ActivityWatch's included
+	sqliteHeader = "SQLite format 3\x00"
+	// heartbeatTimeout is the longest gap between two WakaTime heartbeats that
+	// still counts as coding time, the same default WakaTime itself uses
+	heartbeatTimeout = 15 * time.Minute
+)
+
+// ImportStats is the progress of an import, reported after every bulk request
+type ImportStats struct {
+	Records    int  `json:"records"`  // heartbeats or events read from the export
+	Skipped    int  `json:"skipped"`  // records without coding time
+	Sessions   int  `json:"sessions"` // sessions built from the records
+	Imported   int  `json:"imported"`
+	Duplicates int  `json:"duplicates"`
+	Tracked    int  `json:"tracked"` // sessions overlapping live tracked ones, not imported
+	Failed     int  `json:"failed"`
+	Done       bool `json:"done,omitempty"`
+}
+
+// importParsers read one export format and emit sessions in time order.
+// Defaults carries the user and team given by the caller.
+var importParsers = map[string]func(r io.Reader, defaults CodingSession, emit func(CodingSession) error, stats *ImportStats) error{
+	"wakatime":      parseWakaTime,
+	"activitywatch": parseActivityWatch,
+}
+
+// sessionImporter bulk loads parsed sessions into the coding-sessions index.
+// Document ids are derived from the session itself and written with create,
+// so importing the same export twice only reports duplicates. Sessions that
+// overlap what the editor plugins already tracked live are left out, the
+// export and the live tracking usually record the same coding time.
+type sessionImporter struct {
+	es       *ESClient
+	ctx      context.Context
+	source   string
+	batch    []CodingSession
+	stats    ImportStats
+	progress func(ImportStats)
+}
+
+func (im *sessionImporter) add(session CodingSession) error {
+	im.stats.Sessions++
+	im.batch = append(im.batch, session)
+	if len(im.batch) >= importBatchSize {
+		return im.flush()
+	}
+	return nil
+}
+
+func (im *sessionImporter) flush() error {
+	if len(im.batch) == 0 {
+		return nil
+	}
+
+	tracked, err := im.trackedRanges()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	queued := 0
+	for _, session := range im.batch {
+		// imported sessions are stored at the time they happened, not when
+		// they were loaded, so history queries and exports find them
+		at, _ := time.Parse(time.RFC3339, session.Timestamp)
+		if overlaps(tracked[session.User], at, at.Add(time.Duration(session.DurationSeconds)*time.Second)) {
+			im.stats.Tracked++
+			continue
+		}
+		queued++
+		doc := sessionDocument(session, at)
+		doc["source"] = im.source
+
+		enc.Encode(map[string]interface{}{"create": map[string]string{"_id": importID(im.source, session)}})
+		enc.Encode(doc)
+	}
+	if queued == 0 {
+		im.batch = im.batch[:0]
+		if im.progress != nil {
+			im.progress(im.stats)
+		}
+		return nil
+	}
+
+	res, err := im.es.client.Bulk(&body,
+		im.es.client.Bulk.WithContext(im.ctx),
+		im.es.client.Bulk.WithIndex(sessionsIndex),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var result struct {
+		Items []map[string]struct {
+			Status int `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := decodeESResponse(res.Body, res.IsError(), res.Status(), &result); err != nil {
+		return fmt.Errorf("bulk import: %v", err)
+	}
+
+	for _, item := range result.Items {
+		op := item["create"]
+		switch {
+		case op.Error == nil:
+			im.stats.Imported++
+		case op.Status == http.StatusConflict:
+			im.stats.Duplicates++
+		default:
+			im.stats.Failed++
+			importLog.Warn("Failed to import session", "index", sessionsIndex, "error_type", op.Error.Type, "reason", op.Error.Reason)
+		}
+	}
+
+	im.batch = im.batch[:0]
+	if im.progress != nil {
+		im.progress(im.stats)
+	}
+	return nil
+}
+
+// timeRange is the span of a live tracked session
+type timeRange struct {
+	start, end time.Time
+}
+
+// trackedRanges returns the live tracked sessions around the batch per user.
+// Live sessions are indexed when they end and carry no source.
+func (im *sessionImporter) trackedRanges() (map[string][]timeRange, error) {
+	type span struct{ from, to time.Time }
+	spans := make(map[string]span)
+	for _, session := range im.batch {
+		at, _ := time.Parse(time.RFC3339, session.Timestamp)
+		end := at.Add(time.Duration(session.DurationSeconds) * time.Second)
+		sp, ok := spans[session.User]
+		if !ok || at.Before(sp.from) {
+			sp.from = at
+		}
+		if !ok || end.After(sp.to) {
+			sp.to = end
+		}
+		spans[session.User] = sp
+	}
+
+	tracked := make(map[string][]timeRange)
+	for user, sp := range spans {
+		filters := []interface{}{
+			map[string]interface{}{
+				"range": map[string]interface{}{
+					"server_timestamp": map[string]interface{}{
+						"gt":  sp.from.Format(time.RFC3339),
+						"lte": sp.to.Add(maxTrackedSession).Format(time.RFC3339),
+					},
+				},
+			},
+		}
+		mustNot := []interface{}{
+			map[string]interface{}{"exists": map[string]interface{}{"field": "source"}},
+		}
+		if user != "" {
+			filters = append(filters, map[string]interface{}{
+				"term": map[string]interface{}{"user.keyword": user},
+			})
+		} else {
+			mustNot = append(mustNot, map[string]interface{}{"exists": map[string]interface{}{"field": "user"}})
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"size":    10000,
+			"_source": []string{"server_timestamp", "duration_seconds"},
+			"query": map[string]interface{}{"bool": map[string]interface{}{
+				"filter":   filters,
+				"must_not": mustNot,
+			}},
+		})
+
+		res, err := im.es.client.Search(
+			im.es.client.Search.WithContext(im.ctx),
+			im.es.client.Search.WithIndex(sessionsIndex),
+			// the index only exists once a live session was indexed
+			im.es.client.Search.WithIgnoreUnavailable(true),
+			im.es.client.Search.WithBody(bytes.NewReader(body)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Hits struct {
+				Hits []struct {
+					Source struct {
+						ServerTimestamp string `json:"server_timestamp"`
+						DurationSeconds int64  `json:"duration_seconds"`
+					} `json:"_source"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		err = decodeESResponse(res.Body, res.IsError(), res.Status(), &result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("searching tracked sessions: %v", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			end, err := time.Parse(time.RFC3339, hit.Source.ServerTimestamp)
+			if err != nil || hit.Source.DurationSeconds <= 0 {
+				continue
+			}
+			tracked[user] = append(tracked[user], timeRange{
+				start: end.Add(-time.Duration(hit.Source.DurationSeconds) * time.Second),
+				end:   end,
+			})
+		}
+	}
+	return tracked, nil
+}
+
+// overlaps reports whether [start, end) intersects one of the ranges
+func overlaps(ranges []timeRange, start, end time.Time) bool {
+	for _, r := range ranges {
+		if start.Before(r.end) && r.start.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// importID identifies a session by where, when and what was edited
+func importID(source string, s CodingSession) string {
+	file := ""
+	if s.FilePath != nil {
+		file = *s.FilePath
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		source, s.User, s.Timestamp, s.Editor, s.Project, s.Language, file,
+	}, "\x00")))
+	return source + "-" + hex.EncodeToString(sum[:16])
+}
+
+// importSessions parses r in the given format and loads the result
+func importSessions(ctx context.Context, es *ESClient, format string, r io.Reader, defaults CodingSession, progress func(ImportStats)) (ImportStats, error) {
+	parse, ok := importParsers[format]
+	if !ok {
+		return ImportStats{}, fmt.Errorf("format must be one of wakatime, activitywatch")
+	}
+
+	im := &sessionImporter{es: es, ctx: ctx, source: format, progress: progress}
+	err := parse(r, defaults, im.add, &im.stats)
+	if err == nil {
+		err = im.flush()
+	}
+	im.stats.Done = err == nil
+	return im.stats, err
+}
+
+// WakaTime exports (Settings > Export) hold a list of days with their
+// heartbeats, the heartbeats API returns them under data
+type wakatimeHeartbeat struct {
+	Entity      string  `json:"entity"`
+	Type        string  `json:"type"`
+	Category    string  `json:"category"`
+	Time        float64 `json:"time"`
+	Project     string  `json:"project"`
+	Language    string  `json:"language"`
+	Lines       *int    `json:"lines"`
+	UserAgentID string  `json:"user_agent_id"`
+	UserAgent   string  `json:"user_agent"`
+}
+
+func parseWakaTime(r io.Reader, defaults CodingSession, emit func(CodingSession) error, stats *ImportStats) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return fmt.Errorf("wakatime export: %v", err)
+	}
+
+	userAgents := make(map[string]string)
+	sessions := &heartbeatSessions{defaults: defaults, emit: emit, stats: stats}
+
+	heartbeats := func(list []wakatimeHeartbeat) error {
+		sort.Slice(list, func(i, j int) bool { return list[i].Time < list[j].Time })
+		for _, hb := range list {
+			stats.Records++
+			if (hb.Type != "" && hb.Type != "file") || hb.Category == "browsing" || hb.Time == 0 {
+				stats.Skipped++
+				continue
+			}
+			editor := editorFromUserAgent(hb.UserAgent)
+			if editor == "" {
+				editor = userAgents[hb.UserAgentID]
+			}
+			if err := sessions.add(hb, editor); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "user":
+			var user struct {
+				Username string `json:"username"`
+			}
+			if err := dec.Decode(&user); err != nil {
+				return err
+			}
+			if sessions.defaults.User == "" {
+				sessions.defaults.User = user.Username
+			}
+
+		case "user_agents":
+			var agents []struct {
+				ID    string `json:"id"`
+				Value string `json:"value"`
+			}
+			if err := dec.Decode(&agents); err != nil {
+				return err
+			}
+			for _, a := range agents {
+				userAgents[a.ID] = editorFromUserAgent(a.Value)
+			}
+
+		case "days":
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+			for dec.More() {
+				var day struct {
+					Heartbeats []wakatimeHeartbeat `json:"heartbeats"`
+				}
+				if err := dec.Decode(&day); err != nil {
+					return err
+				}
+				if err := heartbeats(day.Heartbeats); err != nil {
+					return err
+				}
+			}
+			if _, err := dec.Token(); err != nil {
+				return err
+			}
+
+		case "data":
+			var list []wakatimeHeartbeat
+			if err := dec.Decode(&list); err != nil {
+				return err
+			}
+			if err := heartbeats(list); err != nil {
+				return err
+			}
+
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	return sessions.close()
+}
+
+// heartbeatSessions joins consecutive heartbeats of the same file into
+// sessions. The gap to the next heartbeat is credited to the earlier one
+// unless it is longer than heartbeatTimeout, as WakaTime does.
+type heartbeatSessions struct {
+	defaults CodingSession
+	emit     func(CodingSession) error
+	stats    *ImportStats
+
+	current *CodingSession
+	key     string
+	last    time.Time
+	elapsed time.Duration
+}
+
+func (h *heartbeatSessions) add(hb wakatimeHeartbeat, editor string) error {
+	at := time.Unix(0, int64(hb.Time*float64(time.Second))).UTC()
+	key := strings.Join([]string{editor, hb.Project, hb.Language, hb.Entity}, "\x00")
+
+	if h.current != nil {
+		gap := at.Sub(h.last)
+		if gap <= heartbeatTimeout {
+			h.elapsed += gap
+		}
+		if key == h.key && gap <= heartbeatTimeout {
+			h.last = at
+			if hb.Lines != nil {
+				h.current.LinesOfCode = hb.Lines
+			}
+			return nil
+		}
+		if err := h.close(); err != nil {
+			return err
+		}
+	}
+
+	if editor == "" {
+		editor = "wakatime"
+	}
+	session := h.defaults
+	session.Editor = editor
+	session.Project = orUnknown(hb.Project)
+	session.Language = orUnknown(hb.Language)
+	session.Timestamp = at.Format(time.RFC3339)
+	session.LinesOfCode = hb.Lines
+	if hb.Entity != "" {
+		entity := hb.Entity
+		session.FilePath = &entity
+	}
+
+	h.current, h.key, h.last, h.elapsed = &session, key, at, 0
+	return nil
+}
+
+func (h *heartbeatSessions) close() error {
+	if h.current == nil {
+		return nil
+	}
+	session := *h.current
+	h.current = nil
+
+	session.DurationSeconds = int64(math.Round(h.elapsed.Seconds()))
+	if session.DurationSeconds <= 0 {
+		// a lone heartbeat carries no time
+		h.stats.Skipped++
+		return nil
+	}
+	return h.emit(session)
+}
+
+// editorFromUserAgent picks the editor out of a WakaTime user agent such as
+// "wakatime/v1.73.0 (linux-6.1) go1.20 vscode/1.80.0 vscode-wakatime/24.2.0"
+func editorFromUserAgent(ua string) string {
+	fields := strings.Fields(ua)
+	for i := len(fields) - 1; i >= 0; i-- {
+		name, _, _ := strings.Cut(fields[i], "/")
+		if plugin, ok := strings.CutSuffix(name, "-wakatime"); ok {
+			return plugin
+		}
+	}
+	return ""
+}
+
+// activityWatchData is the data of an editor watcher event
+type activityWatchData struct {
+	File     string `json:"file"`
+	Project  string `json:"project"`
+	Language string `json:"language"`
+}
+
+// parseActivityWatch reads the JSON written by ActivityWatch's "Export all
+// buckets" (or GET /api/0/export) or the aw-server-rust SQLite database
+// (sqlite.db in the ActivityWatch data directory). Only editor buckets are
+// imported.
+func parseActivityWatch(r io.Reader, defaults CodingSession, emit func(CodingSession) error, stats *ImportStats) error {
+	in := bufio.NewReader(r)
+	if header, _ := in.Peek(len(sqliteHeader)); string(header) == sqliteHeader {
+		return parseActivityWatchDB(in, defaults, emit, stats)
+	}
+
+	dec := json.NewDecoder(in)
+	if err := expectDelim(dec, '{'); err != nil {
+		return fmt.Errorf("activitywatch export: %v", err)
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key != "buckets" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := expectDelim(dec, '{'); err != nil {
+			return err
+		}
+		for dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return err
+			}
+			var bucket struct {
+				ID       string `json:"id"`
+				Type     string `json:"type"`
+				Client   string `json:"client"`
+				Hostname string `json:"hostname"`
+				Events   []struct {
+					Timestamp time.Time         `json:"timestamp"`
+					Duration  float64           `json:"duration"`
+					Data      activityWatchData `json:"data"`
+				} `json:"events"`
+			}
+			if err := dec.Decode(&bucket); err != nil {
+				return err
+			}
+			stats.Records += len(bucket.Events)
+			if bucket.Type != "app.editor.activity" {
+				stats.Skipped += len(bucket.Events)
+				continue
+			}
+
+			editor := activityWatchEditor(bucket.ID, bucket.Client)
+			events := bucket.Events
+			sort.Slice(events, func(i, j int) bool { return events[i].Timestamp.Before(events[j].Timestamp) })
+			for _, event := range events {
+				if err := emitActivityWatch(defaults, editor, event.Timestamp, event.Duration, event.Data, emit, stats); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseActivityWatchDB reads the buckets and events tables of an
+// aw-server-rust database. The database is copied to a temporary file
+// first, SQLite needs one to open.
+func parseActivityWatchDB(r io.Reader, defaults CodingSession, emit func(CodingSession) error, stats *ImportStats) error {
+	tmp, err := os.CreateTemp("", "activitywatch-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("activitywatch database: %v", err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+tmp.Name()+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("activitywatch database: %v", err)
+	}
+	defer db.Close()
+
+	// events store their start and end in nanoseconds since the epoch
+	rows, err := db.Query(`SELECT b.name, b.type, b.client, e.starttime, e.endtime, e.data
+		FROM events e JOIN buckets b ON b.id = e.bucketrow
+		ORDER BY b.id, e.starttime`)
+	if err != nil {
+		return fmt.Errorf("activitywatch database (only the aw-server-rust schema is supported): %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, bucketType, client, data string
+		var start, end int64
+		if err := rows.Scan(&name, &bucketType, &client, &start, &end, &data); err != nil {
+			return fmt.Errorf("activitywatch database: %v", err)
+		}
+		stats.Records++
+		if bucketType != "app.editor.activity" {
+			stats.Skipped++
+			continue
+		}
+
+		var event activityWatchData
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			stats.Skipped++
+			continue
+		}
+		duration := time.Duration(end - start).Seconds()
+		if err := emitActivityWatch(defaults, activityWatchEditor(name, client), time.Unix(0, start), duration, event, emit, stats); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// activityWatchEditor names the editor of a bucket, watcher clients are
+// named aw-watcher-<editor>
+func activityWatchEditor(bucket, client string) string {
+	if editor := strings.TrimPrefix(client, "aw-watcher-"); editor != "" {
+		return editor
+	}
+	return bucket
+}
+
+// emitActivityWatch turns an editor event into a session
+func emitActivityWatch(defaults CodingSession, editor string, at time.Time, seconds float64, data activityWatchData, emit func(CodingSession) error, stats *ImportStats) error {
+	duration := int64(math.Round(seconds))
+	if duration <= 0 {
+		stats.Skipped++
+		return nil
+	}
+	session := defaults
+	session.Editor = editor
+	session.Project = orUnknown(projectName(data.Project))
+	session.Language = orUnknown(data.Language)
+	session.Timestamp = at.UTC().Format(time.RFC3339)
+	session.DurationSeconds = duration
+	if data.File != "" {
+		file := data.File
+		session.FilePath = &file
+	}
+	return emit(session)
+}
+
+// projectName turns the project directory ActivityWatch records into a name
+func projectName(dir string) string {
+	dir = strings.TrimRight(strings.ReplaceAll(dir, "\\", "/"), "/")
+	return dir[strings.LastIndex(dir, "/")+1:]
+}
+
+func orUnknown(v string) string {
+	if v == "" {
+		return "Unknown"
+	}
+	return v
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %q, found %v", want, tok)
+	}
+	return nil
+}
+
+// importHandler loads an export posted as the request body and streams the
+// progress as NDJSON, one ImportStats line per bulk request
+func importHandler(w http.ResponseWriter, r *http.Request, esClient *ESClient) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if esClient == nil {
+		writeError(w, http.StatusServiceUnavailable, "Elasticsearch is not connected")
+		return
+	}
+
+	params := r.URL.Query()
+	format := params.Get("format")
+	if _, ok := importParsers[format]; !ok {
+		writeError(w, http.StatusBadRequest, "format must be one of wakatime, activitywatch")
+		return
+	}
+	defaults := CodingSession{User: params.Get("user"), Team: params.Get("team")}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	stats, err := importSessions(r.Context(), esClient, format, r.Body, defaults, func(stats ImportStats) {
+		enc.Encode(stats)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		importLog.Error("Import failed", "format", format, "error", err)
+		enc.Encode(map[string]interface{}{"status": "error", "error": err.Error(), "stats": stats})
+		return
+	}
+	enc.Encode(stats)
+	importLog.Info("Import finished", "format", format,
+		"imported", stats.Imported, "duplicates", stats.Duplicates, "tracked", stats.Tracked, "failed", stats.Failed)
+}
+
+// runImport implements `server import`: load export files into Elasticsearch
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "wakatime", "wakatime (JSON export) or activitywatch (JSON bucket export or sqlite.db)")
+	defaults := CodingSession{}
+	fs.StringVar(&defaults.User, "user", "", "user the sessions belong to (default: the user in the export, if any)")
+	fs.StringVar(&defaults.Team, "team", "", "team the sessions belong to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: server import [flags] file... (- for stdin)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, ok := importParsers[*format]; !ok {
+		fatal(importLog, "Unknown import format", "format", *format)
+	}
+
+	cfg := mustLoadConfig("import")
+	esClient, err := NewESClient(cfg.Elasticsearch.URL)
+	if err != nil || esClient == nil {
+		fatal(importLog, "Failed to connect to Elasticsearch", "error", err)
+	}
+
+	for _, name := range fs.Args() {
+		in := os.Stdin
+		if name != "-" {
+			in, err = os.Open(name)
+			if err != nil {
+				fatal(importLog, "Failed to open import file", "file", name, "error", err)
+			}
+		}
+
+		stats, err := importSessions(context.Background(), esClient, *format, in, defaults, func(stats ImportStats) {
+			fmt.Fprintf(os.Stderr, "\r%s: %d sessions, %d imported, %d duplicates, %d already tracked, %d failed",
+				name, stats.Sessions, stats.Imported, stats.Duplicates, stats.Tracked, stats.Failed)
+		})
+		fmt.Fprintln(os.Stderr)
+		in.Close()
+		if err != nil {
+			fatal(importLog, "Import failed", "file", name, "error", err)
+		}
+		importLog.Info("Import finished", "file", name, "records", stats.Records, "skipped", stats.Skipped,
+			"sessions", stats.Sessions, "imported", stats.Imported, "duplicates", stats.Duplicates, "tracked", stats.Tracked, "failed", stats.Failed)
+	}
+}
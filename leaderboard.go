@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WindowWeek  = "week"
+	WindowMonth = "month"
+	WindowAll   = "all"
+)
+
+// leaderboardWindows are the windows broadcast in `leaderboard` hub messages
+var leaderboardWindows = []string{WindowWeek, WindowMonth, WindowAll}
+
+// broadcastBoardSize is how many entries per window are sent to hub clients
+const broadcastBoardSize = 10
+
+// UserPrivacy holds the per-user opt-out flags
+type UserPrivacy struct {
+	// HideFromLeaderboard removes the user from every leaderboard
+	HideFromLeaderboard bool `json:"hide_from_leaderboard"`
+	// HideDetails keeps the user on global boards but out of language/project boards
+	HideDetails bool `json:"hide_details"`
+	// HideBadges makes the user's badges show "private"
+	HideBadges bool `json:"hide_badges"`
+}
+
+type LeaderboardQuery struct {
+	Window   string
+	Team     string
+	Language string
+	Project  string
+	Limit    int
+}
+
+type LeaderboardEntry struct {
+	Rank         int    `json:"rank"`
+	User         string `json:"user"`
+	Team         string `json:"team,omitempty"`
+	TotalSeconds int64  `json:"total_seconds"`
+}
+
+// LeaderboardUpdate is the payload of `leaderboard` hub messages
+type LeaderboardUpdate struct {
+	Boards    map[string][]LeaderboardEntry `json:"boards"`
+	Timestamp string                        `json:"timestamp"`
+}
+
+type leaderboardRecord struct {
+	At       time.Time
+	Seconds  int64
+	Language string
+	Project  string
+}
+
+type dimension struct {
+	Language string
+	Project  string
+}
+
+// Leaderboard ranks users by tracked coding time
+type Leaderboard struct {
+	mutex sync.RWMutex
+
+	// recent records per user, kept for the current month and the last 7 days
+	records map[string][]leaderboardRecord
+
+	// all-time totals per user split by language/project
+	allTime map[string]map[dimension]int64
+
+	// last team seen for each user
+	teams map[string]string
+
+	// days with activity per user, for streaks
+	days map[string]map[string]bool
+
+	privacy map[string]UserPrivacy
+	// privacyPath is where the privacy flags are kept, empty until LoadPrivacy
+	privacyPath string
+	// users hidden by leaderboard.opt_out, kept apart from their own flags
+	optOut map[string]bool
+
+	// boards sent in the last `leaderboard` broadcast
+	lastBroadcast map[string][]LeaderboardEntry
+}
+
+func newLeaderboard() *Leaderboard {
+	return &Leaderboard{
+		records:       make(map[string][]leaderboardRecord),
+		allTime:       make(map[string]map[dimension]int64),
+		teams:         make(map[string]string),
+		days:          make(map[string]map[string]bool),
+		privacy:       make(map[string]UserPrivacy),
+		optOut:        make(map[string]bool),
+		lastBroadcast: make(map[string][]LeaderboardEntry),
+	}
+}
+
+func validWindow(window string) bool {
+	switch window {
+	case WindowWeek, WindowMonth, WindowAll:
+		return true
+	}
+	return false
+}
+
+// windowStart returns the earliest timestamp included in window, zero for all time
+func windowStart(window string, now time.Time) time.Time {
+	switch window {
+	case WindowWeek:
+		return now.Add(-7 * 24 * time.Hour)
+	case WindowMonth:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Time{}
+}
+
+// Record adds a session for user and reports whether the broadcast boards changed
+func (lb *Leaderboard) Record(user, team string, session CodingSession, at time.Time) (LeaderboardUpdate, bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if team != "" {
+		lb.teams[user] = team
+	}
+
+	cutoff := windowStart(WindowMonth, at)
+	if weekStart := windowStart(WindowWeek, at); weekStart.Before(cutoff) {
+		cutoff = weekStart
+	}
+
+	recs := append(lb.records[user], leaderboardRecord{
+		At:       at,
+		Seconds:  session.DurationSeconds,
+		Language: session.Language,
+		Project:  session.Project,
+	})
+	var pruned []leaderboardRecord
+	for _, r := range recs {
+		if !r.At.Before(cutoff) {
+			pruned = append(pruned, r)
+		}
+	}
+	lb.records[user] = pruned
+
+	dims := lb.allTime[user]
+	if dims == nil {
+		dims = make(map[dimension]int64)
+		lb.allTime[user] = dims
+	}
+	dims[dimension{Language: session.Language, Project: session.Project}] += session.DurationSeconds
+
+	if lb.days[user] == nil {
+		lb.days[user] = make(map[string]bool)
+	}
+	lb.days[user][at.Format("2006-01-02")] = true
+
+	return lb.refreshBroadcast(at)
+}
+
+// sessionBucket is the coding time of one user on one language and project
+// within an hour or a day
+type sessionBucket struct {
+	User     string
+	Team     string
+	Language string
+	Project  string
+	Start    time.Time
+	Seconds  int64
+}
+
+// SessionBuckets sums duration_seconds of the sessions received within
+// [from, to) per user, team, language, project and day, or hour when hourly
+// is set. Days are calendar days in the local time zone. Sessions without a
+// user are left out.
+func (es *ESClient) SessionBuckets(ctx context.Context, from, to time.Time, hourly bool) ([]sessionBucket, error) {
+	histogram := map[string]interface{}{
+		"field":  "server_timestamp",
+		"format": "yyyy-MM-dd'T'HH:mm:ssXXX",
+	}
+	if hourly {
+		histogram["fixed_interval"] = "1h"
+	} else {
+		histogram["calendar_interval"] = "1d"
+		histogram["time_zone"] = to.Format("-07:00")
+	}
+	query := map[string]interface{}{
+		"range": map[string]interface{}{
+			"server_timestamp": map[string]interface{}{
+				"gte": from.Format(time.RFC3339),
+				"lt":  to.Format(time.RFC3339),
+			},
+		},
+	}
+
+	var buckets []sessionBucket
+	var after map[string]interface{}
+	for {
+		composite := map[string]interface{}{
+			"size": 1000,
+			"sources": []interface{}{
+				map[string]interface{}{"user": map[string]interface{}{
+					"terms": map[string]interface{}{"field": "user.keyword"},
+				}},
+				map[string]interface{}{"team": map[string]interface{}{
+					"terms": map[string]interface{}{"field": "team.keyword", "missing_bucket": true},
+				}},
+				map[string]interface{}{"language": map[string]interface{}{
+					"terms": map[string]interface{}{"field": "language.keyword", "missing_bucket": true},
+				}},
+				map[string]interface{}{"project": map[string]interface{}{
+					"terms": map[string]interface{}{"field": "project.keyword", "missing_bucket": true},
+				}},
+				map[string]interface{}{"start": map[string]interface{}{
+					"date_histogram": histogram,
+				}},
+			},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"size":  0,
+			"query": query,
+			"aggs": map[string]interface{}{
+				"buckets": map[string]interface{}{
+					"composite": composite,
+					"aggs": map[string]interface{}{
+						"seconds": map[string]interface{}{"sum": map[string]interface{}{"field": "duration_seconds"}},
+					},
+				},
+			},
+		})
+
+		res, err := es.client.Search(
+			es.client.Search.WithContext(ctx),
+			es.client.Search.WithIndex(sessionsIndex),
+			es.client.Search.WithIgnoreUnavailable(true),
+			es.client.Search.WithBody(bytes.NewReader(body)),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Aggregations struct {
+				Buckets struct {
+					AfterKey map[string]interface{} `json:"after_key"`
+					Buckets  []struct {
+						Key struct {
+							User     string  `json:"user"`
+							Team     *string `json:"team"`
+							Language *string `json:"language"`
+							Project  *string `json:"project"`
+							Start    string  `json:"start"`
+						} `json:"key"`
+						Seconds struct {
+							Value float64 `json:"value"`
+						} `json:"seconds"`
+					} `json:"buckets"`
+				} `json:"buckets"`
+			} `json:"aggregations"`
+		}
+		err = decodeESResponse(res.Body, res.IsError(), res.Status(), &result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("aggregating sessions: %v", err)
+		}
+
+		page := result.Aggregations.Buckets
+		for _, b := range page.Buckets {
+			start, err := time.Parse(time.RFC3339, b.Key.Start)
+			if err != nil {
+				continue
+			}
+			bucket := sessionBucket{User: b.Key.User, Start: start, Seconds: int64(b.Seconds.Value)}
+			if b.Key.Team != nil {
+				bucket.Team = *b.Key.Team
+			}
+			if b.Key.Language != nil {
+				bucket.Language = *b.Key.Language
+			}
+			if b.Key.Project != nil {
+				bucket.Project = *b.Key.Project
+			}
+			buckets = append(buckets, bucket)
+		}
+		if len(page.Buckets) == 0 || page.AfterKey == nil {
+			return buckets, nil
+		}
+		after = page.AfterKey
+	}
+}
+
+// Seed loads the sessions indexed before the server started: days carries
+// the whole history for the all-time board and the streaks, hours the recent
+// sessions for the week and month boards. It returns how many users it found.
+func (lb *Leaderboard) Seed(days, hours []sessionBucket, now time.Time) int {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	teamSeen := make(map[string]time.Time)
+	for _, b := range days {
+		dims := lb.allTime[b.User]
+		if dims == nil {
+			dims = make(map[dimension]int64)
+			lb.allTime[b.User] = dims
+		}
+		dims[dimension{Language: b.Language, Project: b.Project}] += b.Seconds
+
+		if lb.days[b.User] == nil {
+			lb.days[b.User] = make(map[string]bool)
+		}
+		lb.days[b.User][b.Start.Format("2006-01-02")] = true
+
+		if b.Team != "" && !b.Start.Before(teamSeen[b.User]) {
+			lb.teams[b.User] = b.Team
+			teamSeen[b.User] = b.Start
+		}
+	}
+
+	for _, b := range hours {
+		lb.records[b.User] = append(lb.records[b.User], leaderboardRecord{
+			At:       b.Start,
+			Seconds:  b.Seconds,
+			Language: b.Language,
+			Project:  b.Project,
+		})
+	}
+	for _, recs := range lb.records {
+		sort.Slice(recs, func(i, j int) bool { return recs[i].At.Before(recs[j].At) })
+	}
+
+	lb.refreshBroadcast(now)
+	return len(lb.allTime)
+}
+
+// seedLeaderboard fills the boards from the coding-sessions index so the
+// all-time, month and week boards survive a restart
+func seedLeaderboard(lb *Leaderboard, es *ESClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	now := time.Now()
+	cutoff := windowStart(WindowMonth, now)
+	if weekStart := windowStart(WindowWeek, now); weekStart.Before(cutoff) {
+		cutoff = weekStart
+	}
+
+	days, err := es.SessionBuckets(ctx, time.Unix(0, 0), now, false)
+	if err != nil {
+		hubLog.Warn("Failed to load the leaderboard history", "index", sessionsIndex, "error", err)
+		return
+	}
+	hours, err := es.SessionBuckets(ctx, cutoff, now, true)
+	if err != nil {
+		hubLog.Warn("Failed to load the leaderboard history", "index", sessionsIndex, "error", err)
+		return
+	}
+
+	users := lb.Seed(days, hours, now)
+	hubLog.Info("Leaderboard loaded from Elasticsearch", "index", sessionsIndex, "users", users)
+}
+
+// refreshBroadcast recomputes the broadcast boards; callers must hold the write lock
+func (lb *Leaderboard) refreshBroadcast(now time.Time) (LeaderboardUpdate, bool) {
+	changed := false
+	boards := make(map[string][]LeaderboardEntry, len(leaderboardWindows))
+	for _, window := range leaderboardWindows {
+		board := lb.rank(LeaderboardQuery{Window: window, Limit: broadcastBoardSize}, now)
+		if !sameBoard(board, lb.lastBroadcast[window]) {
+			changed = true
+		}
+		boards[window] = board
+	}
+
+	if changed {
+		lb.lastBroadcast = boards
+	}
+
+	return LeaderboardUpdate{
+		Boards:    boards,
+		Timestamp: now.Format(time.RFC3339),
+	}, changed
+}
+
+func sameBoard(a, b []LeaderboardEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (lb *Leaderboard) Query(q LeaderboardQuery) []LeaderboardEntry {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	return lb.rank(q, time.Now())
+}
+
+// rank builds the ordered board; callers must hold the lock
+func (lb *Leaderboard) rank(q LeaderboardQuery, now time.Time) []LeaderboardEntry {
+	filtered := q.Language != "" || q.Project != ""
+	matches := func(language, project string) bool {
+		return (q.Language == "" || strings.EqualFold(language, q.Language)) &&
+			(q.Project == "" || strings.EqualFold(project, q.Project))
+	}
+
+	totals := make(map[string]int64)
+	for user, dims := range lb.allTime {
+		privacy := lb.effectivePrivacy(user)
+		if privacy.HideFromLeaderboard || (filtered && privacy.HideDetails) {
+			continue
+		}
+		if q.Team != "" && !strings.EqualFold(lb.teams[user], q.Team) {
+			continue
+		}
+
+		var total int64
+		if q.Window == WindowAll {
+			for dim, seconds := range dims {
+				if matches(dim.Language, dim.Project) {
+					total += seconds
+				}
+			}
+		} else {
+			start := windowStart(q.Window, now)
+			for _, r := range lb.records[user] {
+				if !r.At.Before(start) && matches(r.Language, r.Project) {
+					total += r.Seconds
+				}
+			}
+		}
+
+		if total > 0 {
+			totals[user] = total
+		}
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(totals))
+	for user, total := range totals {
+		entries = append(entries, LeaderboardEntry{
+			User:         user,
+			Team:         lb.teams[user],
+			TotalSeconds: total,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].TotalSeconds != entries[j].TotalSeconds {
+			return entries[i].TotalSeconds > entries[j].TotalSeconds
+		}
+		return entries[i].User < entries[j].User
+	})
+
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+
+	return entries
+}
+
+// effectivePrivacy merges the flags of user with the configured opt-out;
+// callers must hold the lock
+func (lb *Leaderboard) effectivePrivacy(user string) UserPrivacy {
+	privacy := lb.privacy[user]
+	if lb.optOut[user] {
+		privacy.HideFromLeaderboard = true
+	}
+	return privacy
+}
+
+func (lb *Leaderboard) GetPrivacy(user string) UserPrivacy {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	return lb.effectivePrivacy(user)
+}
+
+// SetOptOut replaces the users hidden by the configuration and reports
+// whether the broadcast boards changed. The flags users set themselves
+// are left alone.
+func (lb *Leaderboard) SetOptOut(users []string) (LeaderboardUpdate, bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.optOut = make(map[string]bool, len(users))
+	for _, user := range users {
+		lb.optOut[user] = true
+	}
+
+	return lb.refreshBroadcast(time.Now())
+}
+
+// LoadPrivacy reads the privacy flags kept in the data directory, later
+// changes are written back there
+func (lb *Leaderboard) LoadPrivacy() error {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, "privacy.json")
+
+	privacy := make(map[string]UserPrivacy)
+	if err := readJSONFile(path, &privacy); err != nil {
+		return err
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.privacyPath = path
+	for user, p := range privacy {
+		if p != (UserPrivacy{}) {
+			lb.privacy[user] = p
+		}
+	}
+	return nil
+}
+
+// SetPrivacy updates the opt-out flags of user and reports whether the broadcast boards changed
+func (lb *Leaderboard) SetPrivacy(user string, privacy UserPrivacy) (LeaderboardUpdate, bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if privacy == (UserPrivacy{}) {
+		delete(lb.privacy, user)
+	} else {
+		lb.privacy[user] = privacy
+	}
+	if lb.privacyPath != "" {
+		if err := writeJSONFile(lb.privacyPath, lb.privacy); err != nil {
+			hubLog.Error("Failed to persist privacy settings", "user", user, "error", err)
+		}
+	}
+
+	return lb.refreshBroadcast(time.Now())
+}
+
+// UserActivity is the per-user detail used by the coding summaries
+type UserActivity struct {
+	Team      string
+	Privacy   UserPrivacy
+	Languages map[string]int64
+	Projects  map[string]int64
+}
+
+// Activity splits the recent records of user within [from, to) by language and project
+func (lb *Leaderboard) Activity(user string, from, to time.Time) UserActivity {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	activity := UserActivity{
+		Team:      lb.teams[user],
+		Privacy:   lb.effectivePrivacy(user),
+		Languages: make(map[string]int64),
+		Projects:  make(map[string]int64),
+	}
+	for _, r := range lb.records[user] {
+		if r.At.Before(from) || !r.At.Before(to) {
+			continue
+		}
+		if r.Language != "" {
+			activity.Languages[r.Language] += r.Seconds
+		}
+		if r.Project != "" {
+			activity.Projects[r.Project] += r.Seconds
+		}
+	}
+	return activity
+}
+
+// UserTotals returns the coded seconds of user within window, split by language
+func (lb *Leaderboard) UserTotals(user, window string, now time.Time) (int64, map[string]int64) {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	var total int64
+	languages := make(map[string]int64)
+	if window == WindowAll {
+		for dim, seconds := range lb.allTime[user] {
+			total += seconds
+			if dim.Language != "" {
+				languages[dim.Language] += seconds
+			}
+		}
+		return total, languages
+	}
+
+	start := windowStart(window, now)
+	for _, r := range lb.records[user] {
+		if r.At.Before(start) {
+			continue
+		}
+		total += r.Seconds
+		if r.Language != "" {
+			languages[r.Language] += r.Seconds
+		}
+	}
+	return total, languages
+}
+
+// Streak counts the consecutive days with activity up to today. A streak
+// that ended yesterday still counts until the end of today.
+func (lb *Leaderboard) Streak(user string, now time.Time) int {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	days := lb.days[user]
+	day := now
+	if !days[day.Format("2006-01-02")] {
+		day = day.AddDate(0, 0, -1)
+	}
+
+	streak := 0
+	for days[day.Format("2006-01-02")] {
+		streak++
+		day = day.AddDate(0, 0, -1)
+	}
+	return streak
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// logSubsystems are the names accepted by logging.levels, every logger
+// below tags its records with one of them
+var logSubsystems = []string{
+	"server", "http", "hub", "websocket", "agent", "elasticsearch", "alerts",
+	"webhooks", "notify", "reports", "rollups", "collector", "export", "import", "config",
+}
+
+var (
+	serverLog    = subsystemLogger("server")
+	httpLog      = subsystemLogger("http")
+	hubLog       = subsystemLogger("hub")
+	wsLog        = subsystemLogger("websocket")
+	agentLog     = subsystemLogger("agent")
+	esLog        = subsystemLogger("elasticsearch")
+	alertsLog    = subsystemLogger("alerts")
+	webhooksLog  = subsystemLogger("webhooks")
+	notifyLog    = subsystemLogger("notify")
+	reportsLog   = subsystemLogger("reports")
+	rollupsLog   = subsystemLogger("rollups")
+	collectorLog = subsystemLogger("collector")
+	exportLog    = subsystemLogger("export")
+	importLog    = subsystemLogger("import")
+	configLog    = subsystemLogger("config")
+)
+
+// logSettings is the output and the levels all loggers currently use
+type logSettings struct {
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+}
+
+func (s *logSettings) enabled(subsystem string, level slog.Level) bool {
+	min, ok := s.levels[subsystem]
+	if !ok {
+		min = s.level
+	}
+	return level >= min
+}
+
+var logState atomic.Pointer[logSettings]
+
+func init() {
+	logState.Store(&logSettings{handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})})
+	// the log package, used by net/http for instance, ends up in the server logger
+	slog.SetDefault(serverLog)
+}
+
+// newLogSettings builds the settings of cfg, it validates what
+// Config.Validate checks as well
+func newLogSettings(cfg LoggingConfig, w io.Writer) (*logSettings, error) {
+	s := &logSettings{levels: make(map[string]slog.Level)}
+
+	// the subsystem loggers filter, the handler itself passes everything
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch cfg.Format {
+	case "text":
+		s.handler = slog.NewTextHandler(w, opts)
+	case "json":
+		s.handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("format must be text or json, got %q", cfg.Format)
+	}
+
+	if err := s.level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("level must be debug, info, warn or error, got %q", cfg.Level)
+	}
+	for _, entry := range cfg.Levels {
+		subsystem, level, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("levels entry %q is not subsystem=level", entry)
+		}
+		known := false
+		for _, name := range logSubsystems {
+			known = known || name == subsystem
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown subsystem %q in levels, use one of %s", subsystem, strings.Join(logSubsystems, ", "))
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("levels entry %q: level must be debug, info, warn or error", entry)
+		}
+		s.levels[subsystem] = l
+	}
+	return s, nil
+}
+
+// configureLogging switches every logger to cfg, also on reload
+func configureLogging(cfg LoggingConfig) error {
+	s, err := newLogSettings(cfg, os.Stderr)
+	if err != nil {
+		return err
+	}
+	logState.Store(s)
+	return nil
+}
+
+// subsystemHandler sends the records of one subsystem to the current
+// settings, so a reload applies to loggers that already exist
+type subsystemHandler struct {
+	subsystem string
+	attrs     []slog.Attr
+	cache     atomic.Pointer[cachedHandler]
+}
+
+// cachedHandler is the settings' handler with the attributes of a logger applied
+type cachedHandler struct {
+	settings *logSettings
+	handler  slog.Handler
+}
+
+func subsystemLogger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem, attrs: []slog.Attr{slog.String("subsystem", subsystem)}})
+}
+
+func (h *subsystemHandler) current() slog.Handler {
+	s := logState.Load()
+	if c := h.cache.Load(); c != nil && c.settings == s {
+		return c.handler
+	}
+	handler := s.handler.WithAttrs(h.attrs)
+	h.cache.Store(&cachedHandler{settings: s, handler: handler})
+	return handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return logState.Load().enabled(h.subsystem, level)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.current().Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{subsystem: h.subsystem, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+// WithGroup is not supported, the program logs flat records only
+func (h *subsystemHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// fatal logs an error and exits
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// statusRecorder captures the response status for the request log and passes
+// hijacking and flushing through to the WebSocket and streaming handlers
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests writes one debug record per HTTP request
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		httpLog.Debug("Request served",
+			"method", r.Method,
+			"endpoint", r.URL.Path,
+			"client", r.RemoteAddr,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds())
+	})
+}
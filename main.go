@@ -4,50 +4,124 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
+	"go.opentelemetry.io/otel"
 )
 
 type ESClient struct {
 	client *elasticsearch.Client
-}
 
-func NewESClient() (*ESClient, error) {
-	esURL := os.Getenv("ELASTICSEARCH_URL")
-	if esURL == "" {
-		esURL = "http://localhost:9200"
-	}
+	// pending counts the writes running in the background, shutdown waits for them
+	pending sync.WaitGroup
+	// writes is how many of them are running, for the spool health check
+	writes atomic.Int64
 
+	// draining is set once Wait starts, later writes are dropped
+	mutex    sync.Mutex
+	draining bool
+}
+
+func NewESClient(esURL string) (*ESClient, error) {
 	cfg := elasticsearch.Config{
 		Addresses: []string{esURL},
+		// spans of the requests join the trace of the context they are made with
+		Instrumentation: elasticsearch.NewOpenTelemetryInstrumentation(otel.GetTracerProvider(), false),
 	}
 	es, err := elasticsearch.NewClient(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	// Test connection
-	res, err := es.Info()
+	// Test connection, with a context as the instrumentation needs one on every request
+	res, err := es.Info(es.Info.WithContext(context.Background()))
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		log.Printf("Elasticsearch connection error: %s", res.String())
+		esLog.Error("Elasticsearch connection error", "url", esURL, "status", res.StatusCode)
 		return nil, err
 	}
 
-	log.Println("Connected to Elasticsearch")
+	esLog.Info("Connected to Elasticsearch", "url", esURL)
 	return &ESClient{client: es}, nil
 }
 
-func (es *ESClient) IndexDocument(indexName string, data interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// Background runs write in its own goroutine, tracked so a shutdown can
+// let it finish. Once the shutdown waits for the writes, new ones are dropped.
+func (es *ESClient) Background(write func()) {
+	es.mutex.Lock()
+	if es.draining {
+		es.mutex.Unlock()
+		esLog.Warn("Dropping Elasticsearch write, shutdown in progress")
+		return
+	}
+	es.pending.Add(1)
+	es.mutex.Unlock()
+
+	es.writes.Add(1)
+	go func() {
+		defer es.pending.Done()
+		defer es.writes.Add(-1)
+		write()
+	}()
+}
+
+// Wait refuses new background writes and blocks until the running ones are
+// done or ctx expires
+func (es *ESClient) Wait(ctx context.Context) error {
+	es.mutex.Lock()
+	es.draining = true
+	es.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		es.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pending is the number of background writes not finished yet
+func (es *ESClient) Pending() int {
+	return int(es.writes.Load())
+}
+
+// Ping checks that the cluster answers
+func (es *ESClient) Ping(ctx context.Context) error {
+	res, err := es.client.Ping(es.client.Ping.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("elasticsearch ping: %s", res.Status())
+	}
+	return nil
+}
+
+func (es *ESClient) IndexDocument(ctx context.Context, indexName string, data interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	jsonData, err := json.Marshal(data)
@@ -55,25 +129,31 @@ func (es *ESClient) IndexDocument(indexName string, data interface{}) error {
 		return err
 	}
 
+	start := time.Now()
 	res, err := es.client.Index(
 		indexName,
 		bytes.NewReader(jsonData),
 		es.client.Index.WithContext(ctx),
 		es.client.Index.WithRefresh("true"),
 	)
+	esIndexDuration.Observe(time.Since(start).Seconds(), indexName)
 	if err != nil {
+		esIndexFailures.Inc(indexName)
 		return err
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		log.Printf("Error indexing to %s: %s", indexName, res.String())
+		esLog.Error("Indexing failed", "index", indexName, "status", res.StatusCode, "response", res.String())
+		esIndexFailures.Inc(indexName)
+		return fmt.Errorf("indexing to %s: %s", indexName, res.Status())
 	}
 
 	return nil
 }
 
-func (es *ESClient) IndexSession(session CodingSession) error {
+// sessionDocument is the coding-sessions document of a session received at receivedAt
+func sessionDocument(session CodingSession, receivedAt time.Time) map[string]interface{} {
 	sessionData := map[string]interface{}{
 		"duration_seconds": session.DurationSeconds,
 		"editor":           session.Editor,
@@ -81,35 +161,125 @@ func (es *ESClient) IndexSession(session CodingSession) error {
 		"language":         session.Language,
 		"file_path":        session.FilePath,
 		"client_timestamp": session.Timestamp,
-		"server_timestamp": time.Now().Format(time.RFC3339),
+		"server_timestamp": receivedAt.Format(time.RFC3339),
 	}
 
 	if session.LinesOfCode != nil {
 		sessionData["lines_of_code"] = *session.LinesOfCode
 	}
+	if session.User != "" {
+		sessionData["user"] = session.User
+	}
+	if session.Team != "" {
+		sessionData["team"] = session.Team
+	}
+	return sessionData
+}
 
-	return es.IndexDocument("coding-sessions", sessionData)
+func (es *ESClient) IndexSession(ctx context.Context, session CodingSession) error {
+	return es.IndexDocument(ctx, sessionsIndex, sessionDocument(session, time.Now()))
 }
 
-func (es *ESClient) IndexMetrics(metrics SystemMetrics) error {
-	return es.IndexDocument("system-metrics", metrics)
+func (es *ESClient) IndexMetricsRollup(ctx context.Context, rollup MetricsRollup) error {
+	return es.IndexDocument(ctx, rollupIndex, rollup)
 }
 
 func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		runExport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+
+	cfg, _, err := loadConfig("server", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	applyConfig(cfg)
+
+	stopTracing, err := setupTracing(cfg.Tracing)
+	if err != nil {
+		fatal(serverLog, "Failed to set up tracing", "exporter", cfg.Tracing.Exporter, "error", err)
+	}
 
-	esClient, err := NewESClient()
+	esClient, err := NewESClient(cfg.Elasticsearch.URL)
 	if err != nil {
-		log.Printf("Warning: Failed to create Elasticsearch client: %v", err)
-		log.Println("Server will continue without Elasticsearch indexing")
+		esLog.Warn("Failed to create Elasticsearch client, continuing without indexing", "url", cfg.Elasticsearch.URL, "error", err)
 		esClient = nil
 	}
 
-	hub := newHub()
+	hub := newHub(cfg)
+	if err := hub.leaderboard.LoadPrivacy(); err != nil {
+		fatal(hubLog, "Failed to load privacy settings", "error", err)
+	}
+	hub.leaderboard.SetOptOut(cfg.Leaderboard.OptOut)
+	if esClient != nil {
+		seedLeaderboard(hub.leaderboard, esClient)
+	}
+	alerts, err := newAlertEngine(cfg.Alerts.RulesFile, esClient)
+	if err != nil {
+		fatal(alertsLog, "Failed to load alert rules", "error", err)
+	}
+	hub.alerts = alerts
+	webhooks, err := newWebhookDispatcher(cfg.Webhooks)
+	if err != nil {
+		fatal(webhooksLog, "Failed to load webhooks", "error", err)
+	}
+	hub.listeners = append(hub.listeners, webhooks.Publish)
+	notifier, err := newNotifier(cfg.Notifications.ChannelsFile, hub)
+	if err != nil {
+		fatal(notifyLog, "Failed to load notification channels", "error", err)
+	}
+	hub.listeners = append(hub.listeners, notifier.Publish)
+	reporter, err := newReporter(hub, cfg.Reports, cfg.Server.PublicURLOrDefault())
+	if err != nil {
+		fatal(reportsLog, "Failed to set up email reports", "error", err)
+	}
+	projects, err := newProjectCatalog()
+	if err != nil {
+		fatal(serverLog, "Failed to load project metadata", "error", err)
+	}
+	registerHubMetrics(hub)
+	registerHostMetrics(hostSamples(hub))
+	healthChecks.Register("elasticsearch", esHealthCheck(esClient))
+	healthChecks.Register("spool", spoolHealthCheck(esClient, webhooks))
+	healthChecks.Register("hub", hubHealthCheck(hub))
+	healthChecks.Register("collector", collectorHealthCheck(hub))
 	go hub.run()
+	go hub.presence.run()
+	if esClient != nil {
+		hub.rollups = newMetricsRollups(esClient, cfg.Metrics.RollupWindow)
+		go hub.rollups.run()
+	}
+	go webhooks.run()
+	go notifier.run()
+	go reporter.run()
+	go runLocalMetrics(hub)
+	go runAlertSweeper(hub)
+	reloader := &Reloader{args: os.Args[1:], hub: hub, webhooks: webhooks, notifier: notifier, reporter: reporter}
+	go reloader.watchSignals()
+	port := strconv.Itoa(cfg.Server.Port)
 
 	http.HandleFunc("/ws/monitor", func(w http.ResponseWriter, r *http.Request) {
-		monitorWSHandler(w, r, esClient, hub)
+		monitorWSHandler(w, r, hub)
 	})
 
 	http.HandleFunc("/ws/external", func(w http.ResponseWriter, r *http.Request) {
@@ -120,12 +290,41 @@ func main() {
 		trackingWSHandler(w, r, esClient, hub)
 	})
 
+	http.HandleFunc("/ws/agent", func(w http.ResponseWriter, r *http.Request) {
+		agentWSHandler(w, r, hub)
+	})
+
+	http.HandleFunc("POST /api/v1/agent/metrics", func(w http.ResponseWriter, r *http.Request) {
+		agentMetricsHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/hosts", func(w http.ResponseWriter, r *http.Request) {
+		hostsHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/metrics/history", func(w http.ResponseWriter, r *http.Request) {
+		metricsHistoryHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/hosts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		hostHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /livez", livezHandler)
+
+	http.HandleFunc("GET /readyz", readyzHandler)
+
+	// /health predates the probes and keeps its shape, it always answers 200
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		
 		esStatus := "disconnected"
 		if esClient != nil {
 			esStatus = "connected"
+			check := healthChecks.Run(r.Context(), []string{"elasticsearch"}, func(string) bool { return true })
+			if check[0].Status != "ok" {
+				esStatus = "unreachable"
+			}
 		}
 
 		hub.mutex.RLock()
@@ -146,8 +345,8 @@ func main() {
 		
 		hub.mutex.RLock()
 		clientsInfo := make(map[string]string)
-		for conn, filter := range hub.clients {
-			clientsInfo[conn.RemoteAddr().String()] = filter
+		for client, filter := range hub.clients {
+			clientsInfo[client.RemoteAddr] = filter
 		}
 		
 		weeklyStats := make(map[string]int64)
@@ -167,6 +366,141 @@ func main() {
 		})
 	})
 
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/metrics/host", hostMetricsHandler)
+
+	http.HandleFunc("GET /api/v1/leaderboard", func(w http.ResponseWriter, r *http.Request) {
+		leaderboardHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/presence", func(w http.ResponseWriter, r *http.Request) {
+		presenceHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/users/{user}/privacy", func(w http.ResponseWriter, r *http.Request) {
+		getPrivacyHandler(w, r, hub)
+	})
+
+	http.HandleFunc("PUT /api/v1/users/{user}/privacy", func(w http.ResponseWriter, r *http.Request) {
+		putPrivacyHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/alerts", func(w http.ResponseWriter, r *http.Request) {
+		alertsHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/alerts/rules", func(w http.ResponseWriter, r *http.Request) {
+		alertRulesHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/alerts/history", func(w http.ResponseWriter, r *http.Request) {
+		alertHistoryHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/summary", func(w http.ResponseWriter, r *http.Request) {
+		summaryHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/export", func(w http.ResponseWriter, r *http.Request) {
+		exportHandler(w, r, esClient)
+	})
+
+	http.HandleFunc("POST /api/v1/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+		reloadHandler(w, r, reloader)
+	})
+
+	http.HandleFunc("GET /api/v1/admin/connections", func(w http.ResponseWriter, r *http.Request) {
+		listConnectionsHandler(w, r, hub)
+	})
+
+	http.HandleFunc("DELETE /api/v1/admin/connections/{id}", disconnectHandler)
+
+	http.HandleFunc("PUT /api/v1/admin/connections/{id}/subscription", func(w http.ResponseWriter, r *http.Request) {
+		updateSubscriptionHandler(w, r, hub)
+	})
+
+	http.HandleFunc("POST /api/v1/admin/announcements", func(w http.ResponseWriter, r *http.Request) {
+		announceHandler(w, r, hub)
+	})
+
+	http.HandleFunc("GET /api/v1/projects", func(w http.ResponseWriter, r *http.Request) {
+		listProjectsHandler(w, r, projects)
+	})
+
+	http.HandleFunc("PUT /api/v1/projects/{name}", func(w http.ResponseWriter, r *http.Request) {
+		putProjectHandler(w, r, projects)
+	})
+
+	http.HandleFunc("DELETE /api/v1/projects/{name}", func(w http.ResponseWriter, r *http.Request) {
+		deleteProjectHandler(w, r, projects)
+	})
+
+	http.HandleFunc("GET /api/v1/timesheets", func(w http.ResponseWriter, r *http.Request) {
+		timesheetHandler(w, r, esClient, projects)
+	})
+
+	http.HandleFunc("POST /api/v1/import", func(w http.ResponseWriter, r *http.Request) {
+		importHandler(w, r, esClient)
+	})
+
+	http.HandleFunc("GET /api/v1/notifications/channels", func(w http.ResponseWriter, r *http.Request) {
+		notificationChannelsHandler(w, r, notifier)
+	})
+
+	http.HandleFunc("POST /api/v1/notifications/channels/{name}/test", func(w http.ResponseWriter, r *http.Request) {
+		testNotificationHandler(w, r, notifier)
+	})
+
+	http.HandleFunc("POST /api/v1/reports/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		subscribeReportsHandler(w, r, reporter)
+	})
+
+	http.HandleFunc("GET /api/v1/reports/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		listReportSubscriptionsHandler(w, r, reporter)
+	})
+
+	http.HandleFunc("POST /api/v1/reports/send", func(w http.ResponseWriter, r *http.Request) {
+		sendReportsHandler(w, r, reporter)
+	})
+
+	http.HandleFunc("GET /reports/confirm", func(w http.ResponseWriter, r *http.Request) {
+		confirmReportsHandler(w, r, reporter)
+	})
+
+	http.HandleFunc("/reports/unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		unsubscribeReportsHandler(w, r, reporter)
+	})
+
+	http.HandleFunc("GET /api/v1/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		listWebhooksHandler(w, r, webhooks)
+	})
+
+	http.HandleFunc("POST /api/v1/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		createWebhookHandler(w, r, webhooks)
+	})
+
+	http.HandleFunc("GET /api/v1/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		getWebhookHandler(w, r, webhooks)
+	})
+
+	http.HandleFunc("PUT /api/v1/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		updateWebhookHandler(w, r, webhooks)
+	})
+
+	http.HandleFunc("DELETE /api/v1/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		deleteWebhookHandler(w, r, webhooks)
+	})
+
+	http.HandleFunc("POST /api/v1/webhooks/{id}/ping", func(w http.ResponseWriter, r *http.Request) {
+		pingWebhookHandler(w, r, webhooks)
+	})
+
+	http.HandleFunc("GET /badge/{user}/{file}", func(w http.ResponseWriter, r *http.Request) {
+		badgeHandler(w, r, hub)
+	})
+
+	http.Handle("GET /dashboard/", dashboardHandler())
+
 	// Root endpoint
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
@@ -174,65 +508,115 @@ func main() {
 			return
 		}
 
+		if wantsHTML(r) {
+			http.Redirect(w, r, "/dashboard/", http.StatusFound)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		
 		hub.mutex.RLock()
 		clientCount := len(hub.clients)
 		hub.mutex.RUnlock()
 
-		port := os.Getenv("PORT")
-		if port == "" {
-			port = "8081"
-		}
-
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"service": "Coding Tracker Server",
 			"version": "1.0.0",
 			"endpoints": map[string]string{
-				"monitor":  "ws://localhost:" + port + "/ws/monitor",
-				"external": "ws://localhost:" + port + "/ws/external",
-				"track":    "ws://localhost:" + port + "/ws/track",
-				"health":   "http://localhost:" + port + "/health",
-				"stats":    "http://localhost:" + port + "/stats",
+				"monitor":     "ws://localhost:" + port + "/ws/monitor",
+				"external":    "ws://localhost:" + port + "/ws/external",
+				"track":       "ws://localhost:" + port + "/ws/track",
+				"agent":       "ws://localhost:" + port + "/ws/agent",
+				"hosts":       "http://localhost:" + port + "/api/v1/hosts",
+				"history":     "http://localhost:" + port + "/api/v1/metrics/history",
+				"health":      "http://localhost:" + port + "/health",
+				"livez":       "http://localhost:" + port + "/livez",
+				"readyz":      "http://localhost:" + port + "/readyz",
+				"stats":       "http://localhost:" + port + "/stats",
+				"metrics":     "http://localhost:" + port + "/metrics",
+				"leaderboard": "http://localhost:" + port + "/api/v1/leaderboard",
+				"presence":    "http://localhost:" + port + "/api/v1/presence",
+				"alerts":      "http://localhost:" + port + "/api/v1/alerts",
+				"summary":     "http://localhost:" + port + "/api/v1/summary",
+				"reports":     "http://localhost:" + port + "/api/v1/reports/subscriptions",
+				"export":      "http://localhost:" + port + "/api/v1/export",
+				"import":      "http://localhost:" + port + "/api/v1/import",
+				"projects":    "http://localhost:" + port + "/api/v1/projects",
+				"timesheets":  "http://localhost:" + port + "/api/v1/timesheets",
+				"reload":      "http://localhost:" + port + "/api/v1/admin/reload",
+				"connections": "http://localhost:" + port + "/api/v1/admin/connections",
+				"announce":    "http://localhost:" + port + "/api/v1/admin/announcements",
+				"webhooks":    "http://localhost:" + port + "/api/v1/webhooks",
+				"dashboard":   "http://localhost:" + port + "/dashboard/",
+				"badges":      "http://localhost:" + port + "/badge/{user}/{time,language,streak}.svg",
 			},
 			"connected_clients": clientCount,
 			"timestamp":         time.Now().Format(time.RFC3339),
 		})
 	})
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8081"
-	}
-
-	log.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
-	log.Println("Coding Tracker Server Started")
-	log.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
-	log.Printf("Server running on port %s", port)
-	log.Println("")
-	log.Println("WebSocket Endpoints:")
-	log.Printf("   • Monitor (metrics):     ws://localhost:%s/ws/monitor", port)
-	log.Printf("   • External (sessions):   ws://localhost:%s/ws/external", port)
-	log.Printf("   • Track (send data):     ws://localhost:%s/ws/track", port)
-	log.Println("")
-	log.Println("HTTP Endpoints:")
-	log.Printf("   • Health Check:          http://localhost:%s/health", port)
-	log.Printf("   • Statistics:            http://localhost:%s/stats", port)
-	log.Printf("   • API Info:              http://localhost:%s/", port)
-	log.Println("")
+
+	// the banner is for people reading the console, pipelines get one record
+	banner := io.Discard
+	if cfg.Logging.Format == "text" {
+		banner = os.Stderr
+	}
+	fmt.Fprintln(banner, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	fmt.Fprintln(banner, "Coding Tracker Server Started")
+	fmt.Fprintln(banner, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	fmt.Fprintf(banner, "Server running on port %s\n", port)
+	fmt.Fprintln(banner)
+	fmt.Fprintln(banner, "WebSocket Endpoints:")
+	fmt.Fprintf(banner, "   • Monitor (metrics):     ws://localhost:%s/ws/monitor\n", port)
+	fmt.Fprintf(banner, "   • External (sessions):   ws://localhost:%s/ws/external\n", port)
+	fmt.Fprintf(banner, "   • Track (send data):     ws://localhost:%s/ws/track\n", port)
+	fmt.Fprintf(banner, "   • Agent (push metrics):  ws://localhost:%s/ws/agent\n", port)
+	fmt.Fprintln(banner)
+	fmt.Fprintln(banner, "HTTP Endpoints:")
+	fmt.Fprintf(banner, "   • Health Check:          http://localhost:%s/health\n", port)
+	fmt.Fprintf(banner, "   • Liveness:              http://localhost:%s/livez\n", port)
+	fmt.Fprintf(banner, "   • Readiness:             http://localhost:%s/readyz\n", port)
+	fmt.Fprintf(banner, "   • Statistics:            http://localhost:%s/stats\n", port)
+	fmt.Fprintf(banner, "   • Prometheus Metrics:    http://localhost:%s/metrics\n", port)
+	fmt.Fprintf(banner, "   • Host Metrics:          http://localhost:%s/metrics/host\n", port)
+	fmt.Fprintf(banner, "   • Leaderboard:           http://localhost:%s/api/v1/leaderboard\n", port)
+	fmt.Fprintf(banner, "   • Presence:              http://localhost:%s/api/v1/presence\n", port)
+	fmt.Fprintf(banner, "   • Hosts:                 http://localhost:%s/api/v1/hosts\n", port)
+	fmt.Fprintf(banner, "   • Metrics History:       http://localhost:%s/api/v1/metrics/history\n", port)
+	fmt.Fprintf(banner, "   • Alerts:                http://localhost:%s/api/v1/alerts\n", port)
+	fmt.Fprintf(banner, "   • Coding Summary:        http://localhost:%s/api/v1/summary\n", port)
+	fmt.Fprintf(banner, "   • Email Reports:         http://localhost:%s/api/v1/reports/subscriptions\n", port)
+	fmt.Fprintf(banner, "   • Webhooks (admin):      http://localhost:%s/api/v1/webhooks\n", port)
+	fmt.Fprintf(banner, "   • Export (admin):        http://localhost:%s/api/v1/export\n", port)
+	fmt.Fprintf(banner, "   • Import (admin):        http://localhost:%s/api/v1/import\n", port)
+	fmt.Fprintf(banner, "   • Projects (admin):      http://localhost:%s/api/v1/projects\n", port)
+	fmt.Fprintf(banner, "   • Timesheets (admin):    http://localhost:%s/api/v1/timesheets\n", port)
+	fmt.Fprintf(banner, "   • Config Reload (admin): http://localhost:%s/api/v1/admin/reload\n", port)
+	fmt.Fprintf(banner, "   • Connections (admin):   http://localhost:%s/api/v1/admin/connections\n", port)
+	fmt.Fprintf(banner, "   • Announce (admin):      http://localhost:%s/api/v1/admin/announcements\n", port)
+	fmt.Fprintf(banner, "   • Dashboard:             http://localhost:%s/dashboard/\n", port)
+	fmt.Fprintf(banner, "   • Badges:                http://localhost:%s/badge/{user}/time.svg\n", port)
+	fmt.Fprintf(banner, "   • API Info:              http://localhost:%s/\n", port)
+	fmt.Fprintln(banner)
 	if esClient != nil {
-		esURL := os.Getenv("ELASTICSEARCH_URL")
-		if esURL == "" {
-			esURL = "http://localhost:9200"
-		}
-		log.Printf("Elasticsearch:            %s", esURL)
+		fmt.Fprintf(banner, "Elasticsearch:            %s\n", cfg.Elasticsearch.URL)
 	} else {
-		log.Println("Elasticsearch: Not connected (data will not be persisted)")
+		fmt.Fprintln(banner, "Elasticsearch: Not connected (data will not be persisted)")
 	}
-	log.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
-	log.Println("")
+	fmt.Fprintln(banner, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	fmt.Fprintln(banner)
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
-	}
+	serverLog.Info("Server started", "port", cfg.Server.Port, "elasticsearch", esClient != nil)
+
+	server := &http.Server{Addr: ":" + port, Handler: logRequests(http.DefaultServeMux)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal(serverLog, "HTTP server failed", "error", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	serverLog.Info("Shutting down", "signal", (<-stop).String())
+	shutdown(server, hub, esClient, webhooks, stopTracing)
 }
\ No newline at end of file
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 type CodingSession struct {
+	Type            string  `json:"type,omitempty"` // "heartbeat" for presence-only pings
 	DurationSeconds int64   `json:"duration_seconds"`
 	Editor          string  `json:"editor"`
 	Project         string  `json:"project"`
@@ -14,26 +14,108 @@ type CodingSession struct {
 	FilePath        *string `json:"file_path,omitempty"`
 	Timestamp       string  `json:"timestamp"`
 	LinesOfCode     *int    `json:"lines_of_code,omitempty"`
+	User            string  `json:"user,omitempty"`
+	Team            string  `json:"team,omitempty"`
 }
+
+// MetricsSchemaVersion is sent as schema_version in every metrics message.
+// Version 1 fields (cpu .. timestamp, with total_mem/used_mem in whole GB) are
+// kept unchanged; later versions only add fields.
+const MetricsSchemaVersion = 2
+
 type SystemMetrics struct {
-	CPU       float64 `json:"cpu"`
-	CPUModel  string  `json:"cpu_model"`
-	Cores     int     `json:"cores"`
-	Memory    float64 `json:"memory"`
-	TotalMem  uint64  `json:"total_mem"`
-	UsedMem   uint64  `json:"used_mem"`
-	OS        string  `json:"os"`
-	Platform  string  `json:"platform"`
-	Kernel    string  `json:"kernel"`
-	Arch      string  `json:"arch"`
-	Uptime    uint64  `json:"uptime"`
-	Timestamp string  `json:"timestamp"`
+	SchemaVersion int     `json:"schema_version"`
+	CPU           float64 `json:"cpu"`
+	CPUModel      string  `json:"cpu_model"`
+	Cores         int     `json:"cores"`
+	Memory        float64 `json:"memory"`
+	TotalMem      uint64  `json:"total_mem"`
+	UsedMem       uint64  `json:"used_mem"`
+	OS            string  `json:"os"`
+	Platform      string  `json:"platform"`
+	Kernel        string  `json:"kernel"`
+	Arch          string  `json:"arch"`
+	Uptime        uint64  `json:"uptime"`
+	Timestamp     string  `json:"timestamp"`
+
+	// schema version 2
+	HostID            string           `json:"host_id,omitempty"`
+	Hostname          string           `json:"hostname,omitempty"`
+	TotalMemBytes     uint64           `json:"total_mem_bytes,omitempty"`
+	UsedMemBytes      uint64           `json:"used_mem_bytes,omitempty"`
+	AvailableMemBytes uint64           `json:"available_mem_bytes,omitempty"`
+	CPUPerCore        []float64        `json:"cpu_per_core,omitempty"`
+	Load              *LoadAverage     `json:"load,omitempty"`
+	Swap              *SwapMetrics     `json:"swap,omitempty"`
+	Disks             []DiskMetrics    `json:"disks,omitempty"`
+	Network           []NetworkMetrics `json:"network,omitempty"`
+	Processes         []ProcessMetrics `json:"processes,omitempty"`
+
+	// Container holds the server's own cgroup values when it runs in a container;
+	// all other fields stay host-wide
+	Container *ContainerMetrics `json:"container,omitempty"`
+}
+
+type LoadAverage struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+type SwapMetrics struct {
+	TotalBytes  uint64  `json:"total_bytes"`
+	UsedBytes   uint64  `json:"used_bytes"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// DiskMetrics describes one mounted filesystem; rates are per second since the previous sample
+type DiskMetrics struct {
+	Mount           string  `json:"mount"`
+	Device          string  `json:"device"`
+	FSType          string  `json:"fstype"`
+	TotalBytes      uint64  `json:"total_bytes"`
+	UsedBytes       uint64  `json:"used_bytes"`
+	FreeBytes       uint64  `json:"free_bytes"`
+	UsedPercent     float64 `json:"used_percent"`
+	ReadBytesTotal  uint64  `json:"read_bytes_total"`
+	WriteBytesTotal uint64  `json:"write_bytes_total"`
+	ReadBytesRate   float64 `json:"read_bytes_per_sec"`
+	WriteBytesRate  float64 `json:"write_bytes_per_sec"`
+	ReadOpsRate     float64 `json:"read_ops_per_sec"`
+	WriteOpsRate    float64 `json:"write_ops_per_sec"`
+}
+
+// NetworkMetrics describes one interface; rates are per second since the previous sample
+type NetworkMetrics struct {
+	Interface     string  `json:"interface"`
+	RxBytesTotal  uint64  `json:"rx_bytes_total"`
+	TxBytesTotal  uint64  `json:"tx_bytes_total"`
+	RxBytesRate   float64 `json:"rx_bytes_per_sec"`
+	TxBytesRate   float64 `json:"tx_bytes_per_sec"`
+	RxPacketsRate float64 `json:"rx_packets_per_sec"`
+	TxPacketsRate float64 `json:"tx_packets_per_sec"`
+	RxErrorsTotal uint64  `json:"rx_errors_total"`
+	TxErrorsTotal uint64  `json:"tx_errors_total"`
+}
+
+type ProcessMetrics struct {
+	PID           int32   `json:"pid"`
+	Name          string  `json:"name"`
+	CPU           float64 `json:"cpu"`
+	MemoryBytes   uint64  `json:"memory_bytes"`
+	MemoryPercent float32 `json:"memory_percent"`
 }
 
 type BroadcastMessage struct {
 	Type    string      `json:"type"`
 	Data    interface{} `json:"data"`
 	EventID string      `json:"event_id"`
+
+	// Host routes metrics messages to subscribers of that host, not serialized
+	Host string `json:"-"`
+
+	// ctx carries the trace of the message, the hub broadcast joins it when set
+	ctx context.Context
 }
 
 // internal record for tracking session durations per timestamp
@@ -50,6 +132,17 @@ type WeeklySummary struct {
 
 // Subscription represents a client subscribing to hub broadcasts with an optional filter
 type Subscription struct {
-	Conn   *websocket.Conn
-	Filter string // empty = all, otherwise "metrics" or "session" or "weekly_summary"
+	Client *wsClient
+	Filter string   // empty = all, otherwise "metrics" or "session" or "weekly_summary"
+	Hosts  []string // host ids for host-scoped messages, empty = all hosts
+}
+
+// MetricsHistoryResponse is returned by /api/v1/metrics/history and sent as
+// the metrics_history backfill to new monitor clients
+type MetricsHistoryResponse struct {
+	HostID      string         `json:"host_id"`
+	From        string         `json:"from"`
+	To          string         `json:"to"`
+	StepSeconds float64        `json:"step_seconds"`
+	Points      []HistoryPoint `json:"points"`
 }
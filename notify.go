@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ChannelSlack      = "slack"
+	ChannelDiscord    = "discord"
+	ChannelMattermost = "mattermost"
+)
+
+// NotificationChannel posts hub events, goal pings and scheduled summaries
+// to a chat incoming-webhook URL
+type NotificationChannel struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	URL  string `json:"url,omitempty"`
+	// Events are hub message types plus "goal"
+	Events []string `json:"events,omitempty"`
+	// Schedule posts a coding summary, daily ones cover the previous day
+	Schedule *Schedule `json:"schedule,omitempty"`
+	// Team restricts summaries and goal pings to one team
+	Team       string `json:"team,omitempty"`
+	DailyGoal  string `json:"daily_goal,omitempty"`
+	WeeklyGoal string `json:"weekly_goal,omitempty"`
+	Username   string `json:"username,omitempty"`
+	// Templates override the message body per event type, "summary" or "goal"
+	Templates map[string]string `json:"templates,omitempty"`
+
+	dailyGoal  time.Duration
+	weeklyGoal time.Duration
+	templates  map[string]*template.Template
+}
+
+// GoalEvent is the data of goal templates
+type GoalEvent struct {
+	User         string `json:"user"`
+	Team         string `json:"team,omitempty"`
+	Period       string `json:"period"`
+	GoalSeconds  int64  `json:"goal_seconds"`
+	TotalSeconds int64  `json:"total_seconds"`
+}
+
+var defaultTemplates = map[string]string{
+	"summary": `{{if not .Users}}No coding activity was tracked.{{else}}Total: {{duration .TotalSeconds}} by {{len .Users}} developer(s)
+{{range .Users}}
+• {{.User}}: {{duration .TotalSeconds}}{{if .TopLanguage}} ({{.TopLanguage}}{{if .TopProject}}, {{.TopProject}}{{end}}){{end}}{{end}}{{end}}`,
+	"goal":    `{{.User}} reached the {{.Period}} goal of {{duration .GoalSeconds}} with {{duration .TotalSeconds}} coded.`,
+	"alert":   `{{.Data.Rule}} {{.Data.State}} on {{.Data.HostID}}: {{.Data.Metric}} {{.Data.Comparator}} {{.Data.Threshold}} (value {{printf "%.1f" .Data.Value}})`,
+	"session": `{{.Data.User}} coded {{duration .Data.DurationSeconds}} of {{.Data.Language}} on {{.Data.Project}}`,
+	"":        `{{.Type}}: {{json .Data}}`,
+}
+
+var templateFuncs = template.FuncMap{
+	"duration": formatSeconds,
+	"json": func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	},
+}
+
+func (c *NotificationChannel) prepare() error {
+	switch c.Kind {
+	case ChannelSlack, ChannelDiscord, ChannelMattermost:
+	default:
+		return fmt.Errorf("channel %s: kind must be one of slack, discord, mattermost", c.Name)
+	}
+	if c.Name == "" || c.URL == "" {
+		return fmt.Errorf("channel %q: name and url are required", c.Name)
+	}
+
+	for field, spec := range map[string]string{"daily_goal": c.DailyGoal, "weekly_goal": c.WeeklyGoal} {
+		if spec == "" {
+			continue
+		}
+		d, err := time.ParseDuration(spec)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("channel %s: invalid %s %q", c.Name, field, spec)
+		}
+		if field == "daily_goal" {
+			c.dailyGoal = d
+		} else {
+			c.weeklyGoal = d
+		}
+	}
+
+	c.templates = make(map[string]*template.Template)
+	for event, text := range defaultTemplates {
+		if custom, ok := c.Templates[event]; ok {
+			text = custom
+		}
+		tmpl, err := template.New(event).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return fmt.Errorf("channel %s: template %q: %v", c.Name, event, err)
+		}
+		c.templates[event] = tmpl
+	}
+	for event, text := range c.Templates {
+		if _, ok := c.templates[event]; ok {
+			continue
+		}
+		tmpl, err := template.New(event).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return fmt.Errorf("channel %s: template %q: %v", c.Name, event, err)
+		}
+		c.templates[event] = tmpl
+	}
+	return nil
+}
+
+func (c *NotificationChannel) subscribed(event string) bool {
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *NotificationChannel) render(event string, data interface{}) (string, error) {
+	tmpl, ok := c.templates[event]
+	if !ok {
+		tmpl = c.templates[""]
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// payload wraps a message into the incoming-webhook format of the channel
+func (c *NotificationChannel) payload(title, body, color string, at time.Time) map[string]interface{} {
+	var p map[string]interface{}
+	switch c.Kind {
+	case ChannelSlack:
+		p = map[string]interface{}{
+			"text": title + ": " + body,
+			"blocks": []interface{}{
+				map[string]interface{}{
+					"type": "header",
+					"text": map[string]interface{}{"type": "plain_text", "text": truncate(title, 150)},
+				},
+				map[string]interface{}{
+					"type": "section",
+					"text": map[string]interface{}{"type": "mrkdwn", "text": truncate(body, 3000)},
+				},
+				map[string]interface{}{
+					"type": "context",
+					"elements": []interface{}{
+						map[string]interface{}{"type": "mrkdwn", "text": at.Format("Mon Jan 2 15:04 MST")},
+					},
+				},
+			},
+		}
+	case ChannelDiscord:
+		var rgb int64
+		fmt.Sscanf(color, "#%x", &rgb)
+		p = map[string]interface{}{
+			"embeds": []interface{}{
+				map[string]interface{}{
+					"title":       truncate(title, 256),
+					"description": truncate(body, 4096),
+					"color":       rgb,
+					"timestamp":   at.Format(time.RFC3339),
+				},
+			},
+		}
+	default:
+		p = map[string]interface{}{
+			"text": "#### " + title + "\n" + body,
+		}
+	}
+	if c.Username != "" {
+		p["username"] = c.Username
+	}
+	return p
+}
+
+// truncate shortens s to at most n bytes, cutting on a rune boundary
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	const ellipsis = "…"
+	cut := n - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	if cut < 0 {
+		cut = 0
+	}
+	return s[:cut] + ellipsis
+}
+
+// loadNotificationChannels reads the JSON array of channels in file, no file means no channels
+func loadNotificationChannels(file string) ([]*NotificationChannel, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []*NotificationChannel
+	if err := json.Unmarshal(data, &channels); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	names := make(map[string]bool)
+	for _, c := range channels {
+		if err := c.prepare(); err != nil {
+			return nil, err
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate channel %s", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return channels, nil
+}
+
+// Notifier formats hub events for the chat channels and runs their schedules
+type Notifier struct {
+	hub    *Hub
+	events chan BroadcastMessage
+	client *http.Client
+
+	channelsMutex sync.RWMutex
+	channels      []*NotificationChannel
+	// changed is closed when the channels are replaced, stopping their schedules
+	changed chan struct{}
+
+	mutex sync.Mutex
+	// achieved remembers goal pings already sent, keyed by channel, user and
+	// period, for the current day and week only
+	achieved    map[string]bool
+	achievedFor string
+}
+
+func newNotifier(file string, hub *Hub) (*Notifier, error) {
+	channels, err := loadNotificationChannels(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{
+		channels: channels,
+		changed:  make(chan struct{}),
+		hub:      hub,
+		events:   make(chan BroadcastMessage, 256),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		achieved: make(map[string]bool),
+	}, nil
+}
+
+// Publish is the hub listener
+func (n *Notifier) Publish(message BroadcastMessage) {
+	select {
+	case n.events <- message:
+	default:
+		notifyLog.Warn("Notification queue full, dropping event", "type", message.Type, "event_id", message.EventID)
+	}
+}
+
+// currentChannels returns the channels and the channel closed when they change
+func (n *Notifier) currentChannels() ([]*NotificationChannel, chan struct{}) {
+	n.channelsMutex.RLock()
+	defer n.channelsMutex.RUnlock()
+	return n.channels, n.changed
+}
+
+// SetChannels replaces the channels, restarting the summary schedules
+func (n *Notifier) SetChannels(channels []*NotificationChannel) {
+	n.channelsMutex.Lock()
+	n.channels = channels
+	close(n.changed)
+	n.changed = make(chan struct{})
+	n.channelsMutex.Unlock()
+}
+
+func (n *Notifier) runSchedules() {
+	for {
+		channels, changed := n.currentChannels()
+		for _, c := range channels {
+			if c.Schedule != nil {
+				go runSchedule(*c.Schedule, func(at time.Time) { n.sendSummary(c, at) }, changed)
+			}
+		}
+		<-changed
+	}
+}
+
+func (n *Notifier) run() {
+	go n.runSchedules()
+
+	for message := range n.events {
+		channels, _ := n.currentChannels()
+		for _, c := range channels {
+			if c.subscribed(message.Type) {
+				n.sendEvent(c, message)
+			}
+		}
+		if message.Type == "session" {
+			if session, ok := message.Data.(CodingSession); ok {
+				n.checkGoals(session)
+			}
+		}
+	}
+}
+
+func (n *Notifier) sendEvent(c *NotificationChannel, message BroadcastMessage) {
+	body, err := c.render(message.Type, message)
+	if err != nil {
+		notifyLog.Error("Failed to render notification", "channel", c.Name, "type", message.Type, "event_id", message.EventID, "error", err)
+		return
+	}
+
+	title := "Coding tracker: " + message.Type
+	color := "#1d9bd1"
+	if alert, ok := message.Data.(Alert); ok {
+		title = fmt.Sprintf("Alert %s: %s", alert.State, alert.Rule)
+		color = "#e01e5a"
+		if alert.State == AlertResolved {
+			color = "#2eb67d"
+		}
+	}
+	go n.post(c, c.payload(title, body, color, time.Now()))
+}
+
+// checkGoals pings the channels once per day and week when a user reaches a goal
+func (n *Notifier) checkGoals(session CodingSession) {
+	if session.User == "" {
+		return
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// the ISO week starts on Monday, like the key the pings are deduplicated by
+	weekStart := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	year, week := now.ISOWeek()
+	dayKey, weekKey := today.Format("2006-01-02"), fmt.Sprintf("%d-W%02d", year, week)
+	n.pruneAchieved(dayKey, weekKey)
+
+	var daily, weekly int64
+	var activity UserActivity
+	loaded := false
+
+	channels, _ := n.currentChannels()
+	for _, c := range channels {
+		if !c.subscribed("goal") || (c.dailyGoal == 0 && c.weeklyGoal == 0) {
+			continue
+		}
+		if !loaded {
+			daily = n.hub.TotalsBetween(today, now.Add(time.Second))[session.User]
+			weekly = n.hub.TotalsBetween(weekStart, now.Add(time.Second))[session.User]
+			activity = n.hub.leaderboard.Activity(session.User, today, now)
+			loaded = true
+		}
+		if activity.Privacy.HideFromLeaderboard {
+			return
+		}
+		if c.Team != "" && !strings.EqualFold(activity.Team, c.Team) {
+			continue
+		}
+
+		goals := []struct {
+			period string
+			goal   time.Duration
+			total  int64
+			key    string
+		}{
+			{"daily", c.dailyGoal, daily, dayKey},
+			{"weekly", c.weeklyGoal, weekly, weekKey},
+		}
+		for _, g := range goals {
+			if g.goal == 0 || g.total < int64(g.goal.Seconds()) {
+				continue
+			}
+			key := c.Name + "|" + session.User + "|" + g.period + "|" + g.key
+			n.mutex.Lock()
+			sent := n.achieved[key]
+			n.achieved[key] = true
+			n.mutex.Unlock()
+			if sent {
+				continue
+			}
+
+			event := GoalEvent{
+				User:         session.User,
+				Team:         activity.Team,
+				Period:       g.period,
+				GoalSeconds:  int64(g.goal.Seconds()),
+				TotalSeconds: g.total,
+			}
+			body, err := c.render("goal", event)
+			if err != nil {
+				notifyLog.Error("Failed to render goal notification", "channel", c.Name, "error", err)
+				continue
+			}
+			go n.post(c, c.payload("Goal reached 🎉", body, "#2eb67d", now))
+		}
+	}
+}
+
+// pruneAchieved forgets the goal pings of past days and weeks once a new day starts
+func (n *Notifier) pruneAchieved(dayKey, weekKey string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.achievedFor == dayKey {
+		return
+	}
+	n.achievedFor = dayKey
+	for key := range n.achieved {
+		if !strings.HasSuffix(key, "|"+dayKey) && !strings.HasSuffix(key, "|"+weekKey) {
+			delete(n.achieved, key)
+		}
+	}
+}
+
+func (n *Notifier) sendSummary(c *NotificationChannel, at time.Time) {
+	schedule := Schedule{}
+	if c.Schedule != nil {
+		schedule = *c.Schedule
+	}
+	from, to := schedule.Period(at)
+	summary := buildSummary(n.hub, from, to, c.Team)
+
+	body, err := c.render("summary", summary)
+	if err != nil {
+		notifyLog.Error("Failed to render summary", "channel", c.Name, "error", err)
+		return
+	}
+
+	title := "Yesterday's coding summary"
+	if schedule.Weekly {
+		title = "Coding summary of the last 7 days"
+	}
+	if c.Team != "" {
+		title += " · " + c.Team
+	}
+	n.post(c, c.payload(title, body, "#1d9bd1", at))
+}
+
+// post sends a payload, retrying twice on failure
+func (n *Notifier) post(c *NotificationChannel, payload map[string]interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		notifyLog.Error("Failed to marshal notification", "channel", c.Name, "error", err)
+		return
+	}
+
+	backoff := 2 * time.Second
+	for attempt := 1; ; attempt++ {
+		res, err := n.client.Post(c.URL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				notificationsSent.Inc(c.Name, "success")
+				return
+			}
+			err = fmt.Errorf("unexpected status %s", res.Status)
+		}
+
+		if attempt == 3 {
+			notifyLog.Warn("Failed to notify", "channel", c.Name, "error", err)
+			notificationsSent.Inc(c.Name, "failure")
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Channel returns a configured channel by name
+func (n *Notifier) Channel(name string) (*NotificationChannel, bool) {
+	channels, _ := n.currentChannels()
+	for _, c := range channels {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Channels lists the channels without their webhook URLs
+func (n *Notifier) Channels() []NotificationChannel {
+	channels, _ := n.currentChannels()
+	list := make([]NotificationChannel, 0, len(channels))
+	for _, c := range channels {
+		public := *c
+		public.URL = ""
+		list = append(list, public)
+	}
+	return list
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceIdle    = "idle"
+	PresenceOffline = "offline"
+)
+
+// UserPresence is returned by /api/v1/presence and sent in `presence` hub messages
+type UserPresence struct {
+	User          string `json:"user"`
+	Team          string `json:"team,omitempty"`
+	State         string `json:"state"`
+	PreviousState string `json:"previous_state,omitempty"`
+	Project       string `json:"project,omitempty"`
+	Language      string `json:"language,omitempty"`
+	Editor        string `json:"editor,omitempty"`
+	Since         string `json:"since"`
+	LastActivity  string `json:"last_activity,omitempty"`
+	Connections   int    `json:"connections"`
+}
+
+type presenceState struct {
+	team         string
+	state        string
+	project      string
+	language     string
+	editor       string
+	since        time.Time
+	lastActivity time.Time
+	connections  int
+}
+
+// Presence tracks which users are coding right now based on tracking connections
+type Presence struct {
+	mutex sync.Mutex
+	users map[string]*presenceState
+
+	// idleAfter is how long a connected user may be inactive before becoming idle
+	idleAfter time.Duration
+
+	// forgetAfter is how long offline users stay listed
+	forgetAfter time.Duration
+
+	publish func(UserPresence)
+	privacy func(user string) UserPrivacy
+}
+
+func newPresence(idleAfter time.Duration, publish func(UserPresence), privacy func(user string) UserPrivacy) *Presence {
+	return &Presence{
+		users:       make(map[string]*presenceState),
+		idleAfter:   idleAfter,
+		forgetAfter: 24 * time.Hour,
+		publish:     publish,
+		privacy:     privacy,
+	}
+}
+
+// SetIdleAfter changes the inactivity after which users are shown idle
+func (p *Presence) SetIdleAfter(d time.Duration) {
+	p.mutex.Lock()
+	p.idleAfter = d
+	p.mutex.Unlock()
+}
+
+// run demotes inactive users to idle and forgets users that have been offline for long
+func (p *Presence) run() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var events []UserPresence
+
+		p.mutex.Lock()
+		for user, st := range p.users {
+			switch {
+			case st.state == PresenceOnline && now.Sub(st.lastActivity) >= p.idleAfter:
+				events = append(events, p.transition(user, st, PresenceIdle, now))
+			case st.state == PresenceOffline && now.Sub(st.since) >= p.forgetAfter:
+				delete(p.users, user)
+			}
+		}
+		p.mutex.Unlock()
+
+		p.emit(events)
+	}
+}
+
+// Connect registers a tracking connection for user
+func (p *Presence) Connect(user, team string) {
+	now := time.Now()
+
+	p.mutex.Lock()
+	st := p.state(user, now)
+	if team != "" {
+		st.team = team
+	}
+	st.connections++
+	var events []UserPresence
+	if st.state == PresenceOffline {
+		st.lastActivity = now
+		events = append(events, p.transition(user, st, PresenceOnline, now))
+	}
+	p.mutex.Unlock()
+
+	p.emit(events)
+}
+
+// Disconnect removes a tracking connection; the user goes offline with the last one
+func (p *Presence) Disconnect(user string) {
+	now := time.Now()
+
+	p.mutex.Lock()
+	var events []UserPresence
+	if st, ok := p.users[user]; ok && st.connections > 0 {
+		st.connections--
+		if st.connections == 0 {
+			events = append(events, p.transition(user, st, PresenceOffline, now))
+		}
+	}
+	p.mutex.Unlock()
+
+	p.emit(events)
+}
+
+// Activity records a session or heartbeat from user
+func (p *Presence) Activity(user, team, project, language, editor string) {
+	now := time.Now()
+
+	p.mutex.Lock()
+	st := p.state(user, now)
+	if team != "" {
+		st.team = team
+	}
+	st.lastActivity = now
+
+	changed := st.project != project || st.language != language || st.editor != editor
+	st.project = project
+	st.language = language
+	st.editor = editor
+
+	var events []UserPresence
+	if st.state != PresenceOnline && st.connections > 0 {
+		events = append(events, p.transition(user, st, PresenceOnline, now))
+	} else if changed && st.state == PresenceOnline {
+		events = append(events, p.view(user, st, ""))
+	}
+	p.mutex.Unlock()
+
+	p.emit(events)
+}
+
+// state returns the entry for user, creating an offline one; callers must hold the lock
+func (p *Presence) state(user string, now time.Time) *presenceState {
+	st, ok := p.users[user]
+	if !ok {
+		st = &presenceState{state: PresenceOffline, since: now}
+		p.users[user] = st
+	}
+	return st
+}
+
+// transition moves user to state; callers must hold the lock
+func (p *Presence) transition(user string, st *presenceState, state string, now time.Time) UserPresence {
+	previous := st.state
+	st.state = state
+	st.since = now
+	return p.view(user, st, previous)
+}
+
+func (p *Presence) view(user string, st *presenceState, previous string) UserPresence {
+	view := UserPresence{
+		User:          user,
+		Team:          st.team,
+		State:         st.state,
+		PreviousState: previous,
+		Project:       st.project,
+		Language:      st.language,
+		Editor:        st.editor,
+		Since:         st.since.Format(time.RFC3339),
+		Connections:   st.connections,
+	}
+	if !st.lastActivity.IsZero() {
+		view.LastActivity = st.lastActivity.Format(time.RFC3339)
+	}
+	if p.privacy != nil && p.privacy(user).HideDetails {
+		view.Project = ""
+		view.Language = ""
+	}
+	return view
+}
+
+func (p *Presence) emit(events []UserPresence) {
+	for _, event := range events {
+		p.publish(event)
+	}
+}
+
+// List returns presence for all known users, optionally restricted to a team and state
+func (p *Presence) List(team, state string) []UserPresence {
+	p.mutex.Lock()
+	list := make([]UserPresence, 0, len(p.users))
+	for user, st := range p.users {
+		if team != "" && !strings.EqualFold(st.team, team) {
+			continue
+		}
+		if state != "" && st.state != state {
+			continue
+		}
+		list = append(list, p.view(user, st, ""))
+	}
+	p.mutex.Unlock()
+
+	order := map[string]int{PresenceOnline: 0, PresenceIdle: 1, PresenceOffline: 2}
+	sort.Slice(list, func(i, j int) bool {
+		if order[list[i].State] != order[list[j].State] {
+			return order[list[i].State] < order[list[j].State]
+		}
+		return list[i].User < list[j].User
+	})
+
+	return list
+}
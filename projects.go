@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RoundingRule rounds the tracked time of each timesheet line to a multiple
+// of IncrementMinutes, e.g. 15 minutes rounded up
+type RoundingRule struct {
+	IncrementMinutes int    `json:"increment_minutes"`
+	Mode             string `json:"mode"` // up, down or nearest
+}
+
+func (rule RoundingRule) apply(seconds int64) int64 {
+	if rule.IncrementMinutes <= 0 || seconds <= 0 {
+		return seconds
+	}
+	step := float64(rule.IncrementMinutes * 60)
+	units := float64(seconds) / step
+	switch rule.Mode {
+	case "down":
+		units = math.Floor(units)
+	case "nearest":
+		units = math.Round(units)
+	default:
+		units = math.Ceil(units)
+	}
+	return int64(units * step)
+}
+
+// ProjectInfo is the billing metadata of a tracked project
+type ProjectInfo struct {
+	Name       string       `json:"name"`
+	Client     string       `json:"client"`
+	Billable   bool         `json:"billable"`
+	HourlyRate float64      `json:"hourly_rate"`
+	Currency   string       `json:"currency"`
+	Rounding   RoundingRule `json:"rounding"`
+}
+
+// unassignedClient groups projects without metadata in timesheets
+const unassignedClient = "Unassigned"
+
+func validateProject(p *ProjectInfo) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if p.HourlyRate < 0 {
+		return fmt.Errorf("hourly_rate must not be negative")
+	}
+	if p.Rounding.IncrementMinutes < 0 {
+		return fmt.Errorf("rounding increment_minutes must not be negative")
+	}
+	switch p.Rounding.Mode {
+	case "":
+		p.Rounding.Mode = "up"
+	case "up", "down", "nearest":
+	default:
+		return fmt.Errorf("rounding mode must be one of up, down, nearest")
+	}
+	if p.Client == "" {
+		p.Client = unassignedClient
+	}
+	if p.Currency == "" {
+		p.Currency = "USD"
+	}
+	p.Currency = strings.ToUpper(p.Currency)
+	return nil
+}
+
+// ProjectCatalog keeps project metadata in the data directory, keyed by the
+// project name editors report
+type ProjectCatalog struct {
+	mu       sync.RWMutex
+	path     string
+	projects map[string]ProjectInfo
+}
+
+func newProjectCatalog() (*ProjectCatalog, error) {
+	c := &ProjectCatalog{
+		path:     filepath.Join(dataDir, "projects.json"),
+		projects: make(map[string]ProjectInfo),
+	}
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	var projects []ProjectInfo
+	if err := readJSONFile(c.path, &projects); err != nil {
+		return nil, err
+	}
+	for _, p := range projects {
+		c.projects[p.Name] = p
+	}
+	return c, nil
+}
+
+func (c *ProjectCatalog) save() error {
+	return writeJSONFile(c.path, c.list())
+}
+
+func (c *ProjectCatalog) list() []ProjectInfo {
+	projects := make([]ProjectInfo, 0, len(c.projects))
+	for _, p := range c.projects {
+		projects = append(projects, p)
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+	return projects
+}
+
+// List returns all projects with metadata sorted by name
+func (c *ProjectCatalog) List() []ProjectInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.list()
+}
+
+// Get returns the metadata of a project
+func (c *ProjectCatalog) Get(name string) (ProjectInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	p, ok := c.projects[name]
+	return p, ok
+}
+
+// Put creates or replaces the metadata of a project
+func (c *ProjectCatalog) Put(p ProjectInfo) (ProjectInfo, error) {
+	if err := validateProject(&p); err != nil {
+		return ProjectInfo{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.projects[p.Name] = p
+	return p, c.save()
+}
+
+// Delete removes the metadata of a project, its sessions stay tracked
+func (c *ProjectCatalog) Delete(name string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.projects[name]; !ok {
+		return false, nil
+	}
+	delete(c.projects, name)
+	return true, c.save()
+}
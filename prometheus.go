@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// promRegistry renders registered metrics in the Prometheus text exposition format
+type promRegistry struct {
+	mutex   sync.Mutex
+	metrics []promMetric
+}
+
+type promMetric interface {
+	writeTo(w io.Writer)
+}
+
+var registry = &promRegistry{}
+
+// Server internals
+var (
+	hubMessagesBroadcast = registry.counter("tracker_hub_messages_broadcast_total",
+		"Messages broadcast by the hub.", "type")
+	hubMessagesDelivered = registry.counter("tracker_hub_messages_delivered_total",
+		"Messages written to hub clients.", "type")
+	hubMessagesDropped = registry.counter("tracker_hub_messages_dropped_total",
+		"Messages that could not be delivered to a hub client.", "type")
+
+	sessionsReceived = registry.counter("tracker_sessions_received_total",
+		"Coding sessions received on /ws/track.")
+	sessionsRejected = registry.counter("tracker_sessions_rejected_total",
+		"Coding sessions rejected on /ws/track.", "reason")
+	sessionsIndexed = registry.counter("tracker_sessions_indexed_total",
+		"Coding sessions indexed into Elasticsearch.")
+
+	esIndexFailures = registry.counter("tracker_elasticsearch_index_failures_total",
+		"Elasticsearch index requests that failed.", "index")
+	esIndexTimeouts = registry.counter("tracker_elasticsearch_index_timeouts_total",
+		"Elasticsearch index requests that timed out.", "index")
+	esIndexDuration = registry.histogram("tracker_elasticsearch_index_duration_seconds",
+		"Latency of Elasticsearch index requests.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}, "index")
+
+	webhookDeliveries = registry.counter("tracker_webhook_deliveries_total",
+		"Webhook delivery attempts by result (success, failure, dropped).", "result")
+	notificationsSent = registry.counter("tracker_notifications_total",
+		"Chat notifications posted by channel and result.", "channel", "result")
+	emailReports = registry.counter("tracker_email_reports_total",
+		"Email reports sent by result.", "result")
+
+	// codingSeconds is only populated when metrics.session_labels is set, as
+	// language and project labels can have a high cardinality
+	codingSeconds = registry.counter("tracker_coding_seconds_total",
+		"Tracked coding time.", "language", "project")
+)
+
+func init() {
+	registry.gaugeFunc("go_goroutines", "Number of goroutines that currently exist.", nil,
+		func() []promSample {
+			return []promSample{{Value: float64(runtime.NumGoroutine())}}
+		})
+	registry.gaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", nil,
+		func() []promSample {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			return []promSample{{Value: float64(ms.Alloc)}}
+		})
+}
+
+// registerHubMetrics exposes gauges computed from the hub state at scrape time
+func registerHubMetrics(hub *Hub) {
+	registry.gaugeFunc("tracker_hub_clients", "Connected hub clients by subscription filter.", []string{"filter"},
+		func() []promSample {
+			counts := make(map[string]int)
+			hub.mutex.RLock()
+			for _, filter := range hub.clients {
+				counts[filter]++
+			}
+			hub.mutex.RUnlock()
+
+			samples := make([]promSample, 0, len(counts))
+			for filter, n := range counts {
+				samples = append(samples, promSample{Labels: []string{filter}, Value: float64(n)})
+			}
+			return samples
+		})
+	registry.gaugeFunc("tracker_hub_broadcast_queue_length", "Messages waiting in the hub broadcast queue.", nil,
+		func() []promSample {
+			return []promSample{{Value: float64(len(hub.broadcast))}}
+		})
+	registry.gaugeFunc("tracker_hub_broadcast_queue_capacity", "Capacity of the hub broadcast queue.", nil,
+		func() []promSample {
+			return []promSample{{Value: float64(cap(hub.broadcast))}}
+		})
+	registry.gaugeFunc("tracker_alerts_firing", "Firing alerts by severity.", []string{"severity"},
+		func() []promSample {
+			if hub.alerts == nil {
+				return nil
+			}
+			var samples []promSample
+			for severity, n := range hub.alerts.Firing() {
+				samples = append(samples, promSample{Labels: []string{severity}, Value: float64(n)})
+			}
+			return samples
+		})
+}
+
+func (r *promRegistry) add(m promMetric) {
+	r.mutex.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mutex.Unlock()
+}
+
+func (r *promRegistry) counter(name, help string, labels ...string) *promVec {
+	v := newPromVec(name, help, "counter", labels)
+	r.add(v)
+	return v
+}
+
+func (r *promRegistry) gaugeFunc(name, help string, labels []string, collect func() []promSample) {
+	r.add(&promFunc{name: name, help: help, kind: "gauge", labels: labels, collect: collect})
+}
+
+// counterFunc exposes counters maintained elsewhere, such as kernel IO counters
+func (r *promRegistry) counterFunc(name, help string, labels []string, collect func() []promSample) {
+	r.add(&promFunc{name: name, help: help, kind: "counter", labels: labels, collect: collect})
+}
+
+func (r *promRegistry) histogram(name, help string, buckets []float64, labels ...string) *promHistogram {
+	h := &promHistogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.add(h)
+	return h
+}
+
+func (r *promRegistry) Write(w io.Writer) {
+	r.mutex.Lock()
+	metrics := append([]promMetric(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeTo(bw)
+	}
+	bw.Flush()
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.Write(w)
+	hostRegistry.Write(w)
+}
+
+// promSample is a single labelled value, label values in declaration order
+type promSample struct {
+	Labels []string
+	Value  float64
+}
+
+// promVec is a counter with a fixed set of label names
+type promVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]*promSample
+}
+
+func newPromVec(name, help, kind string, labels []string) *promVec {
+	return &promVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*promSample),
+	}
+}
+
+func (v *promVec) sample(labelValues []string) *promSample {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &promSample{Labels: append([]string(nil), labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+func (v *promVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *promVec) Add(delta float64, labelValues ...string) {
+	v.mutex.Lock()
+	v.sample(labelValues).Value += delta
+	v.mutex.Unlock()
+}
+
+func (v *promVec) writeTo(w io.Writer) {
+	v.mutex.Lock()
+	samples := make([]promSample, 0, len(v.values))
+	for _, s := range v.values {
+		samples = append(samples, *s)
+	}
+	v.mutex.Unlock()
+
+	if len(samples) == 0 && len(v.labels) == 0 {
+		samples = append(samples, promSample{})
+	}
+	writeSamples(w, v.name, v.help, v.kind, v.labels, samples)
+}
+
+// promFunc is a gauge or counter whose samples are computed at scrape time
+type promFunc struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	collect func() []promSample
+}
+
+func (f *promFunc) writeTo(w io.Writer) {
+	writeSamples(w, f.name, f.help, f.kind, f.labels, f.collect())
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type promHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+func (h *promHistogram) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *promHistogram) writeTo(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, escapeHelp(h.help), h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			values := append(append([]string(nil), s.labels...), formatFloat(upper))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, values), s.counts[i])
+		}
+		values := append(append([]string(nil), s.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+func writeSamples(w io.Writer, name, help, kind string, labels []string, samples []promSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, kind)
+
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, s.Labels), formatFloat(s.Value))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// restartSettings are read once at startup; a reload keeps their running
+// values and reports them instead of applying them
+var restartSettings = []string{
+	"server.port",
+	"server.data_dir",
+	"elasticsearch.url",
+	"hub.broadcast_buffer",
+	"hosts.host_id",
+	"metrics.rollup_window",
+	"tracing.exporter",
+	"tracing.endpoint",
+	"tracing.service_name",
+	"tracing.sample_ratio",
+}
+
+// ReloadResult lists the settings a reload changed
+type ReloadResult struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+// Reloader re-reads the configuration the server was started with and
+// applies it to the running subsystems. Everything that can fail is loaded
+// before anything is applied, so an invalid configuration leaves the server
+// running unchanged on the old one.
+type Reloader struct {
+	mutex    sync.Mutex
+	args     []string
+	hub      *Hub
+	webhooks *WebhookDispatcher
+	notifier *Notifier
+	reporter *Reporter
+}
+
+func (rl *Reloader) Reload() (ReloadResult, error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	cfg, _, err := loadConfig("server", rl.args)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	rules, err := loadAlertRules(cfg.Alerts.RulesFile)
+	if err != nil {
+		return ReloadResult{}, fmt.Errorf("alerts.rules_file: %v", err)
+	}
+	channels, err := loadNotificationChannels(cfg.Notifications.ChannelsFile)
+	if err != nil {
+		return ReloadResult{}, fmt.Errorf("notifications.channels_file: %v", err)
+	}
+	reportSettings, err := newReportSettings(cfg.Reports, cfg.Server.PublicURLOrDefault())
+	if err != nil {
+		return ReloadResult{}, fmt.Errorf("reports: %v", err)
+	}
+
+	old := currentConfig()
+	result := ReloadResult{Changed: []string{}}
+	oldFields := configFields(old)
+	restart := make(map[string]bool)
+	for _, path := range restartSettings {
+		restart[path] = true
+	}
+	for i, f := range configFields(cfg) {
+		if reflect.DeepEqual(f.value.Interface(), oldFields[i].value.Interface()) {
+			continue
+		}
+		if restart[f.path] {
+			result.RestartRequired = append(result.RestartRequired, f.path)
+			f.value.Set(oldFields[i].value)
+			continue
+		}
+		result.Changed = append(result.Changed, f.path)
+	}
+
+	activeConfig.Store(cfg)
+	configureLogging(cfg.Logging)
+	localCollector.Configure(cfg.Metrics)
+	rl.hub.presence.SetIdleAfter(cfg.Presence.IdleAfter)
+	applyOptOut(rl.hub, cfg.Leaderboard.OptOut)
+	rl.hub.alerts.SetRules(rules)
+	rl.webhooks.SetPolicy(cfg.Webhooks)
+	rl.notifier.SetChannels(channels)
+	rl.reporter.SetSettings(reportSettings)
+
+	return result, nil
+}
+
+// applyOptOut hides the users listed in leaderboard.opt_out, users
+// removed from it only show up again if they did not opt out themselves
+func applyOptOut(hub *Hub, users []string) {
+	if update, changed := hub.leaderboard.SetOptOut(users); changed {
+		hub.broadcast <- BroadcastMessage{
+			Type:    "leaderboard",
+			Data:    update,
+			EventID: time.Now().Format("20060102150405"),
+		}
+	}
+}
+
+// reloadAndLog runs a reload and logs its outcome
+func (rl *Reloader) reloadAndLog(trigger string) (ReloadResult, error) {
+	result, err := rl.Reload()
+	if err != nil {
+		configLog.Error("Configuration reload rejected, keeping the current configuration", "trigger", trigger, "error", err)
+		return result, err
+	}
+	configLog.Info("Configuration reloaded", "trigger", trigger, "changed", result.Changed)
+	if len(result.RestartRequired) > 0 {
+		configLog.Warn("Some changes take effect after a restart", "settings", result.RestartRequired)
+	}
+	return result, nil
+}
+
+// watchSignals reloads on every SIGHUP
+func (rl *Reloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		rl.reloadAndLog("SIGHUP")
+	}
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request, reloader *Reloader) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	result, err := reloader.reloadAndLog("admin API")
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":           "reloaded",
+		"changed":          result.Changed,
+		"restart_required": result.RestartRequired,
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rollupIndex receives one document per host and window; it replaces the raw
+// point samples that used to go to system-metrics
+const rollupIndex = "system-metrics-rollups"
+
+// RollupStat is the min/avg/max of one metric within a window
+type RollupStat struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// MetricsRollup is the document indexed for a host and window
+type MetricsRollup struct {
+	HostID      string                `json:"host_id"`
+	Hostname    string                `json:"hostname,omitempty"`
+	OS          string                `json:"os,omitempty"`
+	Platform    string                `json:"platform,omitempty"`
+	Kernel      string                `json:"kernel,omitempty"`
+	Arch        string                `json:"arch,omitempty"`
+	WindowStart string                `json:"window_start"`
+	WindowEnd   string                `json:"window_end"`
+	Samples     int                   `json:"samples"`
+	Metrics     map[string]RollupStat `json:"metrics"`
+}
+
+// rollupFields are the metrics aggregated per window, shared with the history points
+var rollupFields = []struct {
+	name  string
+	value func(HistoryPoint) float64
+}{
+	{"cpu", func(p HistoryPoint) float64 { return p.CPU }},
+	{"memory", func(p HistoryPoint) float64 { return p.Memory }},
+	{"used_mem_bytes", func(p HistoryPoint) float64 { return p.UsedMemBytes }},
+	{"load1", func(p HistoryPoint) float64 { return p.Load1 }},
+	{"swap_percent", func(p HistoryPoint) float64 { return p.SwapPercent }},
+	{"net_rx_bytes_per_sec", func(p HistoryPoint) float64 { return p.NetRxRate }},
+	{"net_tx_bytes_per_sec", func(p HistoryPoint) float64 { return p.NetTxRate }},
+	{"disk_read_bytes_per_sec", func(p HistoryPoint) float64 { return p.DiskRead }},
+	{"disk_write_bytes_per_sec", func(p HistoryPoint) float64 { return p.DiskWrite }},
+	{"container_cpu_percent", func(p HistoryPoint) float64 { return p.ContainerCPU }},
+	{"container_memory_bytes", func(p HistoryPoint) float64 { return p.ContainerMem }},
+}
+
+type rollupAccumulator struct {
+	start   time.Time
+	latest  SystemMetrics
+	samples int
+	min     []float64
+	max     []float64
+	sum     []float64
+}
+
+func (a *rollupAccumulator) add(m SystemMetrics, at time.Time) {
+	p := pointFromMetrics(m, at)
+	for i, field := range rollupFields {
+		v := field.value(p)
+		if a.samples == 0 || v < a.min[i] {
+			a.min[i] = v
+		}
+		if a.samples == 0 || v > a.max[i] {
+			a.max[i] = v
+		}
+		a.sum[i] += v
+	}
+	a.samples++
+	a.latest = m
+}
+
+func (a *rollupAccumulator) rollup(window time.Duration) MetricsRollup {
+	r := MetricsRollup{
+		HostID:      a.latest.HostID,
+		Hostname:    a.latest.Hostname,
+		OS:          a.latest.OS,
+		Platform:    a.latest.Platform,
+		Kernel:      a.latest.Kernel,
+		Arch:        a.latest.Arch,
+		WindowStart: a.start.Format(time.RFC3339),
+		WindowEnd:   a.start.Add(window).Format(time.RFC3339),
+		Samples:     a.samples,
+		Metrics:     make(map[string]RollupStat, len(rollupFields)),
+	}
+	for i, field := range rollupFields {
+		r.Metrics[field.name] = RollupStat{
+			Min: a.min[i],
+			Avg: a.sum[i] / float64(a.samples),
+			Max: a.max[i],
+		}
+	}
+	return r
+}
+
+// MetricsRollups aggregates every host sample into wall-clock aligned windows
+// and indexes one rollup per host when its window closes
+type MetricsRollups struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	current map[string]*rollupAccumulator
+	es      *ESClient
+}
+
+func newMetricsRollups(es *ESClient, window time.Duration) *MetricsRollups {
+	return &MetricsRollups{
+		window:  window,
+		current: make(map[string]*rollupAccumulator),
+		es:      es,
+	}
+}
+
+func (r *MetricsRollups) Add(m SystemMetrics, at time.Time) {
+	start := at.Truncate(r.window)
+
+	r.mutex.Lock()
+	acc, ok := r.current[m.HostID]
+	var closed *rollupAccumulator
+	if ok && !acc.start.Equal(start) {
+		closed = acc
+		ok = false
+	}
+	if !ok {
+		acc = &rollupAccumulator{
+			start: start,
+			min:   make([]float64, len(rollupFields)),
+			max:   make([]float64, len(rollupFields)),
+			sum:   make([]float64, len(rollupFields)),
+		}
+		r.current[m.HostID] = acc
+	}
+	acc.add(m, at)
+	r.mutex.Unlock()
+
+	if closed != nil {
+		rollup := closed.rollup(r.window)
+		r.es.Background(func() { r.index(rollup) })
+	}
+}
+
+// run closes windows of hosts that stopped reporting
+func (r *MetricsRollups) run() {
+	ticker := time.NewTicker(r.window / 4)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		r.flush(func(acc *rollupAccumulator) bool {
+			// leave a little slack for samples still in flight
+			return now.After(acc.start.Add(r.window + r.window/4))
+		})
+	}
+}
+
+// Flush indexes all open windows, used on shutdown
+func (r *MetricsRollups) Flush() {
+	r.flush(func(*rollupAccumulator) bool { return true })
+}
+
+func (r *MetricsRollups) flush(due func(*rollupAccumulator) bool) {
+	var closed []*rollupAccumulator
+
+	r.mutex.Lock()
+	for host, acc := range r.current {
+		if due(acc) {
+			closed = append(closed, acc)
+			delete(r.current, host)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, acc := range closed {
+		r.index(acc.rollup(r.window))
+	}
+}
+
+func (r *MetricsRollups) index(rollup MetricsRollup) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.es.IndexMetricsRollup(ctx, rollup)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			rollupsLog.Error("Failed to index metrics rollup", "host", rollup.HostID, "index", rollupIndex, "error", err)
+		}
+	case <-ctx.Done():
+		rollupsLog.Error("Metrics rollup indexing timed out", "host", rollup.HostID, "index", rollupIndex)
+		esIndexTimeouts.Inc(rollupIndex)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is a recurring local time, written as "daily HH:MM" or
+// "weekly <weekday> HH:MM" (weekday as mon, tue, ...)
+type Schedule struct {
+	Weekly  bool
+	Weekday time.Weekday
+	Hour    int
+	Minute  int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseSchedule(spec string) (Schedule, error) {
+	fields := strings.Fields(strings.ToLower(spec))
+
+	var s Schedule
+	var clock string
+	switch {
+	case len(fields) == 2 && fields[0] == "daily":
+		clock = fields[1]
+	case len(fields) == 3 && fields[0] == "weekly":
+		day, ok := weekdays[fields[1][:min(3, len(fields[1]))]]
+		if !ok {
+			return Schedule{}, fmt.Errorf("schedule %q: unknown weekday %q", spec, fields[1])
+		}
+		s.Weekly = true
+		s.Weekday = day
+		clock = fields[2]
+	default:
+		return Schedule{}, fmt.Errorf("schedule %q: expected \"daily HH:MM\" or \"weekly mon HH:MM\"", spec)
+	}
+
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return Schedule{}, fmt.Errorf("schedule %q: invalid time %q", spec, clock)
+	}
+	s.Hour, s.Minute = t.Hour(), t.Minute()
+	return s, nil
+}
+
+func (s Schedule) String() string {
+	if s.Weekly {
+		return fmt.Sprintf("weekly %s %02d:%02d", strings.ToLower(s.Weekday.String()[:3]), s.Hour, s.Minute)
+	}
+	return fmt.Sprintf("daily %02d:%02d", s.Hour, s.Minute)
+}
+
+func (s Schedule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Schedule) UnmarshalJSON(data []byte) error {
+	var spec string
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	parsed, err := parseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// Next returns the first occurrence strictly after t, in t's location
+func (s Schedule) Next(t time.Time) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), s.Hour, s.Minute, 0, 0, t.Location())
+	if s.Weekly {
+		next = next.AddDate(0, 0, (int(s.Weekday)-int(next.Weekday())+7)%7)
+	}
+	for !next.After(t) {
+		if s.Weekly {
+			next = next.AddDate(0, 0, 7)
+		} else {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+// Period is the time range a report sent at t covers: the previous calendar
+// day for daily schedules, the last 7 days for weekly ones
+func (s Schedule) Period(t time.Time) (time.Time, time.Time) {
+	if s.Weekly {
+		return t.AddDate(0, 0, -7), t
+	}
+	today := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return today.AddDate(0, 0, -1), today
+}
+
+// runSchedule calls fn at every occurrence of s until stop is closed
+func runSchedule(s Schedule, fn func(at time.Time), stop <-chan struct{}) {
+	for {
+		next := s.Next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			fn(next)
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// shutdown stops the server in order: refuse new connections, deliver the
+// queued broadcasts, close the WebSocket clients with a reconnect hint, stop
+// sampling and alerting, then write out what is still pending. Steps still
+// running at the deadline are abandoned.
+func shutdown(server *http.Server, hub *Hub, es *ESClient, webhooks *WebhookDispatcher, stopTracing func(context.Context) error) {
+	cfg := currentConfig().Server
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	step := func(name string, err error) {
+		if err != nil {
+			serverLog.Warn("Shutdown step incomplete", "step", name, "error", err)
+		}
+	}
+
+	step("stopping the HTTP server", server.Shutdown(ctx))
+	step("flushing broadcasts", hub.Flush(ctx))
+	step("closing WebSocket connections", wsConns.Close(ctx, cfg.ReconnectAfter))
+	hub.StopProducers()
+	step("stopping the hub", hub.Stop(ctx))
+
+	if hub.rollups != nil {
+		hub.rollups.Flush()
+	}
+	webhooks.Flush()
+	if hub.alerts != nil {
+		step("closing the alert history", hub.alerts.Close())
+	}
+	if es != nil {
+		step("waiting for Elasticsearch writes", es.Wait(ctx))
+	}
+	step("flushing spans", stopTracing(ctx))
+
+	serverLog.Info("Shutdown complete")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UserSummary is one user's line of a coding summary
+type UserSummary struct {
+	User         string `json:"user"`
+	Team         string `json:"team,omitempty"`
+	TotalSeconds int64  `json:"total_seconds"`
+	WeekSeconds  int64  `json:"week_seconds"`
+	TopLanguage  string `json:"top_language,omitempty"`
+	TopProject   string `json:"top_project,omitempty"`
+}
+
+// CodingSummary is the coding time of all users within a period, used by the
+// chat notifications and email reports
+type CodingSummary struct {
+	From         string           `json:"from"`
+	To           string           `json:"to"`
+	Team         string           `json:"team,omitempty"`
+	TotalSeconds int64            `json:"total_seconds"`
+	Users        []UserSummary    `json:"users"`
+	Languages    map[string]int64 `json:"languages"`
+	Projects     map[string]int64 `json:"projects"`
+}
+
+// buildSummary combines the hub session totals with the leaderboard details.
+// Users hidden from the leaderboard are left out, HideDetails drops their
+// languages and projects.
+func buildSummary(hub *Hub, from, to time.Time, team string) CodingSummary {
+	summary := CodingSummary{
+		From:      from.Format(time.RFC3339),
+		To:        to.Format(time.RFC3339),
+		Team:      team,
+		Users:     []UserSummary{},
+		Languages: make(map[string]int64),
+		Projects:  make(map[string]int64),
+	}
+
+	weekly := hub.GetAllWeeklyTotals()
+	for user, seconds := range hub.TotalsBetween(from, to) {
+		activity := hub.leaderboard.Activity(user, from, to)
+		if activity.Privacy.HideFromLeaderboard {
+			continue
+		}
+		if team != "" && !strings.EqualFold(activity.Team, team) {
+			continue
+		}
+
+		entry := UserSummary{
+			User:         user,
+			Team:         activity.Team,
+			TotalSeconds: seconds,
+			WeekSeconds:  weekly[user],
+		}
+		if !activity.Privacy.HideDetails {
+			entry.TopLanguage = topKey(activity.Languages)
+			entry.TopProject = topKey(activity.Projects)
+			for language, s := range activity.Languages {
+				summary.Languages[language] += s
+			}
+			for project, s := range activity.Projects {
+				summary.Projects[project] += s
+			}
+		}
+
+		summary.Users = append(summary.Users, entry)
+		summary.TotalSeconds += seconds
+	}
+
+	sort.Slice(summary.Users, func(i, j int) bool {
+		if summary.Users[i].TotalSeconds != summary.Users[j].TotalSeconds {
+			return summary.Users[i].TotalSeconds > summary.Users[j].TotalSeconds
+		}
+		return summary.Users[i].User < summary.Users[j].User
+	})
+
+	return summary
+}
+
+func topKey(totals map[string]int64) string {
+	var top string
+	var max int64
+	for key, seconds := range totals {
+		if seconds > max || (seconds == max && key < top) {
+			top, max = key, seconds
+		}
+	}
+	return top
+}
+
+// formatSeconds renders a duration as "3h 05m" for humans
+func formatSeconds(seconds int64) string {
+	d := time.Duration(seconds) * time.Second
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", seconds)
+	}
+	if d < time.Hour {
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh %02dm", int(d.Hours()), int(d.Minutes())%60)
+}
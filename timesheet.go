@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// projectDay is the tracked time of one user on one project and day
+type projectDay struct {
+	Project string
+	User    string
+	Day     string
+	Seconds int64
+}
+
+// ProjectDailyTotals sums duration_seconds per project, user and day with a
+// composite aggregation, paging through the buckets so any number of
+// projects fits. Days are calendar days in loc.
+func (es *ESClient) ProjectDailyTotals(ctx context.Context, q ExportQuery, loc *time.Location) ([]projectDay, error) {
+	var totals []projectDay
+	var after map[string]interface{}
+
+	for {
+		composite := map[string]interface{}{
+			"size": 1000,
+			"sources": []interface{}{
+				map[string]interface{}{"project": map[string]interface{}{
+					"terms": map[string]interface{}{"field": "project.keyword"},
+				}},
+				map[string]interface{}{"user": map[string]interface{}{
+					"terms": map[string]interface{}{"field": "user.keyword", "missing_bucket": true},
+				}},
+				map[string]interface{}{"day": map[string]interface{}{
+					"date_histogram": map[string]interface{}{
+						"field":             "server_timestamp",
+						"calendar_interval": "1d",
+						"time_zone":         loc.String(),
+						"format":            "yyyy-MM-dd",
+					},
+				}},
+			},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"size":  0,
+			"query": q.esQuery(),
+			"aggs": map[string]interface{}{
+				"lines": map[string]interface{}{
+					"composite": composite,
+					"aggs": map[string]interface{}{
+						"seconds": map[string]interface{}{"sum": map[string]interface{}{"field": "duration_seconds"}},
+					},
+				},
+			},
+		})
+
+		res, err := es.client.Search(
+			es.client.Search.WithContext(ctx),
+			es.client.Search.WithIndex(sessionsIndex),
+			es.client.Search.WithBody(bytes.NewReader(body)),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Aggregations struct {
+				Lines struct {
+					AfterKey map[string]interface{} `json:"after_key"`
+					Buckets  []struct {
+						Key struct {
+							Project string  `json:"project"`
+							User    *string `json:"user"`
+							Day     string  `json:"day"`
+						} `json:"key"`
+						Seconds struct {
+							Value float64 `json:"value"`
+						} `json:"seconds"`
+					} `json:"buckets"`
+				} `json:"lines"`
+			} `json:"aggregations"`
+		}
+		err = decodeESResponse(res.Body, res.IsError(), res.Status(), &result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("aggregating sessions: %v", err)
+		}
+
+		lines := result.Aggregations.Lines
+		for _, b := range lines.Buckets {
+			day := projectDay{Project: b.Key.Project, Day: b.Key.Day, Seconds: int64(b.Seconds.Value)}
+			if b.Key.User != nil {
+				day.User = *b.Key.User
+			}
+			totals = append(totals, day)
+		}
+		if len(lines.Buckets) == 0 || lines.AfterKey == nil {
+			return totals, nil
+		}
+		after = lines.AfterKey
+	}
+}
+
+// TimesheetLine is one user's billed time on a project for one day
+type TimesheetLine struct {
+	Date           string  `json:"date"`
+	Project        string  `json:"project"`
+	User           string  `json:"user,omitempty"`
+	TrackedSeconds int64   `json:"tracked_seconds"`
+	BilledSeconds  int64   `json:"billed_seconds"`
+	Hours          float64 `json:"hours"`
+	Billable       bool    `json:"billable"`
+	HourlyRate     float64 `json:"hourly_rate"`
+	Currency       string  `json:"currency"`
+	Amount         float64 `json:"amount"`
+}
+
+// ClientTimesheet holds the lines of all projects of one client. Amounts are
+// per currency since projects of a client may be billed differently.
+type ClientTimesheet struct {
+	Client         string             `json:"client"`
+	Lines          []TimesheetLine    `json:"lines"`
+	TrackedSeconds int64              `json:"tracked_seconds"`
+	BilledSeconds  int64              `json:"billed_seconds"`
+	BillableHours  float64            `json:"billable_hours"`
+	Amounts        map[string]float64 `json:"amounts"`
+}
+
+// Timesheet is the billing report of a period
+type Timesheet struct {
+	From           string             `json:"from"`
+	To             string             `json:"to"`
+	TimeZone       string             `json:"time_zone"`
+	Clients        []ClientTimesheet  `json:"clients"`
+	TrackedSeconds int64              `json:"tracked_seconds"`
+	BilledSeconds  int64              `json:"billed_seconds"`
+	Amounts        map[string]float64 `json:"amounts"`
+}
+
+// TimesheetOptions narrows a timesheet to one client or to billable work
+type TimesheetOptions struct {
+	Client       string
+	BillableOnly bool
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// buildTimesheet applies the project metadata to the daily totals. Projects
+// without metadata are listed under the Unassigned client as not billable.
+func buildTimesheet(totals []projectDay, projects *ProjectCatalog, opts TimesheetOptions) []ClientTimesheet {
+	clients := make(map[string]*ClientTimesheet)
+
+	for _, t := range totals {
+		info, ok := projects.Get(t.Project)
+		if !ok {
+			info = ProjectInfo{Name: t.Project, Client: unassignedClient}
+		}
+		if opts.Client != "" && !strings.EqualFold(info.Client, opts.Client) {
+			continue
+		}
+		if opts.BillableOnly && !info.Billable {
+			continue
+		}
+
+		line := TimesheetLine{
+			Date:           t.Day,
+			Project:        t.Project,
+			User:           t.User,
+			TrackedSeconds: t.Seconds,
+			BilledSeconds:  info.Rounding.apply(t.Seconds),
+			Billable:       info.Billable,
+			Currency:       info.Currency,
+		}
+		line.Hours = roundCents(float64(line.BilledSeconds) / 3600)
+		if info.Billable {
+			line.HourlyRate = info.HourlyRate
+			line.Amount = roundCents(float64(line.BilledSeconds) / 3600 * info.HourlyRate)
+		}
+
+		client := clients[info.Client]
+		if client == nil {
+			client = &ClientTimesheet{Client: info.Client, Lines: []TimesheetLine{}, Amounts: make(map[string]float64)}
+			clients[info.Client] = client
+		}
+		client.Lines = append(client.Lines, line)
+		client.TrackedSeconds += line.TrackedSeconds
+		client.BilledSeconds += line.BilledSeconds
+		if line.Billable {
+			client.BillableHours = roundCents(client.BillableHours + line.Hours)
+			client.Amounts[line.Currency] = roundCents(client.Amounts[line.Currency] + line.Amount)
+		}
+	}
+
+	list := make([]ClientTimesheet, 0, len(clients))
+	for _, client := range clients {
+		sort.Slice(client.Lines, func(i, j int) bool {
+			a, b := client.Lines[i], client.Lines[j]
+			if a.Date != b.Date {
+				return a.Date < b.Date
+			}
+			if a.Project != b.Project {
+				return a.Project < b.Project
+			}
+			return a.User < b.User
+		})
+		list = append(list, *client)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		// unassigned work goes last, after the clients that are billed
+		if (list[i].Client == unassignedClient) != (list[j].Client == unassignedClient) {
+			return list[j].Client == unassignedClient
+		}
+		return list[i].Client < list[j].Client
+	})
+	return list
+}
+
+var timesheetCSVHeader = []string{
+	"client", "date", "project", "user", "tracked_hours", "billed_hours",
+	"billable", "hourly_rate", "currency", "amount",
+}
+
+func writeTimesheetCSV(w *csv.Writer, sheet Timesheet) error {
+	if err := w.Write(timesheetCSVHeader); err != nil {
+		return err
+	}
+	for _, client := range sheet.Clients {
+		for _, line := range client.Lines {
+			record := []string{
+				client.Client, line.Date, line.Project, line.User,
+				strconv.FormatFloat(float64(line.TrackedSeconds)/3600, 'f', 2, 64),
+				strconv.FormatFloat(line.Hours, 'f', 2, 64),
+				strconv.FormatBool(line.Billable),
+				strconv.FormatFloat(line.HourlyRate, 'f', 2, 64),
+				line.Currency,
+				strconv.FormatFloat(line.Amount, 'f', 2, 64),
+			}
+			if err := w.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+var timesheetTemplate = htmltemplate.Must(htmltemplate.New("timesheet").Funcs(htmltemplate.FuncMap{
+	"hours": func(seconds int64) string { return strconv.FormatFloat(float64(seconds)/3600, 'f', 2, 64) },
+	"money": func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) },
+}).Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Timesheet {{.From}} – {{.To}}</title>
+<style>
+body{font-family:-apple-system,Segoe UI,Helvetica,Arial,sans-serif;color:#1f2328;max-width:960px;margin:0 auto;padding:24px}
+table{border-collapse:collapse;width:100%;margin-bottom:24px}
+th,td{padding:6px;border-bottom:1px solid #d0d7de;text-align:left}
+td.num,th.num{text-align:right}
+tfoot td{font-weight:bold;border-bottom:none}
+p.period{color:#656d76;margin-top:0}
+</style>
+</head>
+<body>
+<h2 style="margin-bottom:4px">Timesheet</h2>
+<p class="period">{{.From}} – {{.To}} ({{.TimeZone}})</p>
+{{if not .Clients}}<p>No tracked time in this period.</p>{{end}}
+{{range .Clients}}
+<h3>{{.Client}}</h3>
+<table>
+<thead><tr><th>Date</th><th>Project</th><th>User</th><th class="num">Tracked</th><th class="num">Billed</th><th class="num">Rate</th><th class="num">Amount</th></tr></thead>
+<tbody>
+{{range .Lines}}<tr><td>{{.Date}}</td><td>{{.Project}}</td><td>{{.User}}</td><td class="num">{{hours .TrackedSeconds}} h</td><td class="num">{{hours .BilledSeconds}} h</td>
+<td class="num">{{if .Billable}}{{money .HourlyRate}} {{.Currency}}{{else}}–{{end}}</td><td class="num">{{if .Billable}}{{money .Amount}} {{.Currency}}{{else}}not billable{{end}}</td></tr>
+{{end}}</tbody>
+<tfoot><tr><td colspan="3">Total</td><td class="num">{{hours .TrackedSeconds}} h</td><td class="num">{{hours .BilledSeconds}} h</td><td></td>
+<td class="num">{{range $currency, $amount := .Amounts}}{{money $amount}} {{$currency}}<br>{{end}}</td></tr></tfoot>
+</table>
+{{end}}
+{{if .Amounts}}<p><strong>Total billable:</strong> {{range $currency, $amount := .Amounts}}{{money $amount}} {{$currency}} {{end}}</p>{{end}}
+</body>
+</html>
+`))
+
+// timesheetHandler serves GET /api/v1/timesheets. Query parameters: from, to
+// or range as for exports, client, user, project, billable=true, tz (IANA
+// zone the days are counted in) and format (json, csv, html).
+func timesheetHandler(w http.ResponseWriter, r *http.Request, esClient *ESClient, projects *ProjectCatalog) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if esClient == nil {
+		writeError(w, http.StatusServiceUnavailable, "Elasticsearch is not connected")
+		return
+	}
+
+	params := r.URL.Query()
+	from, to, err := parseExportRange(params.Get("from"), params.Get("to"), params.Get("range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	loc := time.UTC
+	if tz := params.Get("tz"); tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			writeError(w, http.StatusBadRequest, "tz must be an IANA time zone such as Europe/Berlin")
+			return
+		}
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "html" {
+		writeError(w, http.StatusBadRequest, "format must be one of json, csv, html")
+		return
+	}
+
+	q := ExportQuery{From: from, To: to, User: params.Get("user"), Project: params.Get("project")}
+	totals, err := esClient.ProjectDailyTotals(r.Context(), q, loc)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	sheet := Timesheet{
+		From:     from.In(loc).Format(time.RFC3339),
+		To:       to.In(loc).Format(time.RFC3339),
+		TimeZone: loc.String(),
+		Clients: buildTimesheet(totals, projects, TimesheetOptions{
+			Client:       params.Get("client"),
+			BillableOnly: params.Get("billable") == "true",
+		}),
+		Amounts: make(map[string]float64),
+	}
+	for _, client := range sheet.Clients {
+		sheet.TrackedSeconds += client.TrackedSeconds
+		sheet.BilledSeconds += client.BilledSeconds
+		for currency, amount := range client.Amounts {
+			sheet.Amounts[currency] = roundCents(sheet.Amounts[currency] + amount)
+		}
+	}
+
+	filename := fmt.Sprintf("timesheet-%s-%s", from.In(loc).Format("20060102"), to.In(loc).Format("20060102"))
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		writeTimesheetCSV(csv.NewWriter(w), sheet)
+	case "html":
+		var body bytes.Buffer
+		if err := timesheetTemplate.Execute(&body, sheet); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(body.Bytes())
+	default:
+		writeJSON(w, http.StatusOK, sheet)
+	}
+}
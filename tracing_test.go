@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is an OTLP/HTTP endpoint keeping the exported spans
+type collector struct {
+	mutex sync.Mutex
+	paths []string
+	spans map[string][]map[string]string // span name to the attributes of each span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.paths = append(c.paths, r.URL.Path)
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				attrs := make(map[string]string)
+				for _, kv := range span.Attributes {
+					attrs[kv.Key] = kv.Value.GetStringValue()
+				}
+				c.spans[span.Name] = append(c.spans[span.Name], attrs)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+// fakeElasticsearch answers the product check and accepts every document
+func fakeElasticsearch() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		if r.Method == http.MethodGet && r.URL.Path == "/" {
+			io.WriteString(w, `{"version":{"number":"8.11.0"},"tagline":"You Know, for Search"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"result":"created","_id":"1"}`)
+	}))
+}
+
+func TestOTLPTracesURL(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"http://localhost:4318":              "http://localhost:4318/v1/traces",
+		"http://localhost:4318/":             "http://localhost:4318/v1/traces",
+		"https://otel.example.com/v1/traces": "https://otel.example.com/v1/traces",
+		"https://otel.example.com/custom":    "https://otel.example.com/custom",
+	} {
+		if got := otlpTracesURL(endpoint); got != want {
+			t.Errorf("otlpTracesURL(%q) = %q, want %q", endpoint, got, want)
+		}
+	}
+}
+
+func TestTrackSessionSpans(t *testing.T) {
+	col := &collector{spans: make(map[string][]map[string]string)}
+	otlp := httptest.NewServer(col)
+	defer otlp.Close()
+	es := fakeElasticsearch()
+	defer es.Close()
+
+	cfg := defaultConfig()
+	cfg.Server.DataDir = t.TempDir()
+	cfg.Tracing = TracingConfig{Exporter: "otlp", Endpoint: otlp.URL + "/", ServiceName: "test", SampleRatio: 1}
+	applyConfig(cfg)
+
+	// the Elasticsearch client picks up the provider when it is created
+	stopTracing, err := setupTracing(cfg.Tracing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esClient, err := NewESClient(es.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := newHub(cfg)
+	go hub.run()
+	defer hub.Stop(context.Background())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trackingWSHandler(w, r, esClient, hub)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/track?user=alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(CodingSession{Editor: "vscode", Project: "p", Language: "go", DurationSeconds: 60}); err != nil {
+		t.Fatal(err)
+	}
+	var ack map[string]interface{}
+	if err := conn.ReadJSON(&ack); err != nil || ack["status"] != "received" {
+		t.Fatalf("ack %v, error %v", ack, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := esClient.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := stopTracing(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	col.mutex.Lock()
+	defer col.mutex.Unlock()
+	if len(col.paths) == 0 {
+		t.Fatal("no spans exported")
+	}
+	for _, path := range col.paths {
+		if path != "/v1/traces" {
+			t.Errorf("spans posted to %q", path)
+		}
+	}
+	for _, name := range []string{"ws.track frame", "session.validate", "session.index", "hub.AddSessionRecord", "hub.broadcast"} {
+		if len(col.spans[name]) == 0 {
+			t.Errorf("no %q span", name)
+		}
+	}
+
+	// the instrumented client adds a span per Elasticsearch request
+	esSpans := 0
+	for _, spans := range col.spans {
+		for _, attrs := range spans {
+			if attrs["db.system"] == "elasticsearch" {
+				esSpans++
+			}
+		}
+	}
+	if esSpans == 0 {
+		t.Errorf("no Elasticsearch client span among %d span names", len(col.spans))
+	}
+}
@@ -0,0 +1,248 @@
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+const wsBase = (location.protocol === "https:" ? "wss://" : "ws://") + location.host;
+const api = (path) => fetch(path).then((res) => (res.ok ? res.json() : Promise.reject(res.status)));
+
+const liveChart = new LineChart($("live-chart"), [
+  { name: "CPU", color: "#4ea1ff" },
+  { name: "Memory", color: "#f2994a" },
+], { max: 100, unit: "%", window: 10 * 60 * 1000, limit: 1200 });
+
+const historyChart = new LineChart($("history-chart"), [
+  { name: "CPU", color: "#4ea1ff" },
+  { name: "Memory", color: "#f2994a" },
+], { max: 100, unit: "%" });
+
+const state = {
+  host: "",
+  weekly: {},
+  presence: {},
+  alerts: {},
+};
+
+function formatSeconds(seconds) {
+  if (seconds < 60) return seconds + "s";
+  const h = Math.floor(seconds / 3600);
+  const m = Math.floor((seconds % 3600) / 60);
+  return h ? `${h}h ${String(m).padStart(2, "0")}m` : `${m}m`;
+}
+
+function item(...parts) {
+  const li = document.createElement("li");
+  for (const part of parts) {
+    const span = document.createElement("span");
+    if (Array.isArray(part)) {
+      span.textContent = part[0];
+      span.className = part[1];
+    } else {
+      span.textContent = part;
+    }
+    li.appendChild(span);
+  }
+  return li;
+}
+
+function renderList(el, items, empty) {
+  el.replaceChildren(...(items.length ? items : [item([empty, "empty"])]));
+}
+
+// Reconnecting WebSocket, onMessage receives the parsed hub messages
+function connect(path, statusEl, onMessage) {
+  let backoff = 1000;
+  let socket;
+  const open = () => {
+    socket = new WebSocket(wsBase + path());
+    socket.onopen = () => {
+      backoff = 1000;
+      statusEl.classList.add("on");
+    };
+    socket.onmessage = (event) => {
+      try {
+        onMessage(JSON.parse(event.data));
+      } catch (err) {
+        console.error("bad message", err);
+      }
+    };
+    socket.onclose = (event) => {
+      statusEl.classList.remove("on");
+      let delay = backoff;
+      // a server shutting down says how long to stay away
+      if (event.code === 1001) {
+        try {
+          delay = Math.max(delay, JSON.parse(event.reason).reconnect_after_ms || 0);
+        } catch (err) {
+          // no hint, keep the backoff
+        }
+      }
+      setTimeout(open, delay);
+      backoff = Math.min(backoff * 2, 30000);
+    };
+  };
+  open();
+  return { reconnect: () => socket && socket.close() };
+}
+
+// Host metrics
+
+async function loadHosts() {
+  const { hosts } = await api("/api/v1/hosts");
+  const select = $("host");
+  select.replaceChildren(...hosts.map((h) => {
+    const option = document.createElement("option");
+    option.value = h.host_id;
+    option.textContent = h.host_id + (h.online ? "" : " (offline)");
+    return option;
+  }));
+  const local = hosts.find((h) => h.source === "local");
+  state.host = state.host || (local ? local.host_id : hosts.length ? hosts[0].host_id : "");
+  select.value = state.host;
+}
+
+function showMetrics(m) {
+  $("cpu-now").textContent = m.cpu.toFixed(1) + "%";
+  $("mem-now").textContent = m.memory.toFixed(1) + "%";
+  $("load-now").textContent = m.load ? m.load.load1.toFixed(2) : "–";
+  $("host-info").textContent = [m.hostname, m.platform, m.cores && m.cores + " cores"].filter(Boolean).join(" · ");
+}
+
+function connectMonitor() {
+  return connect(
+    () => `/ws/monitor?host=${encodeURIComponent(state.host)}&backfill=10m`,
+    $("monitor-status"),
+    (msg) => {
+      if (msg.type === "metrics_history" && msg.data.host_id === state.host) {
+        const points = msg.data.points;
+        liveChart.set([
+          points.map((p) => [Date.parse(p.timestamp), p.cpu]),
+          points.map((p) => [Date.parse(p.timestamp), p.memory]),
+        ]);
+      } else if (msg.type === "metrics") {
+        liveChart.push(Date.now(), [msg.data.cpu, msg.data.memory]);
+        showMetrics(msg.data);
+      }
+    },
+  );
+}
+
+let monitor;
+
+$("host").addEventListener("change", (e) => {
+  state.host = e.target.value;
+  liveChart.set([[], []]);
+  monitor.reconnect();
+  loadHistory();
+});
+
+async function loadHistory() {
+  if (!state.host) return;
+  const range = $("range").value;
+  const data = await api(`/api/v1/metrics/history?host=${encodeURIComponent(state.host)}&range=${range}`);
+  historyChart.set([
+    data.points.map((p) => [Date.parse(p.timestamp), p.cpu]),
+    data.points.map((p) => [Date.parse(p.timestamp), p.memory]),
+  ]);
+}
+
+$("range").addEventListener("change", loadHistory);
+
+// Coding activity
+
+function renderBoard(entries) {
+  renderList($("leaderboard"), entries.map((e) =>
+    item(e.user, [e.team || "", "muted"], formatSeconds(e.total_seconds))), "No sessions yet");
+}
+
+async function loadLeaderboard() {
+  const data = await api(`/api/v1/leaderboard?window=${$("window").value}`);
+  renderBoard(data.entries);
+}
+
+$("window").addEventListener("change", loadLeaderboard);
+
+function renderWeekly() {
+  const rows = Object.entries(state.weekly).sort((a, b) => b[1] - a[1]);
+  renderList($("weekly"), rows.map(([client, seconds]) => item(client, formatSeconds(seconds))), "No sessions this week");
+}
+
+function renderPresence() {
+  const users = Object.values(state.presence).filter((p) => p.state !== "offline");
+  users.sort((a, b) => a.user.localeCompare(b.user));
+  renderList($("presence"), users.map((p) =>
+    item(p.user, [[p.language, p.project].filter(Boolean).join(" · "), "muted"], [p.state, "state " + p.state])),
+  "Nobody is online");
+}
+
+function renderAlerts() {
+  const alerts = Object.values(state.alerts).sort((a, b) => b.timestamp.localeCompare(a.timestamp));
+  renderList($("alerts"), alerts.slice(0, 20).map((a) =>
+    item(`${a.rule} on ${a.host_id}`, [`${a.metric} ${a.value.toFixed(1)}`, "muted"], [a.state, "state " + a.state])),
+  "No alerts");
+}
+
+function addSession(s) {
+  const feed = $("sessions");
+  const empty = feed.querySelector(".empty");
+  if (empty) empty.parentElement.remove();
+  const who = s.user || "anonymous";
+  feed.prepend(item(who, [`${s.language} · ${s.project} · ${s.editor}`, "muted"], formatSeconds(s.duration_seconds)));
+  while (feed.children.length > 50) feed.lastChild.remove();
+}
+
+connect(() => "/ws/external", $("external-status"), (msg) => {
+  switch (msg.type) {
+    case "session":
+      addSession(msg.data);
+      break;
+    case "weekly_summary":
+      state.weekly[msg.data.client] = msg.data.week_seconds;
+      renderWeekly();
+      break;
+    case "leaderboard": {
+      const board = msg.data.boards[$("window").value];
+      if (board) renderBoard(board);
+      break;
+    }
+    case "presence":
+      state.presence[msg.data.user] = msg.data;
+      renderPresence();
+      break;
+    case "alert":
+      state.alerts[msg.data.rule + "|" + msg.data.host_id] = msg.data;
+      renderAlerts();
+      break;
+    case "announcement": {
+      const banner = $("announcement");
+      banner.textContent = msg.data.message;
+      banner.className = "announcement " + msg.data.level;
+      banner.hidden = false;
+      break;
+    }
+  }
+});
+
+async function init() {
+  renderList($("sessions"), [], "Waiting for sessions");
+  await loadHosts().catch(() => {});
+  monitor = connectMonitor();
+  loadHistory().catch(() => {});
+  loadLeaderboard().catch(() => {});
+
+  api("/stats").then((data) => {
+    state.weekly = data.weekly_totals || {};
+    renderWeekly();
+  }).catch(() => {});
+  api("/api/v1/presence").then((data) => {
+    data.users.forEach((p) => (state.presence[p.user] = p));
+    renderPresence();
+  }).catch(() => {});
+  api("/api/v1/alerts").then((data) => {
+    data.alerts.forEach((a) => (state.alerts[a.rule + "|" + a.host_id] = a));
+    renderAlerts();
+  }).catch(() => {});
+
+  setInterval(() => loadHistory().catch(() => {}), 60000);
+  setInterval(() => loadHosts().catch(() => {}), 30000);
+}
+
+init();
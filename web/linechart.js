@@ -0,0 +1,122 @@
+// Minimal time series line chart on a canvas, no dependencies.
+class LineChart {
+  constructor(canvas, series, options = {}) {
+    this.canvas = canvas;
+    this.series = series; // [{name, color}]
+    this.max = options.max; // fixed y maximum, auto when undefined
+    this.unit = options.unit || "";
+    this.data = series.map(() => []); // per series [[t, v], ...]
+    this.window = options.window || 0; // visible milliseconds, 0 = all data
+    this.limit = options.limit || 0; // points kept per series, 0 = unlimited
+    window.addEventListener("resize", () => this.draw());
+  }
+
+  set(data) {
+    this.data = data;
+    this.draw();
+  }
+
+  push(t, values) {
+    values.forEach((v, i) => {
+      this.data[i].push([t, v]);
+      if (this.limit && this.data[i].length > this.limit) {
+        this.data[i].shift();
+      }
+    });
+    this.draw();
+  }
+
+  draw() {
+    const ratio = window.devicePixelRatio || 1;
+    const width = this.canvas.clientWidth;
+    const height = this.canvas.clientHeight || Number(this.canvas.getAttribute("height"));
+    this.canvas.width = width * ratio;
+    this.canvas.height = height * ratio;
+
+    const ctx = this.canvas.getContext("2d");
+    ctx.scale(ratio, ratio);
+    ctx.clearRect(0, 0, width, height);
+
+    const pad = { left: 44, right: 12, top: 20, bottom: 22 };
+    const plotW = width - pad.left - pad.right;
+    const plotH = height - pad.top - pad.bottom;
+
+    const all = this.data.flat();
+    let tMax = all.length ? Math.max(...all.map((p) => p[0])) : Date.now();
+    let tMin = all.length ? Math.min(...all.map((p) => p[0])) : tMax - 60000;
+    if (this.window) {
+      tMax = Math.max(tMax, Date.now());
+      tMin = tMax - this.window;
+    }
+    if (tMax === tMin) tMin = tMax - 1000;
+
+    let yMax = this.max;
+    if (yMax === undefined) {
+      yMax = all.length ? Math.max(...all.map((p) => p[1])) : 1;
+      yMax = niceCeil(yMax || 1);
+    }
+
+    const x = (t) => pad.left + ((t - tMin) / (tMax - tMin)) * plotW;
+    const y = (v) => pad.top + plotH - (Math.min(v, yMax) / yMax) * plotH;
+
+    ctx.font = "11px sans-serif";
+    ctx.fillStyle = "#8b949e";
+    ctx.strokeStyle = "#2a3240";
+    ctx.lineWidth = 1;
+
+    for (let i = 0; i <= 4; i++) {
+      const v = (yMax / 4) * i;
+      const py = Math.round(y(v)) + 0.5;
+      ctx.beginPath();
+      ctx.moveTo(pad.left, py);
+      ctx.lineTo(width - pad.right, py);
+      ctx.stroke();
+      ctx.textAlign = "right";
+      ctx.fillText(formatValue(v) + this.unit, pad.left - 6, py + 4);
+    }
+
+    ctx.textAlign = "center";
+    const span = tMax - tMin;
+    for (let i = 0; i <= 4; i++) {
+      const t = tMin + (span / 4) * i;
+      ctx.fillText(formatTime(t, span), x(t), height - 6);
+    }
+
+    this.series.forEach((s, i) => {
+      const points = this.data[i].filter((p) => p[0] >= tMin);
+      ctx.strokeStyle = s.color;
+      ctx.lineWidth = 1.5;
+      ctx.beginPath();
+      points.forEach(([t, v], j) => (j ? ctx.lineTo(x(t), y(v)) : ctx.moveTo(x(t), y(v))));
+      ctx.stroke();
+
+      ctx.fillStyle = s.color;
+      ctx.textAlign = "left";
+      ctx.fillText("● " + s.name, pad.left + i * 90, 12);
+    });
+  }
+}
+
+function niceCeil(v) {
+  const exp = Math.pow(10, Math.floor(Math.log10(v)));
+  for (const step of [1, 2, 2.5, 5, 10]) {
+    if (v <= step * exp) return step * exp;
+  }
+  return 10 * exp;
+}
+
+function formatValue(v) {
+  if (v >= 1e9) return (v / 1e9).toFixed(1) + "G";
+  if (v >= 1e6) return (v / 1e6).toFixed(1) + "M";
+  if (v >= 1e3) return (v / 1e3).toFixed(1) + "k";
+  return Number.isInteger(v) ? String(v) : v.toFixed(1);
+}
+
+function formatTime(t, span) {
+  const d = new Date(t);
+  if (span > 36 * 3600 * 1000) {
+    return d.toLocaleDateString([], { month: "short", day: "numeric" }) + " " +
+      d.toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+  }
+  return d.toLocaleTimeString([], { hour: "2-digit", minute: "2-digit", second: span < 600000 ? "2-digit" : undefined });
+}
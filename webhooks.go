@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookLogSize is how many delivery attempts are kept per webhook
+	webhookLogSize = 50
+	// webhookMaxAttempts is how often a single event is tried before it is dropped
+	webhookMaxAttempts = 8
+	webhookMaxBackoff  = time.Hour
+	webhookWorkers     = 4
+	// webhookMaxQueued is how many deliveries may wait per webhook, newer
+	// events are dropped until a down receiver catches up or gets disabled
+	webhookMaxQueued = 1000
+)
+
+// Webhook is a subscription receiving hub events as signed HTTP POSTs
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the payloads, it is only returned when the webhook is created
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events"`
+	// Filters restrict events to those whose data has these top-level values,
+	// e.g. {"user": "alice"} or {"host_id": "web-1"}
+	Filters map[string]string `json:"filters,omitempty"`
+
+	Enabled             bool   `json:"enabled"`
+	DisabledReason      string `json:"disabled_reason,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	CreatedAt           string `json:"created_at"`
+}
+
+// WebhookDeliveryLog records one delivery attempt
+type WebhookDeliveryLog struct {
+	DeliveryID string `json:"delivery_id"`
+	EventType  string `json:"event_type"`
+	EventID    string `json:"event_id"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Timestamp  string `json:"timestamp"`
+}
+
+// webhookDelivery is an event waiting to be (re)delivered to a webhook
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	WebhookID   string          `json:"webhook_id"`
+	EventType   string          `json:"event_type"`
+	EventID     string          `json:"event_id"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+
+	inFlight bool
+}
+
+// WebhookDispatcher fans hub broadcasts out to the webhooks. Subscriptions
+// and pending deliveries are kept in the data directory so neither is lost
+// on restart.
+type WebhookDispatcher struct {
+	mutex  sync.Mutex
+	hooks  map[string]*Webhook
+	queue  []*webhookDelivery
+	logs   map[string][]WebhookDeliveryLog
+	events chan BroadcastMessage
+
+	// the queue and the failure counts change with every event and attempt,
+	// run writes them out once per tick when dirty
+	queueDirty  bool
+	hooksDirty  bool
+	overflowing map[string]bool
+	saveMutex   sync.Mutex
+
+	hooksPath   string
+	queuePath   string
+	client      *http.Client
+	maxFailures int
+	retryBase   time.Duration
+	workers     chan struct{}
+}
+
+func newWebhookDispatcher(cfg WebhooksConfig) (*WebhookDispatcher, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	d := &WebhookDispatcher{
+		hooks:       make(map[string]*Webhook),
+		logs:        make(map[string][]WebhookDeliveryLog),
+		events:      make(chan BroadcastMessage, 256),
+		overflowing: make(map[string]bool),
+		hooksPath:   filepath.Join(dataDir, "webhooks.json"),
+		queuePath:   filepath.Join(dataDir, "webhook-queue.json"),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxFailures: cfg.MaxFailures,
+		retryBase:   cfg.RetryBase,
+		workers:     make(chan struct{}, webhookWorkers),
+	}
+
+	var hooks []*Webhook
+	if err := readJSONFile(d.hooksPath, &hooks); err != nil {
+		return nil, err
+	}
+	for _, hook := range hooks {
+		d.hooks[hook.ID] = hook
+	}
+	if err := readJSONFile(d.queuePath, &d.queue); err != nil {
+		return nil, err
+	}
+	kept := d.queue[:0]
+	for _, delivery := range d.queue {
+		if hook, ok := d.hooks[delivery.WebhookID]; ok && hook.Enabled {
+			kept = append(kept, delivery)
+		}
+	}
+	d.queue = kept
+	if len(d.queue) > 0 {
+		webhooksLog.Info("Resuming queued webhook deliveries", "count", len(d.queue))
+	}
+
+	registry.gaugeFunc("tracker_webhook_queue_length", "Webhook deliveries waiting to be sent or retried.", nil,
+		func() []promSample {
+			return []promSample{{Value: float64(d.QueueLength())}}
+		})
+
+	return d, nil
+}
+
+// QueueLength is the number of deliveries waiting to be sent or retried
+func (d *WebhookDispatcher) QueueLength() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.queue)
+}
+
+// readJSONFile decodes path into v, a missing file leaves v untouched
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile replaces path atomically
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Publish is the hub listener, it never blocks the hub loop
+func (d *WebhookDispatcher) Publish(message BroadcastMessage) {
+	select {
+	case d.events <- message:
+	default:
+		webhooksLog.Warn("Webhook event queue full, dropping event", "type", message.Type, "event_id", message.EventID)
+	}
+}
+
+func (d *WebhookDispatcher) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message := <-d.events:
+			d.enqueue(message)
+			d.dispatchDue()
+		case <-ticker.C:
+			d.dispatchDue()
+			d.persist()
+		}
+	}
+}
+
+// Flush moves the events still waiting for run into the persisted queue so
+// they are delivered after a restart
+func (d *WebhookDispatcher) Flush() {
+	for {
+		select {
+		case message := <-d.events:
+			d.enqueue(message)
+		default:
+			d.mutex.Lock()
+			d.saveQueue()
+			d.mutex.Unlock()
+			d.persist()
+			return
+		}
+	}
+}
+
+func (hook *Webhook) matches(message BroadcastMessage, data map[string]interface{}) bool {
+	if !hook.Enabled {
+		return false
+	}
+	subscribed := false
+	for _, event := range hook.Events {
+		if event == message.Type {
+			subscribed = true
+			break
+		}
+	}
+	if !subscribed {
+		return false
+	}
+	for key, want := range hook.Filters {
+		value, ok := data[key]
+		if !ok || fmt.Sprint(value) != want {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *WebhookDispatcher) enqueue(message BroadcastMessage) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		webhooksLog.Error("Failed to marshal webhook payload", "type", message.Type, "event_id", message.EventID, "error", err)
+		return
+	}
+	// filters look at the event data as the receiver will see it
+	var data map[string]interface{}
+	if raw, err := json.Marshal(message.Data); err == nil {
+		json.Unmarshal(raw, &data)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	waiting := make(map[string]int)
+	for _, delivery := range d.queue {
+		waiting[delivery.WebhookID]++
+	}
+
+	queued := false
+	for _, hook := range d.hooks {
+		if !hook.matches(message, data) {
+			continue
+		}
+		if waiting[hook.ID] >= webhookMaxQueued {
+			webhookDeliveries.Inc("dropped")
+			if !d.overflowing[hook.ID] {
+				d.overflowing[hook.ID] = true
+				webhooksLog.Warn("Webhook queue full, dropping new events", "webhook", hook.ID, "queued", waiting[hook.ID])
+			}
+			continue
+		}
+		delete(d.overflowing, hook.ID)
+		d.queue = append(d.queue, &webhookDelivery{
+			ID:          randomHex(8),
+			WebhookID:   hook.ID,
+			EventType:   message.Type,
+			EventID:     message.EventID,
+			Payload:     payload,
+			NextAttempt: time.Now(),
+		})
+		queued = true
+	}
+	if queued {
+		d.saveQueue()
+	}
+}
+
+func (d *WebhookDispatcher) dispatchDue() {
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, delivery := range d.queue {
+		if delivery.inFlight || delivery.NextAttempt.After(now) {
+			continue
+		}
+		hook, ok := d.hooks[delivery.WebhookID]
+		if !ok {
+			continue
+		}
+		// the rest waits for the next tick when every worker is busy
+		select {
+		case d.workers <- struct{}{}:
+		default:
+			return
+		}
+		delivery.inFlight = true
+		go d.deliver(*hook, delivery)
+	}
+}
+
+// sign returns the X-Signature-256 header value for payload
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver makes one attempt, dispatchDue acquired its worker slot
+func (d *WebhookDispatcher) deliver(hook Webhook, delivery *webhookDelivery) {
+	defer func() { <-d.workers }()
+
+	start := time.Now()
+	status, err := d.post(hook, delivery)
+
+	entry := WebhookDeliveryLog{
+		DeliveryID: delivery.ID,
+		EventType:  delivery.EventType,
+		EventID:    delivery.EventID,
+		Attempt:    delivery.Attempts + 1,
+		StatusCode: status,
+		DurationMs: time.Since(start).Milliseconds(),
+		Timestamp:  start.Format(time.RFC3339),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.logs[hook.ID] = append(d.logs[hook.ID], entry)
+	if n := len(d.logs[hook.ID]); n > webhookLogSize {
+		d.logs[hook.ID] = d.logs[hook.ID][n-webhookLogSize:]
+	}
+
+	delivery.inFlight = false
+	delivery.Attempts++
+	current, ok := d.hooks[hook.ID]
+
+	switch {
+	case err == nil:
+		webhookDeliveries.Inc("success")
+		d.remove(delivery)
+		if ok && current.ConsecutiveFailures > 0 {
+			current.ConsecutiveFailures = 0
+			d.saveHooks()
+		}
+
+	case !ok:
+		d.remove(delivery)
+
+	default:
+		webhookDeliveries.Inc("failure")
+		webhooksLog.Warn("Webhook delivery failed", "webhook", hook.ID, "delivery", delivery.ID, "event_id", delivery.EventID, "attempt", delivery.Attempts, "error", err)
+
+		current.ConsecutiveFailures++
+		if current.ConsecutiveFailures >= d.maxFailures {
+			current.Enabled = false
+			current.DisabledReason = fmt.Sprintf("%d consecutive failed deliveries, last: %v", current.ConsecutiveFailures, err)
+			webhooksLog.Warn("Webhook disabled", "webhook", hook.ID, "consecutive_failures", current.ConsecutiveFailures)
+			d.dropQueued(hook.ID)
+		} else if delivery.Attempts >= webhookMaxAttempts {
+			webhookDeliveries.Inc("dropped")
+			d.remove(delivery)
+		} else {
+			backoff := d.retryBase << (delivery.Attempts - 1)
+			if backoff > webhookMaxBackoff || backoff <= 0 {
+				backoff = webhookMaxBackoff
+			}
+			delivery.NextAttempt = time.Now().Add(backoff)
+		}
+		d.saveHooks()
+	}
+	d.saveQueue()
+}
+
+func (d *WebhookDispatcher) post(hook Webhook, delivery *webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "coding-tracker-webhooks/1.0")
+	req.Header.Set("X-Webhook-ID", hook.ID)
+	req.Header.Set("X-Delivery-ID", delivery.ID)
+	req.Header.Set("X-Event-Type", delivery.EventType)
+	req.Header.Set("X-Event-ID", delivery.EventID)
+	if hook.Secret != "" {
+		req.Header.Set("X-Signature-256", sign(hook.Secret, delivery.Payload))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func (d *WebhookDispatcher) remove(delivery *webhookDelivery) {
+	for i, queued := range d.queue {
+		if queued == delivery {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) dropQueued(hookID string) {
+	kept := d.queue[:0]
+	for _, delivery := range d.queue {
+		if delivery.WebhookID != hookID || delivery.inFlight {
+			kept = append(kept, delivery)
+		}
+	}
+	d.queue = kept
+}
+
+// saveQueue marks the queue for the next persist, the caller holds the mutex
+func (d *WebhookDispatcher) saveQueue() {
+	d.queueDirty = true
+}
+
+// saveHooks marks the webhooks for the next persist, the caller holds the mutex
+func (d *WebhookDispatcher) saveHooks() {
+	d.hooksDirty = true
+}
+
+func (d *WebhookDispatcher) sortedHooks() []*Webhook {
+	hooks := make([]*Webhook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt < hooks[j].CreatedAt })
+	return hooks
+}
+
+// persist writes out what changed since the last call. The snapshot is
+// taken under the mutex, the files are written outside of it; saveMutex
+// keeps an older snapshot from being written last.
+func (d *WebhookDispatcher) persist() {
+	d.saveMutex.Lock()
+	defer d.saveMutex.Unlock()
+
+	var queue, hooks []byte
+	d.mutex.Lock()
+	if d.queueDirty {
+		queue, _ = json.Marshal(d.queue)
+		d.queueDirty = false
+	}
+	if d.hooksDirty {
+		hooks, _ = json.MarshalIndent(d.sortedHooks(), "", "  ")
+		d.hooksDirty = false
+	}
+	d.mutex.Unlock()
+
+	if queue != nil {
+		if err := writeFileAtomic(d.queuePath, queue); err != nil {
+			webhooksLog.Error("Failed to persist webhook queue", "error", err)
+		}
+	}
+	if hooks != nil {
+		if err := writeFileAtomic(d.hooksPath, hooks); err != nil {
+			webhooksLog.Error("Failed to persist webhooks", "error", err)
+		}
+	}
+}
+
+// SetPolicy applies new retry settings to the following delivery attempts
+func (d *WebhookDispatcher) SetPolicy(cfg WebhooksConfig) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.maxFailures = cfg.MaxFailures
+	d.retryBase = cfg.RetryBase
+}
+
+func validateWebhook(hook *Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if len(hook.Events) == 0 {
+		return fmt.Errorf("events must list at least one event type")
+	}
+	return nil
+}
+
+// Create registers a webhook, generating the secret when none is given
+func (d *WebhookDispatcher) Create(hook Webhook) (Webhook, error) {
+	if err := validateWebhook(&hook); err != nil {
+		return Webhook{}, err
+	}
+	hook.ID = randomHex(8)
+	if hook.Secret == "" {
+		hook.Secret = randomHex(32)
+	}
+	hook.Enabled = true
+	hook.CreatedAt = time.Now().Format(time.RFC3339)
+
+	d.mutex.Lock()
+	d.hooks[hook.ID] = &hook
+	d.saveHooks()
+	d.mutex.Unlock()
+	d.persist()
+
+	return hook, nil
+}
+
+// Update replaces the URL, events and filters of a webhook and re-enables it
+func (d *WebhookDispatcher) Update(id string, update Webhook) (Webhook, bool, error) {
+	if err := validateWebhook(&update); err != nil {
+		return Webhook{}, true, err
+	}
+
+	defer d.persist()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	hook, ok := d.hooks[id]
+	if !ok {
+		return Webhook{}, false, nil
+	}
+	hook.URL = update.URL
+	hook.Events = update.Events
+	hook.Filters = update.Filters
+	if update.Secret != "" {
+		hook.Secret = update.Secret
+	}
+	hook.Enabled = true
+	hook.DisabledReason = ""
+	hook.ConsecutiveFailures = 0
+	d.saveHooks()
+
+	return hook.public(), true, nil
+}
+
+func (d *WebhookDispatcher) Delete(id string) bool {
+	defer d.persist()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.hooks[id]; !ok {
+		return false
+	}
+	delete(d.hooks, id)
+	delete(d.logs, id)
+	d.dropQueued(id)
+	d.saveHooks()
+	d.saveQueue()
+	return true
+}
+
+// public hides the secret
+func (hook Webhook) public() Webhook {
+	hook.Secret = ""
+	return hook
+}
+
+func (d *WebhookDispatcher) List() []Webhook {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	hooks := make([]Webhook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		hooks = append(hooks, hook.public())
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt < hooks[j].CreatedAt })
+	return hooks
+}
+
+func (d *WebhookDispatcher) Get(id string) (Webhook, []WebhookDeliveryLog, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	hook, ok := d.hooks[id]
+	if !ok {
+		return Webhook{}, nil, false
+	}
+	logs := make([]WebhookDeliveryLog, 0, len(d.logs[id]))
+	for i := len(d.logs[id]) - 1; i >= 0; i-- {
+		logs = append(logs, d.logs[id][i])
+	}
+	return hook.public(), logs, true
+}
+
+// Ping queues a ping event for one webhook regardless of its event types
+func (d *WebhookDispatcher) Ping(id string) bool {
+	payload, _ := json.Marshal(BroadcastMessage{
+		Type:    "ping",
+		Data:    map[string]interface{}{"webhook_id": id, "timestamp": time.Now().Format(time.RFC3339)},
+		EventID: time.Now().Format("20060102150405"),
+	})
+
+	d.mutex.Lock()
+	if _, ok := d.hooks[id]; !ok {
+		d.mutex.Unlock()
+		return false
+	}
+	d.queue = append(d.queue, &webhookDelivery{
+		ID:          randomHex(8),
+		WebhookID:   id,
+		EventType:   "ping",
+		Payload:     payload,
+		NextAttempt: time.Now(),
+	})
+	d.saveQueue()
+	d.mutex.Unlock()
+
+	d.dispatchDue()
+	return true
+}
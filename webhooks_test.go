@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a webhook endpoint answering with the queued status codes,
+// then 200
+type receiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	rc.times = append(rc.times, time.Now())
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) count() int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return len(rc.requests)
+}
+
+func newTestDispatcher(t *testing.T, cfg WebhooksConfig) *WebhookDispatcher {
+	t.Helper()
+	dataDir = t.TempDir()
+	d, err := newWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// publish runs an event through the dispatcher like run does
+func publish(d *WebhookDispatcher, eventType string) {
+	d.enqueue(BroadcastMessage{Type: eventType, Data: map[string]string{"user": "alice"}, EventID: "20260101000000"})
+	d.dispatchDue()
+}
+
+// waitFor polls cond while the dispatcher keeps dispatching due deliveries
+func waitFor(t *testing.T, d *WebhookDispatcher, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+		d.dispatchDue()
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	d := newTestDispatcher(t, WebhooksConfig{RetryBase: time.Second, MaxFailures: 3})
+	hook, err := d.Create(Webhook{URL: server.URL, Events: []string{"session"}, Secret: "topsecret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(d, "leaderboard") // not subscribed
+	publish(d, "session")
+	waitFor(t, d, func() bool { return rc.count() == 1 && d.QueueLength() == 0 })
+
+	r, body := rc.requests[0], rc.bodies[0]
+	mac := hmac.New(sha256.New, []byte("topsecret"))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Signature-256") != want {
+		t.Errorf("signature %q, want %q", r.Header.Get("X-Signature-256"), want)
+	}
+	if r.Header.Get("X-Webhook-ID") != hook.ID || r.Header.Get("X-Event-Type") != "session" {
+		t.Errorf("headers %v", r.Header)
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	retryBase := 50 * time.Millisecond
+	d := newTestDispatcher(t, WebhooksConfig{RetryBase: retryBase, MaxFailures: 10})
+	hook, err := d.Create(Webhook{URL: server.URL, Events: []string{"session"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(d, "session")
+	waitFor(t, d, func() bool { return rc.count() == 3 && d.QueueLength() == 0 })
+
+	// the delay doubles per failed attempt
+	if gap := rc.times[1].Sub(rc.times[0]); gap < retryBase {
+		t.Errorf("first retry after %s, want at least %s", gap, retryBase)
+	}
+	if gap := rc.times[2].Sub(rc.times[1]); gap < 2*retryBase {
+		t.Errorf("second retry after %s, want at least %s", gap, 2*retryBase)
+	}
+
+	current, logs, _ := d.Get(hook.ID)
+	if current.ConsecutiveFailures != 0 || !current.Enabled {
+		t.Errorf("webhook after success: %+v", current)
+	}
+	if len(logs) != 3 || logs[0].StatusCode != http.StatusOK || logs[2].StatusCode != http.StatusInternalServerError {
+		t.Errorf("delivery log %+v", logs)
+	}
+}
+
+func TestWebhookAutoDisable(t *testing.T) {
+	rc := &receiver{statuses: []int{500, 500, 500, 500}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	d := newTestDispatcher(t, WebhooksConfig{RetryBase: 10 * time.Millisecond, MaxFailures: 2})
+	hook, err := d.Create(Webhook{URL: server.URL, Events: []string{"session"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(d, "session")
+	publish(d, "session")
+	waitFor(t, d, func() bool {
+		current, _, _ := d.Get(hook.ID)
+		return !current.Enabled
+	})
+
+	current, _, _ := d.Get(hook.ID)
+	if current.DisabledReason == "" || current.ConsecutiveFailures < 2 {
+		t.Errorf("disabled webhook %+v", current)
+	}
+	waitFor(t, d, func() bool { return d.QueueLength() == 0 })
+
+	// a disabled webhook gets nothing
+	before := rc.count()
+	publish(d, "session")
+	time.Sleep(50 * time.Millisecond)
+	if rc.count() != before || d.QueueLength() != 0 {
+		t.Errorf("disabled webhook still receives events")
+	}
+}
+
+func TestWebhookQueueCap(t *testing.T) {
+	d := newTestDispatcher(t, WebhooksConfig{RetryBase: time.Hour, MaxFailures: 10})
+	// nothing listens there, the deliveries are never attempted
+	if _, err := d.Create(Webhook{URL: "http://127.0.0.1:1", Events: []string{"metrics"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < webhookMaxQueued+10; i++ {
+		d.enqueue(BroadcastMessage{Type: "metrics", Data: map[string]float64{"cpu": 1}})
+	}
+	if n := d.QueueLength(); n != webhookMaxQueued {
+		t.Errorf("queue length %d, want %d", n, webhookMaxQueued)
+	}
+}